@@ -17,6 +17,8 @@ func main() {
 		Password:   "123456",
 		CACertPath: "",
 		CAKeyPath:  "",
+
+		MetricsAddr: "127.0.0.1:9090",
 	}
 	srvProxy, httpsListener := util.HttpServer(proxy, &proxyConfig)
 	if srvProxy == nil || httpsListener == nil {
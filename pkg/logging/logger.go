@@ -27,6 +27,15 @@ func SetLevel(l zapcore.Level) {
 
 // NewLogger create a new logger with the given log level
 func NewLogger(level zapcore.Level) *zap.SugaredLogger {
+	return newLogger(level, "stdout")
+}
+
+// NewStderrLogger create a new logger with the given log level, writing to stderr
+func NewStderrLogger(level zapcore.Level) *zap.SugaredLogger {
+	return newLogger(level, "stderr")
+}
+
+func newLogger(level zapcore.Level, output string) *zap.SugaredLogger {
 	ec := zap.NewProductionEncoderConfig()
 	ec.EncodeTime = zapcore.ISO8601TimeEncoder
 	cfg := zap.Config{
@@ -34,7 +43,7 @@ func NewLogger(level zapcore.Level) *zap.SugaredLogger {
 		EncoderConfig:    ec,
 		Level:            zap.NewAtomicLevelAt(level),
 		Development:      false,
-		OutputPaths:      []string{"stdout"},
+		OutputPaths:      []string{output},
 		ErrorOutputPaths: []string{"stderr"},
 		// OutputPaths:      []string{fmt.Sprintf("iproxy.log")},
 		// ErrorOutputPaths: []string{fmt.Sprintf("iproxy-err.log")},
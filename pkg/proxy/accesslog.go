@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// AccessRecord describes one transaction handled by the proxy: a plain HTTP request,
+// a CONNECT tunnel, or a request sent inside a MITM'd connection.
+type AccessRecord struct {
+	// Time at which the proxy received the request
+	Time     time.Time
+	Duration time.Duration
+	Session  int64
+	// Mode is one of "http", "connect", "mitm", "http_mitm" or "hijack"
+	Mode     string
+	ClientIP string
+	// User is the authenticated proxy user, empty when unknown
+	User   string
+	Method string
+	// URL is the requested URL, or the host:port target of a CONNECT request
+	URL   string
+	Proto string
+	// Status is the status code sent to the client, 0 when none was sent
+	Status int
+	// BytesSent counts the body bytes sent to the client, for tunnels all bytes
+	// from the upstream server
+	BytesSent int64
+	// BytesReceived counts the bytes of a tunnel sent by the client, it is only
+	// set for CONNECT tunnels
+	BytesReceived int64
+	// UpstreamAddr is the address of the upstream server (or upstream proxy)
+	// the request was sent to, empty when the proxy did not connect anywhere
+	UpstreamAddr string
+	Referer      string
+	UserAgent    string
+	// Cached is true when a ReqHandler answered the request instead of the
+	// upstream server, as caches and replay handlers do
+	Cached bool
+	// Mitm is true for requests read from a MITM'd CONNECT tunnel
+	Mitm  bool
+	Error string
+}
+
+// AccessLogger receives one AccessRecord for every transaction, once it is complete.
+// It is called concurrently from the goroutines serving the clients.
+type AccessLogger interface {
+	LogAccess(rec *AccessRecord)
+}
+
+// newAccessRecord starts the record of the transaction of ctx, for request r.
+func newAccessRecord(ctx *ProxyCtx, r *http.Request, mode string) *AccessRecord {
+	if ctx.Proxy.AccessLog == nil {
+		return nil
+	}
+	rec := &AccessRecord{
+		Time:      time.Now(),
+		Session:   ctx.Session,
+		Mode:      mode,
+		ClientIP:  r.RemoteAddr,
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Mitm:      mode == modeMitm || mode == modeHTTPMitm,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		rec.ClientIP = host
+	}
+	if r.Method == "CONNECT" {
+		rec.URL = r.Host
+	}
+	return rec
+}
+
+// logAccess completes rec from ctx and hands it to the AccessLog. It does nothing
+// when rec is nil, that is when no access log is configured.
+func (ctx *ProxyCtx) logAccess(rec *AccessRecord, status int, err error) {
+	if rec == nil {
+		return
+	}
+	rec.Duration = time.Since(rec.Time)
+	rec.Status = status
+	rec.User = ctx.User
+	if ctx.RoundTripDetails != nil && ctx.RoundTripDetails.TCPAddr != nil {
+		rec.UpstreamAddr = ctx.RoundTripDetails.TCPAddr.String()
+	}
+	if err == nil {
+		err = ctx.Error
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	ctx.Proxy.AccessLog.LogAccess(rec)
+}
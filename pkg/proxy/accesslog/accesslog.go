@@ -0,0 +1,202 @@
+// Package accesslog writes one line per proxy transaction, in Common Log Format,
+// Combined Log Format, JSON, or a user supplied text/template.
+//
+//	proxy.AccessLog = accesslog.New(rotate.New("/var/log/proxy/access.log", 100<<20), accesslog.Combined)
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// Format writes a single record, including its trailing newline, to w.
+type Format func(w *bytes.Buffer, rec *goproxy.AccessRecord) error
+
+// Logger is a goproxy.AccessLogger writing formatted records to Out. Every record is
+// written with a single Write call, so Out can be a rotate.File.
+type Logger struct {
+	Out    io.Writer
+	Format Format
+	// OnError is called when writing a record fails, errors are dropped when nil
+	OnError func(err error)
+
+	mu   sync.Mutex
+	pool sync.Pool
+}
+
+// New returns a Logger writing records to out in the given format.
+func New(out io.Writer, format Format) *Logger {
+	return &Logger{Out: out, Format: format}
+}
+
+// LogAccess implements goproxy.AccessLogger.
+func (l *Logger) LogAccess(rec *goproxy.AccessRecord) {
+	buf, _ := l.pool.Get().(*bytes.Buffer)
+	if buf == nil {
+		buf = &bytes.Buffer{}
+	}
+	defer func() {
+		buf.Reset()
+		l.pool.Put(buf)
+	}()
+	err := l.Format(buf, rec)
+	if err == nil {
+		l.mu.Lock()
+		_, err = l.Out.Write(buf.Bytes())
+		l.mu.Unlock()
+	}
+	if err != nil && l.OnError != nil {
+		l.OnError(err)
+	}
+}
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func dashInt(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+func quote(s string) string {
+	return `"` + quoteEscaper.Replace(s) + `"`
+}
+
+func writeCommon(w *bytes.Buffer, rec *goproxy.AccessRecord) {
+	fmt.Fprintf(w, "%s - %s [%s] %s %s %s",
+		dash(rec.ClientIP),
+		dash(strings.ReplaceAll(rec.User, " ", "%20")),
+		rec.Time.Format(clfTimeFormat),
+		quote(rec.Method+" "+rec.URL+" "+rec.Proto),
+		dashInt(int64(rec.Status)),
+		dashInt(rec.BytesSent))
+}
+
+// Common is the Common Log Format:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/ HTTP/1.1" 200 2326
+var Common Format = func(w *bytes.Buffer, rec *goproxy.AccessRecord) error {
+	writeCommon(w, rec)
+	w.WriteByte('\n')
+	return nil
+}
+
+// Combined is the Combined Log Format, the Common Log Format followed by the referer and
+// the user agent.
+var Combined Format = func(w *bytes.Buffer, rec *goproxy.AccessRecord) error {
+	writeCommon(w, rec)
+	fmt.Fprintf(w, " %s %s\n", quote(dash(rec.Referer)), quote(dash(rec.UserAgent)))
+	return nil
+}
+
+type jsonRecord struct {
+	Time          string  `json:"time"`
+	DurationMs    float64 `json:"duration_ms"`
+	Session       int64   `json:"session"`
+	Mode          string  `json:"mode"`
+	ClientIP      string  `json:"client_ip"`
+	User          string  `json:"user,omitempty"`
+	Method        string  `json:"method"`
+	URL           string  `json:"url"`
+	Proto         string  `json:"proto"`
+	Status        int     `json:"status"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received,omitempty"`
+	UpstreamAddr  string  `json:"upstream_addr,omitempty"`
+	Referer       string  `json:"referer,omitempty"`
+	UserAgent     string  `json:"user_agent,omitempty"`
+	Cached        bool    `json:"cached"`
+	Mitm          bool    `json:"mitm"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// JSON writes every field of the record as a JSON object on its own line.
+var JSON Format = func(w *bytes.Buffer, rec *goproxy.AccessRecord) error {
+	return json.NewEncoder(w).Encode(jsonRecord{
+		Time:          rec.Time.Format(time.RFC3339Nano),
+		DurationMs:    durationMs(rec.Duration),
+		Session:       rec.Session,
+		Mode:          rec.Mode,
+		ClientIP:      rec.ClientIP,
+		User:          rec.User,
+		Method:        rec.Method,
+		URL:           rec.URL,
+		Proto:         rec.Proto,
+		Status:        rec.Status,
+		BytesSent:     rec.BytesSent,
+		BytesReceived: rec.BytesReceived,
+		UpstreamAddr:  rec.UpstreamAddr,
+		Referer:       rec.Referer,
+		UserAgent:     rec.UserAgent,
+		Cached:        rec.Cached,
+		Mitm:          rec.Mitm,
+		Error:         rec.Error,
+	})
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+var templateFuncs = template.FuncMap{
+	"clf":   func(t time.Time) string { return t.Format(clfTimeFormat) },
+	"ms":    durationMs,
+	"dash":  dash,
+	"quote": quote,
+}
+
+// Template returns a Format executing a text/template with the *goproxy.AccessRecord as
+// data. Besides the builtin functions, templates can use clf (formats a time as in the
+// Common Log Format), ms (converts a duration to milliseconds), dash (replaces an empty
+// string with "-") and quote. A newline is appended when the output lacks one.
+//
+//	accesslog.Template(`{{.ClientIP}} {{dash .User}} {{.Method}} {{.URL}} {{.Status}} {{ms .Duration}}ms {{.UpstreamAddr}}`)
+func Template(text string) (Format, error) {
+	tmpl, err := template.New("accesslog").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(w *bytes.Buffer, rec *goproxy.AccessRecord) error {
+		start := w.Len()
+		if err := tmpl.Execute(w, rec); err != nil {
+			return err
+		}
+		if w.Len() == start || w.Bytes()[w.Len()-1] != '\n' {
+			w.WriteByte('\n')
+		}
+		return nil
+	}, nil
+}
+
+// ParseFormat returns the format named "common", "combined" or "json", and otherwise
+// parses name as a template.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common", "clf":
+		return Common, nil
+	case "combined", "":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	}
+	return Template(name)
+}
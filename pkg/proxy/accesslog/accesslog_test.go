@@ -0,0 +1,173 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/accesslog"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := strings.TrimSpace(b.buf.String())
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+var sample = &goproxy.AccessRecord{
+	Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+	Duration:  1500 * time.Microsecond,
+	Mode:      "http",
+	ClientIP:  "127.0.0.1",
+	User:      "frank",
+	Method:    "GET",
+	URL:       "http://example.com/a",
+	Proto:     "HTTP/1.1",
+	Status:    200,
+	BytesSent: 2326,
+	Referer:   "http://example.com/",
+	UserAgent: `Mozilla "4.08"`,
+}
+
+func format(t *testing.T, f accesslog.Format, rec *goproxy.AccessRecord) string {
+	var buf bytes.Buffer
+	if err := f(&buf, rec); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestFormats(t *testing.T) {
+	if got := format(t, accesslog.Common, sample); got != `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/a HTTP/1.1" 200 2326`+"\n" {
+		t.Errorf("unexpected common log line %q", got)
+	}
+	if got := format(t, accesslog.Combined, sample); got != `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/a HTTP/1.1" 200 2326 "http://example.com/" "Mozilla \"4.08\""`+"\n" {
+		t.Errorf("unexpected combined log line %q", got)
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(format(t, accesslog.JSON, sample)), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["user"] != "frank" || rec["status"] != float64(200) || rec["duration_ms"] != 1.5 {
+		t.Errorf("unexpected json record %v", rec)
+	}
+	tmpl, err := accesslog.Template(`{{.ClientIP}} {{dash .UpstreamAddr}} {{ms .Duration}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := format(t, tmpl, sample); got != "127.0.0.1 - 1.5\n" {
+		t.Errorf("unexpected template output %q", got)
+	}
+	if _, err := accesslog.ParseFormat("{{.Nope"); err == nil {
+		t.Error("invalid template should not parse")
+	}
+}
+
+func TestProxyTransactions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer tlsUpstream.Close()
+	mitmUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "mitm")
+	}))
+	defer mitmUpstream.Close()
+
+	out := &syncBuffer{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.AccessLog = accesslog.New(out, accesslog.JSON)
+	proxy.OnRequest(goproxy.ReqHostIs(mitmUpstream.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/cached")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.TextResponse(req, "from cache")
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	for _, u := range []string{upstream.URL + "/plain", upstream.URL + "/cached", tlsUpstream.URL + "/tunnel", mitmUpstream.URL + "/inner"} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// tunnels are logged when they close, which happens asynchronously
+	var records []map[string]interface{}
+	for i := 0; i < 100; i++ {
+		if len(out.lines()) >= 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range out.lines() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	find := func(mode, suffix string) map[string]interface{} {
+		for _, rec := range records {
+			if rec["mode"] == mode && strings.HasSuffix(rec["url"].(string), suffix) {
+				return rec
+			}
+		}
+		t.Errorf("no %s record for %s in %v", mode, suffix, out.lines())
+		return map[string]interface{}{}
+	}
+	plain := find("http", "/plain")
+	if plain["status"] != float64(200) || plain["bytes_sent"] != float64(5) || plain["client_ip"] != "127.0.0.1" ||
+		plain["upstream_addr"] != upstream.Listener.Addr().String() || plain["cached"] != false {
+		t.Errorf("unexpected plain record %v", plain)
+	}
+	if cached := find("http", "/cached"); cached["cached"] != true || cached["status"] != float64(202) {
+		t.Errorf("unexpected cached record %v", cached)
+	}
+	tunnel := find("connect", tlsUpstream.Listener.Addr().String())
+	if tunnel["status"] != float64(200) || tunnel["bytes_sent"] == float64(0) || tunnel["bytes_received"] == float64(0) ||
+		tunnel["upstream_addr"] != tlsUpstream.Listener.Addr().String() || tunnel["mitm"] != false {
+		t.Errorf("unexpected tunnel record %v", tunnel)
+	}
+	if inner := find("mitm", "/inner"); inner["mitm"] != true || inner["bytes_sent"] != float64(4) {
+		t.Errorf("unexpected mitm record %v", inner)
+	}
+	if connect := find("connect", mitmUpstream.Listener.Addr().String()); connect["mitm"] != true {
+		t.Errorf("unexpected mitm connect record %v", connect)
+	}
+}
@@ -7,8 +7,29 @@ import (
 	"time"
 
 	"github.com/acentior/go-httpproxy/pkg/logging"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
 )
 
+var (
+	clientBytesTotal = metrics.NewCounterVec("proxy_client_bytes_total",
+		"Bytes exchanged with proxy clients, by authenticated user and direction (in or out).",
+		"user", "direction")
+	clientConnections = metrics.NewGaugeVec("proxy_client_connections",
+		"Currently open client connections.")
+	savedBytesTotal = metrics.NewCounterVec("proxy_saved_bytes_total",
+		"Bytes saved by sending proxy clients smaller responses than received, by authenticated user.",
+		"user")
+)
+
+// AddSaved records n bytes saved for the given proxy user, by transformations making
+// the responses smaller, as the recompression of images.
+func AddSaved(user string, n int) {
+	if user == "" {
+		user = "-"
+	}
+	savedBytesTotal.With(user).Add(float64(n))
+}
+
 type ConnMap struct {
 	conns map[string]net.Conn
 	m     sync.Mutex
@@ -18,7 +39,7 @@ func NewConnMap() *ConnMap {
 	return &ConnMap{conns: map[string]net.Conn{}}
 }
 
-func (cm ConnMap) Pop(remoteAddr string) (net.Conn, bool) {
+func (cm *ConnMap) Pop(remoteAddr string) (net.Conn, bool) {
 	logging.DefaultLogger().Debugf("ConnMap popping '%v'", remoteAddr)
 	cm.m.Lock()
 	defer cm.m.Unlock()
@@ -27,14 +48,14 @@ func (cm ConnMap) Pop(remoteAddr string) (net.Conn, bool) {
 	return c, ok
 }
 
-func (cm ConnMap) Push(conn net.Conn) {
+func (cm *ConnMap) Push(conn net.Conn) {
 	logging.DefaultLogger().Debugf("ConnMap pushing '%v'", conn.RemoteAddr().String())
 	cm.m.Lock()
 	defer cm.m.Unlock()
 	cm.conns[conn.RemoteAddr().String()] = conn
 }
 
-func (cm ConnMap) Find(remoteAddr string) (net.Conn, bool) {
+func (cm *ConnMap) Find(remoteAddr string) (net.Conn, bool) {
 	logging.DefaultLogger().Debugf("ConnMap finding '%v'", remoteAddr)
 	cm.m.Lock()
 	defer cm.m.Unlock()
@@ -57,18 +78,33 @@ func InterceptListen(network, laddr string) (net.Listener, *ConnMap, error) {
 	return &InterceptListener{realListener: l, connMap: connMap}, connMap, nil
 }
 
-func InterceptListenTLS(net, laddr, certFile, keyFile string) (net.Listener, *ConnMap, error) {
-	interceptListener, connMap, err := InterceptListen(net, laddr)
+// InterceptListenTLS creates a listener like InterceptListen, serving TLS with the
+// certificate and key of certFile and keyFile, reloaded when they change.
+func InterceptListenTLS(network, laddr, certFile, keyFile string) (net.Listener, *ConnMap, error) {
+	keyPair, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return InterceptListenTLSConfig(network, laddr, &tls.Config{GetCertificate: keyPair.GetCertificate})
+}
 
-	config := &tls.Config{NextProtos: []string{"h2"}}
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+// InterceptListenTLSConfig creates a listener like InterceptListen, serving TLS with
+// config. Only HTTP/1.1 is negotiated, since CONNECT tunnels need to hijack the
+// connections.
+func InterceptListenTLSConfig(network, laddr string, config *tls.Config) (net.Listener, *ConnMap, error) {
+	interceptListener, connMap, err := InterceptListen(network, laddr)
 	if err != nil {
 		return nil, nil, err
 	}
+	return tls.NewListener(interceptListener, TLSConfig(config)), connMap, nil
+}
 
-	tlsLst := tls.NewListener(interceptListener, config)
-	return tlsLst, connMap, nil
+// TLSConfig returns a copy of config negotiating HTTP/1.1 only, for the listeners of
+// the proxy.
+func TLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	return config
 }
 
 func (l *InterceptListener) Accept() (net.Conn, error) {
@@ -77,6 +113,7 @@ func (l *InterceptListener) Accept() (net.Conn, error) {
 		return c, err
 	}
 	interceptConn := &InterceptConn{realConn: c}
+	clientConnections.With().Inc()
 	l.connMap.Push(interceptConn)
 	logging.DefaultLogger().Debugf("InterceptListener Accept conn %s", c.RemoteAddr())
 	return interceptConn, nil
@@ -94,6 +131,8 @@ type InterceptConn struct {
 	realConn     net.Conn
 	bytesRead    int
 	bytesWritten int
+	user         string
+	closeOnce    sync.Once
 
 	OnClose func(bytesRead, bytesWritten int)
 }
@@ -106,6 +145,12 @@ func (c *InterceptConn) BytesWritten() int {
 	return c.bytesWritten
 }
 
+// SetUser attributes the bytes of this connection to the given proxy user
+// in the bandwidth metrics.
+func (c *InterceptConn) SetUser(user string) {
+	c.user = user
+}
+
 func (c *InterceptConn) Read(b []byte) (n int, err error) {
 	n, err = c.realConn.Read(b)
 	c.bytesRead += n
@@ -120,6 +165,15 @@ func (c *InterceptConn) Write(b []byte) (n int, err error) {
 
 func (c *InterceptConn) Close() error {
 	logging.DefaultLogger().Debugf("InterceptConn was closed: %s", c.RemoteAddr())
+	c.closeOnce.Do(func() {
+		clientConnections.With().Dec()
+		user := c.user
+		if user == "" {
+			user = "-"
+		}
+		clientBytesTotal.With(user, "in").Add(float64(c.bytesRead))
+		clientBytesTotal.With(user, "out").Add(float64(c.bytesWritten))
+	})
 	if c.OnClose != nil {
 		c.OnClose(c.bytesRead, c.bytesWritten)
 	}
@@ -0,0 +1,162 @@
+package bandwidth
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/logging"
+)
+
+// peekTimeout bounds the wait for the first bytes of a connection of a MuxListener.
+const peekTimeout = 10 * time.Second
+
+var errMuxClosed = errors.New("bandwidth: mux listener closed")
+
+// MuxListener serves several protocols on a single port. It accepts the connections of
+// an InterceptListener, and dispatches them to the listener of their protocol, detected
+// from their first bytes: SOCKS4 and SOCKS5 to SOCKS, a TLS ClientHello to TLS, and
+// everything else to HTTP. The connections of a protocol whose listener was not asked
+// for are closed. The bytes peeked are counted once, as the other bytes of the
+// connections.
+type MuxListener struct {
+	l *InterceptListener
+
+	mu                   sync.Mutex
+	http, socks, tlsConn *muxListener
+	done                 chan struct{}
+	closeOnce            sync.Once
+}
+
+// InterceptListenMux creates a MuxListener on a listener created by InterceptListen.
+func InterceptListenMux(network, laddr string) (*MuxListener, *ConnMap, error) {
+	l, connMap, err := InterceptListen(network, laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &MuxListener{l: l.(*InterceptListener), done: make(chan struct{})}
+	go m.serve()
+	return m, connMap, nil
+}
+
+// HTTP returns the listener of the connections that are neither SOCKS nor TLS.
+func (m *MuxListener) HTTP() net.Listener {
+	return m.route(&m.http)
+}
+
+// SOCKS returns the listener of the SOCKS4 and SOCKS5 connections.
+func (m *MuxListener) SOCKS() net.Listener {
+	return m.route(&m.socks)
+}
+
+// TLS returns the listener of the TLS connections, to be wrapped by tls.NewListener.
+func (m *MuxListener) TLS() net.Listener {
+	return m.route(&m.tlsConn)
+}
+
+func (m *MuxListener) route(l **muxListener) net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if *l == nil {
+		*l = &muxListener{m: m, conns: make(chan net.Conn)}
+	}
+	return *l
+}
+
+// Close closes the port, and so all the listeners of m.
+func (m *MuxListener) Close() error {
+	err := errMuxClosed
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.l.Close()
+	})
+	return err
+}
+
+// Addr returns the address of the port.
+func (m *MuxListener) Addr() net.Addr {
+	return m.l.Addr()
+}
+
+func (m *MuxListener) serve() {
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			logging.DefaultLogger().Debugf("MuxListener stops accepting: %v", err)
+			m.Close()
+			return
+		}
+		// the first bytes are awaited without blocking the other connections
+		go m.dispatch(c)
+	}
+}
+
+func (m *MuxListener) dispatch(c net.Conn) {
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(peekTimeout))
+	first, err := r.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+	m.mu.Lock()
+	var l *muxListener
+	switch first[0] {
+	case 4, 5:
+		l = m.socks
+	case 0x16:
+		// handshake record of TLS
+		l = m.tlsConn
+	default:
+		l = m.http
+	}
+	m.mu.Unlock()
+	if l == nil {
+		logging.DefaultLogger().Debugf("MuxListener has no listener for %s starting with %#x", c.RemoteAddr(), first[0])
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- &peekedConn{Conn: c, r: r}:
+	case <-m.done:
+		c.Close()
+	}
+}
+
+// muxListener is the listener of a protocol of a MuxListener.
+type muxListener struct {
+	m     *MuxListener
+	conns chan net.Conn
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.m.done:
+		return nil, errMuxClosed
+	}
+}
+
+// Close closes the port, and so all the listeners of the MuxListener.
+func (l *muxListener) Close() error {
+	return l.m.Close()
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.m.Addr()
+}
+
+// peekedConn is a connection whose first bytes were read to detect its protocol.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	// the bufio.Reader reads directly into b once its buffer is drained
+	return c.r.Read(b)
+}
@@ -0,0 +1,93 @@
+package bandwidth
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/logging"
+)
+
+// DefaultCheckInterval is the interval at which a KeyPair checks its files.
+const DefaultCheckInterval = 10 * time.Second
+
+// KeyPair is a certificate and its key loaded from files, loaded again when the files
+// change, so that the certificate of a TLS listener can be renewed without restart.
+type KeyPair struct {
+	CertFile, KeyFile string
+	// CheckInterval is the interval at which the files are checked for changes, during
+	// the handshakes. The default is DefaultCheckInterval.
+	CheckInterval time.Duration
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+// LoadKeyPair loads the KeyPair of certFile and keyFile, the files holding PEM data.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	k := &KeyPair{CertFile: certFile, KeyFile: keyFile}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KeyPair) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{k.CertFile, k.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Reload loads the files again. On error the previous certificate is kept.
+func (k *KeyPair) Reload() error {
+	modTimes, err := k.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(k.CertFile, k.KeyFile)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.cert, k.modTimes, k.checked = &cert, modTimes, time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate, loading it again if the files changed. It is
+// meant for tls.Config.GetCertificate.
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	interval := k.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	k.mu.Lock()
+	cert, modTimes, check := k.cert, k.modTimes, time.Since(k.checked) >= interval
+	if check {
+		k.checked = time.Now()
+	}
+	k.mu.Unlock()
+	if !check {
+		return cert, nil
+	}
+	if current, err := k.stat(); err == nil && current == modTimes {
+		return cert, nil
+	}
+	// the files may be half written, the next check loading them again
+	if err := k.Reload(); err != nil {
+		logging.DefaultLogger().Warnw("KeyPair failed to reload certificate", "cert", k.CertFile, "err", err)
+		return cert, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.cert, nil
+}
@@ -1,9 +1,18 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+	"github.com/acentior/go-httpproxy/pkg/proxy/transport"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
@@ -20,9 +29,38 @@ type ProxyCtx struct {
 	// call of RespHandler
 	UserData interface{}
 	// Will connect a request to a response
-	Session   int64
-	certStore CertStorage
-	Proxy     *ProxyHttpServer
+	Session int64
+	// The proxy user, set by authentication handlers once the user is authenticated
+	User string
+	// LocalAddr is the local IP address of the connections made to the servers for the
+	// transaction, set by handlers to bind it, the system choosing it when nil
+	LocalAddr net.IP
+	// ResolveDuration is the time taken to resolve the host of the last connection made
+	// for the transaction by the Resolver of the proxy
+	ResolveDuration time.Duration
+	// Will contain the upstream connection used by RoundTrip or by the CONNECT tunnel
+	// (nil if no connection was made yet)
+	RoundTripDetails *transport.RoundTripDetails
+	certStore        CertStorage
+	Proxy            *ProxyHttpServer
+	// span of the transaction, nil when tracing is disabled
+	span *tracing.Span
+	// values stored by SetValue
+	values map[interface{}]interface{}
+}
+
+// SetValue stores val under key until the end of the transaction. Unlike UserData, it lets
+// several handlers keep their own state, each one using a key of an unexported type.
+func (ctx *ProxyCtx) SetValue(key, val interface{}) {
+	if ctx.values == nil {
+		ctx.values = make(map[interface{}]interface{})
+	}
+	ctx.values[key] = val
+}
+
+// Value returns the value stored under key by SetValue, nil if there is none.
+func (ctx *ProxyCtx) Value(key interface{}) interface{} {
+	return ctx.values[key]
 }
 
 type RoundTripper interface {
@@ -39,33 +77,140 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 	return f(req, ctx)
 }
 
-func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+type proxyCtxKey struct{}
+
+// targetKey carries the host the transaction connects to for its client, whose
+// connections are checked against the AddrPolicy of the proxy.
+type targetKey struct{}
+
+// withProxyCtx returns a copy of req whose context carries ctx, req being sent to its
+// host for the client of ctx.
+func withProxyCtx(req *http.Request, ctx *ProxyCtx) *http.Request {
+	return req.WithContext(proxyContext(req.Context(), ctx, req.URL.Host))
+}
+
+// proxyContext returns a copy of c carrying ctx and the host of target, the address the
+// transaction connects to for its client.
+func proxyContext(c context.Context, ctx *ProxyCtx, target string) context.Context {
+	c = context.WithValue(c, proxyCtxKey{}, ctx)
+	return context.WithValue(c, targetKey{}, targetHost(target))
+}
+
+// targetHost returns the host of s, a host or a host:port, without the brackets of
+// IPv6 addresses.
+func targetHost(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
+
+// sameHost reports whether the hosts a and b, without port, are the same: the same
+// IP address in any of its forms, or the same name.
+func sameHost(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA != nil || ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// ProxyCtxFromContext returns the ProxyCtx of the transaction of a request sent by the
+// proxy, from the context of the request given to the Proxy function of Tr, to
+// ConnectDialWithReq, or to a RoundTripper.
+func ProxyCtxFromContext(c context.Context) (*ProxyCtx, bool) {
+	ctx, ok := c.Value(proxyCtxKey{}).(*ProxyCtx)
+	return ctx, ok
+}
+
+func (ctx *ProxyCtx) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	req = withProxyCtx(req, ctx)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			ctx.RoundTripDetails = connDetails(req.URL.Host, info.Conn)
+		},
+	}))
+	span := ctx.span.Child("proxy.roundTrip", tracing.SpanKindClient)
+	if span != nil {
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.url", req.URL.String())
+		tracing.Inject(req.Header, span)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace(span)))
+		defer func() {
+			if resp != nil {
+				span.SetAttribute("http.status_code", resp.StatusCode)
+			}
+			span.RecordError(err)
+			span.End()
+		}()
+	}
 	if ctx.RoundTripper != nil {
-		return ctx.RoundTripper.RoundTrip(req, ctx)
+		resp, err = ctx.RoundTripper.RoundTrip(req, ctx)
+	} else {
+		resp, err = ctx.Proxy.transport(ctx.LocalAddr).RoundTrip(req)
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
+	if status := dialErrorStatus(err); err != nil && status != http.StatusBadGateway {
+		// answered for the server, so that the client knows why
+		observeDialError(err, true)
+		return NewResponse(req, ContentTypeText, status, err.Error()+"\n"), nil
+	}
+	return resp, err
 }
 
-func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
-	ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
+func connDetails(host string, c net.Conn) *transport.RoundTripDetails {
+	details := &transport.RoundTripDetails{Host: host}
+	if c != nil {
+		details.TCPAddr, _ = c.RemoteAddr().(*net.TCPAddr)
+	}
+	return details
 }
 
-// Logf prints a message to the proxy's log. Should be used in a ProxyHttpServer's filter
-// This message will be printed only if the Verbose field of the ProxyHttpServer is set to true
+// Log sends an event to the proxy's log, adding the session, user and host of the
+// transaction to the given key-value pairs. Events are dropped when the proxy has no Log.
+func (ctx *ProxyCtx) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	l := ctx.Proxy.logger()
+	if l == nil || !l.Enabled(level) {
+		return
+	}
+	fields := make([]interface{}, 0, len(keysAndValues)+6)
+	fields = append(fields, "session", ctx.Session)
+	if ctx.User != "" {
+		fields = append(fields, "user", ctx.User)
+	}
+	if host := ctx.host(); host != "" {
+		fields = append(fields, "host", host)
+	}
+	l.Log(level, msg, append(fields, keysAndValues...)...)
+}
+
+func (ctx *ProxyCtx) host() string {
+	if ctx.Req == nil {
+		return ""
+	}
+	if ctx.Req.URL != nil && ctx.Req.URL.Host != "" {
+		return ctx.Req.URL.Host
+	}
+	return ctx.Req.Host
+}
+
+func (ctx *ProxyCtx) logf(level LogLevel, msg string, argv ...interface{}) {
+	if l := ctx.Proxy.logger(); l != nil && l.Enabled(level) {
+		ctx.Log(level, fmt.Sprintf(msg, argv...))
+	}
+}
+
+// Logf prints a debug message to the proxy's log. Should be used in a ProxyHttpServer's filter
 //
 //	proxy.OnRequest().DoFunc(func(r *http.Request,ctx *goproxy.ProxyCtx) (*http.Request, *http.Response){
 //		nr := atomic.AddInt32(&counter,1)
-//		ctx.Printf("So far %d requests",nr)
+//		ctx.Logf("So far %d requests",nr)
 //		return r, nil
 //	})
 func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
-	if ctx.Proxy.Verbose {
-		ctx.printf("INFO: "+msg, argv...)
-	}
+	ctx.logf(LevelDebug, msg, argv...)
 }
 
-// Warnf prints a message to the proxy's log. Should be used in a ProxyHttpServer's filter
-// This message will always be printed.
+// Warnf prints a warning to the proxy's log. Should be used in a ProxyHttpServer's filter
 //
 //	proxy.OnRequest().DoFunc(func(r *http.Request,ctx *goproxy.ProxyCtx) (*http.Request, *http.Response){
 //		f,err := os.OpenFile(cachedContent)
@@ -76,7 +221,27 @@ func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
 //		return r, nil
 //	})
 func (ctx *ProxyCtx) Warnf(msg string, argv ...interface{}) {
-	ctx.printf("WARN: "+msg, argv...)
+	ctx.logf(LevelWarn, msg, argv...)
+}
+
+// Debugw logs a debug event with the given key-value pairs, see Log.
+func (ctx *ProxyCtx) Debugw(msg string, keysAndValues ...interface{}) {
+	ctx.Log(LevelDebug, msg, keysAndValues...)
+}
+
+// Infow logs an informational event with the given key-value pairs, see Log.
+func (ctx *ProxyCtx) Infow(msg string, keysAndValues ...interface{}) {
+	ctx.Log(LevelInfo, msg, keysAndValues...)
+}
+
+// Warnw logs a warning with the given key-value pairs, see Log.
+func (ctx *ProxyCtx) Warnw(msg string, keysAndValues ...interface{}) {
+	ctx.Log(LevelWarn, msg, keysAndValues...)
+}
+
+// Errorw logs an error with the given key-value pairs, see Log.
+func (ctx *ProxyCtx) Errorw(msg string, keysAndValues ...interface{}) {
+	ctx.Log(LevelError, msg, keysAndValues...)
 }
 
 var charsetFinder = regexp.MustCompile("charset=([^ ;]*)")
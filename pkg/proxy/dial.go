@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// minAttemptTimeout bounds the share of dialTimeout of each address of a host
+	minAttemptTimeout = 2 * time.Second
+)
+
+// Resolver resolves the hosts the proxy connects to. network is "ip", "ip4" or "ip6".
+// The ProxyCtx of the transaction, if any, is given by ProxyCtxFromContext(ctx).
+// *net.Resolver is a Resolver.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// dial connects to addr with the dialer of Tr, c carrying the transaction the
+// connection is made for, if any.
+func (proxy *ProxyHttpServer) dial(c context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Tr.DialContext != nil {
+		return proxy.Tr.DialContext(c, network, addr)
+	}
+	if proxy.Tr.Dial != nil {
+		return proxy.Tr.Dial(network, addr)
+	}
+	return proxy.DialContext(c, network, addr)
+}
+
+// DialContext connects to addr from the LocalAddr of the transaction of c, if any,
+// resolving its host with the Resolver of the proxy. The addresses of the host are
+// tried in turn. When the host is the one of the transaction, the addresses denied by
+// the AddrPolicy of the proxy fail with a ForbiddenAddrError, and its ListenAddrs with
+// ErrLoop. It is the default DialContext of Tr.
+func (proxy *ProxyHttpServer) DialContext(c context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{KeepAlive: 30 * time.Second}
+	ipNetwork := "ip"
+	switch {
+	case strings.HasSuffix(network, "4"):
+		ipNetwork = "ip4"
+	case strings.HasSuffix(network, "6"):
+		ipNetwork = "ip6"
+	}
+	ctx, _ := ProxyCtxFromContext(c)
+	target, _ := c.Value(targetKey{}).(string)
+	// else an upstream proxy, or a connection made by the proxy for itself
+	isTarget := target != "" && sameHost(target, host)
+	policy := proxy.AddrPolicy
+	if !isTarget {
+		policy = nil
+	}
+	if ctx != nil && ctx.LocalAddr != nil {
+		d.LocalAddr = localAddr(network, ctx.LocalAddr)
+		// the addresses of the other family cannot be reached from LocalAddr
+		if ctx.LocalAddr.To4() != nil {
+			ipNetwork = "ip4"
+		} else {
+			ipNetwork = "ip6"
+		}
+	}
+	ips, err := proxy.lookupIP(c, ipNetwork, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	deadline := time.Now().Add(dialTimeout)
+	if d, ok := c.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	var firstErr error
+	for i, ip := range ips {
+		if isTarget && proxy.isListenAddr(ip, port) {
+			if ctx != nil {
+				ctx.Warnf("Rejected connection to %s (%s): %v", host, ip, ErrLoop)
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ErrLoop}
+		}
+		if !policy.Allowed(ip) {
+			err := &ForbiddenAddrError{Host: host, IP: ip}
+			if ctx != nil {
+				ctx.Warnf("Denied %v", err)
+			}
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Err: err}
+			}
+			continue
+		}
+		// each address gets its share of the time left, as the net package does
+		d.Deadline = deadline
+		if left := time.Until(deadline) / time.Duration(len(ips)-i); left > minAttemptTimeout {
+			d.Deadline = time.Now().Add(left)
+		}
+		conn, err := d.DialContext(c, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if c.Err() != nil || !time.Now().Before(deadline) {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// lookupIP returns the addresses of host, resolved by the Resolver of the proxy, the
+// system resolver when nil. The duration of the resolution is reported to the client
+// trace of c, or to the span of its transaction, and recorded in its ProxyCtx.
+func (proxy *ProxyHttpServer) lookupIP(c context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r := proxy.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ctx, _ := ProxyCtxFromContext(c)
+	trace := httptrace.ContextClientTrace(c)
+	var span *tracing.Span
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	} else if ctx != nil {
+		span = ctx.span.Child("proxy.dns", tracing.SpanKindClient)
+		span.SetAttribute("net.host.name", host)
+	}
+	start := time.Now()
+	ips, err := r.LookupIP(c, network, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	elapsed := time.Since(start)
+	observeLookup(err, elapsed)
+	if ctx != nil {
+		ctx.ResolveDuration = elapsed
+	}
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	}
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		if _, ok := err.(*net.DNSError); !ok {
+			err = &net.DNSError{Err: err.Error(), Name: host}
+		}
+		return nil, err
+	}
+	return ips, nil
+}
+
+func localAddr(network string, ip net.IP) net.Addr {
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
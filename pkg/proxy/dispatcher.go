@@ -100,7 +100,8 @@ func ReqHostIs(hosts ...string) ReqConditionFunc {
 var localHostIpv4 = regexp.MustCompile(`127\.0\.0\.\d+`)
 
 // IsLocalHost checks whether the destination host is explicitly local host
-// (buggy, there can be IPv6 addresses it doesn't catch)
+// (buggy, there can be IPv6 addresses it doesn't catch, and hosts resolving to local
+// addresses, see AddrPolicy for a check of the resolved addresses)
 var IsLocalHost ReqConditionFunc = func(req *http.Request, ctx *ProxyCtx) bool {
 	return req.URL.Host == "::1" ||
 		req.URL.Host == "0:0:0:0:0:0:0:1" ||
@@ -136,6 +137,17 @@ func SrcIpIs(ips ...string) ReqCondition {
 	})
 }
 
+// UserIs returns a ReqCondition testing whether the authenticated proxy user is one of the given users
+func UserIs(users ...string) ReqConditionFunc {
+	userSet := make(map[string]bool)
+	for _, u := range users {
+		userSet[u] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return ctx.User != "" && userSet[ctx.User]
+	}
+}
+
 // Not returns a ReqCondition negating the given ReqCondition
 func Not(r ReqCondition) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
@@ -333,8 +345,13 @@ var AlwaysReject FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAc
 // HandleBytes will return a RespHandler that read the entire body of the request
 // to a byte array in memory, would run the user supplied f function on the byte arra,
 // and will replace the body of the original response with the resulting byte array.
+// Encoded bodies are decoded first, and left alone if their encoding is not supported.
 func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if err := DecodeBody(resp, ctx); err != nil {
+			ctx.Warnf("Cannot decode response %s", err)
+			return resp
+		}
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			ctx.Warnf("Cannot read response %s", err)
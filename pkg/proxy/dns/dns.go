@@ -0,0 +1,355 @@
+// Package dns resolves the hosts the proxy connects to. A Resolver caches the answers
+// for the TTL of their records, answers some hosts from static overrides, for all the
+// users or for some of them, and queries the DNS servers of the domains they belong to,
+// over UDP or DNS over HTTPS.
+//
+//	corp, _ := dns.ParseUpstream("udp://10.0.0.53")
+//	r := &dns.Resolver{
+//		Upstream: &dns.DoH{URL: "https://dns.example/dns-query"},
+//		Domains:  map[string]dns.Upstream{"corp.example": corp},
+//		Hosts:    map[string][]net.IP{"api.example.com": {net.ParseIP("192.0.2.10")}},
+//	}
+//	proxy.Resolver = r
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultSystemTTL is how long the answers of the system resolver are cached, their
+	// TTL being unknown.
+	DefaultSystemTTL = 30 * time.Second
+	// DefaultNegativeTTL is how long the hosts found not to exist are cached.
+	DefaultNegativeTTL = 10 * time.Second
+	// DefaultMaxTTL bounds the time the answers are cached.
+	DefaultMaxTTL = time.Hour
+	// DefaultMaxEntries bounds the number of answers cached.
+	DefaultMaxEntries = 10000
+)
+
+// Resolver resolves hosts with a cache, static overrides and DNS servers by domain. It
+// is a goproxy.Resolver.
+type Resolver struct {
+	// Upstream is the DNS server of the hosts of no domain of Domains, the system
+	// resolver when nil
+	Upstream Upstream
+	// Domains are the DNS servers of domains and their subdomains, the longest domain
+	// matching a host being used
+	Domains map[string]Upstream
+	// Hosts are the addresses of hosts, answered without query
+	Hosts map[string][]net.IP
+	// UserHosts are the addresses of hosts for proxy users, before Hosts. They apply to
+	// the connections the proxy makes, which Tr may reuse for the other users
+	UserHosts map[string]map[string][]net.IP
+	// MinTTL and MaxTTL bound the time the answers are cached, MaxTTL being
+	// DefaultMaxTTL when 0
+	MinTTL, MaxTTL time.Duration
+	// SystemTTL is how long the answers of the system resolver are cached,
+	// DefaultSystemTTL when 0
+	SystemTTL time.Duration
+	// NegativeTTL is how long the hosts found not to exist are cached,
+	// DefaultNegativeTTL when 0
+	NegativeTTL time.Duration
+	// MaxEntries is the number of answers cached, DefaultMaxEntries when 0
+	MaxEntries int
+
+	mu    sync.Mutex
+	cache map[string]*entry
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// LookupIP returns the addresses of host, of the family of network, "ip", "ip4" or
+// "ip6". The overrides of the user of the ProxyCtx of ctx, if any, apply.
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if pctx, ok := goproxy.ProxyCtxFromContext(ctx); ok && pctx.User != "" {
+		if ips, ok := r.UserHosts[pctx.User][name]; ok {
+			return family(ips, network), nil
+		}
+	}
+	if ips, ok := r.Hosts[name]; ok {
+		return family(ips, network), nil
+	}
+
+	key := network + " " + name
+	now := time.Now()
+	r.mu.Lock()
+	e, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ips, ttl, err := r.resolve(ctx, network, name)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		ttl = r.clamp(ttl)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		ttl = r.NegativeTTL
+		if ttl <= 0 {
+			ttl = DefaultNegativeTTL
+		}
+	default:
+		// failures of the servers are not cached
+		return nil, err
+	}
+	r.store(key, &entry{ips: ips, err: err, expires: now.Add(ttl)})
+	return ips, err
+}
+
+func (r *Resolver) clamp(ttl time.Duration) time.Duration {
+	max := r.MaxTTL
+	if max <= 0 {
+		max = DefaultMaxTTL
+	}
+	if ttl > max {
+		ttl = max
+	}
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	return ttl
+}
+
+func (r *Resolver) store(key string, e *entry) {
+	max := r.MaxEntries
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]*entry)
+	}
+	if len(r.cache) >= max {
+		now := time.Now()
+		for k, old := range r.cache {
+			if !now.Before(old.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// without expired answers, random ones make room
+		for k := range r.cache {
+			if len(r.cache) < max {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = e
+}
+
+// Flush empties the cache.
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	r.cache = nil
+	r.mu.Unlock()
+}
+
+// upstream returns the DNS server of name, nil for the system resolver.
+func (r *Resolver) upstream(name string) Upstream {
+	best, up := -1, r.Upstream
+	for domain, u := range r.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > best {
+			best, up = len(domain), u
+		}
+	}
+	return up
+}
+
+// resolve queries the DNS server of name, returning its addresses and their TTL.
+func (r *Resolver) resolve(ctx context.Context, network, name string) ([]net.IP, time.Duration, error) {
+	up := r.upstream(name)
+	if up == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+		ttl := r.SystemTTL
+		if ttl <= 0 {
+			ttl = DefaultSystemTTL
+		}
+		return ips, ttl, err
+	}
+	var types []dnsmessage.Type
+	switch network {
+	case "ip4":
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			answers[i] = query(ctx, up, name, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl time.Duration = -1
+	var err error
+	for _, a := range answers {
+		if a.err != nil {
+			if err == nil || !isNotFound(a.err) {
+				err = a.err
+			}
+			continue
+		}
+		ips = append(ips, a.ips...)
+		if len(a.ips) > 0 && (ttl < 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+	}
+	if len(ips) > 0 {
+		// the addresses of one family are enough
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, 0, err
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+type answer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// query asks up for the records of type t of name.
+func query(ctx context.Context, up Upstream, name string, t dnsmessage.Type) answer {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return answer{err: &net.DNSError{Err: err.Error(), Name: name}}
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	q, err := msg.Pack()
+	if err != nil {
+		return answer{err: &net.DNSError{Err: err.Error(), Name: name}}
+	}
+	resp, err := up.Exchange(ctx, q)
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: fmt.Sprint(up)}
+		dnsErr.IsTimeout = errors.Is(err, context.DeadlineExceeded) || isTimeout(err)
+		return answer{err: dnsErr}
+	}
+	a, err := parseAnswer(resp, id)
+	if err != nil {
+		a.err = &net.DNSError{Err: err.Error(), Name: name, Server: fmt.Sprint(up), IsNotFound: err == errNotFound}
+	}
+	return a
+}
+
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+var errNotFound = errors.New("no such host")
+
+// parseAnswer returns the addresses of the answer resp to the query id, and the
+// smallest TTL of their records.
+func parseAnswer(resp []byte, id uint16) (answer, error) {
+	var a answer
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return a, err
+	}
+	if h.ID != id || !h.Response {
+		return a, errors.New("mismatched answer")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return a, errNotFound
+	default:
+		return a, fmt.Errorf("server answered %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return a, err
+	}
+	a.ttl = -1
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return a, err
+		}
+		var ip net.IP
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return a, err
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return a, err
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			// CNAME records lead to the addresses that follow them
+			if err := p.SkipAnswer(); err != nil {
+				return a, err
+			}
+			continue
+		}
+		a.ips = append(a.ips, ip)
+		if ttl := time.Duration(rh.TTL) * time.Second; a.ttl < 0 || ttl < a.ttl {
+			a.ttl = ttl
+		}
+	}
+	if a.ttl < 0 {
+		a.ttl = 0
+	}
+	return a, nil
+}
+
+// family returns the addresses of ips of the family of network.
+func family(ips []net.IP, network string) []net.IP {
+	if network == "ip" {
+		return ips
+	}
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "ip4") {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
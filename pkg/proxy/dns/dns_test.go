@@ -0,0 +1,249 @@
+package dns_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zone is a stand-in DNS server answering the A records of its names.
+type zone struct {
+	mu      sync.Mutex
+	names   map[string]string
+	ttl     uint32
+	queries []string
+}
+
+func (z *zone) answer(query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	z.mu.Lock()
+	z.queries = append(z.queries, name+" "+q.Type.String())
+	addr, ok := z.names[name]
+	z.mu.Unlock()
+	msg.Response = true
+	if !ok {
+		msg.RCode = dnsmessage.RCodeNameError
+	} else if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], net.ParseIP(addr).To4())
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: z.ttl},
+			Body:   &a,
+		}}
+	}
+	resp, _ := msg.Pack()
+	return resp
+}
+
+func (z *zone) take() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	q := z.queries
+	z.queries = nil
+	return q
+}
+
+// serveUDP serves z over UDP until the test ends.
+func serveUDP(t *testing.T, z *zone) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(z.answer(buf[:n]), addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+// serveDoH serves z over DNS over HTTPS until the test ends.
+func serveDoH(t *testing.T, z *zone) *dns.DoH {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(z.answer(query))
+	}))
+	t.Cleanup(s.Close)
+	return &dns.DoH{URL: s.URL + "/dns-query", Client: s.Client()}
+}
+
+func TestResolverCache(t *testing.T) {
+	z := &zone{names: map[string]string{"www.example.com": "192.0.2.1"}, ttl: 1}
+	up, err := dns.ParseUpstream("udp://" + serveUDP(t, z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &dns.Resolver{Upstream: up}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP(ctx, "ip4", "www.example.com")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("LookupIP = %v %v", ips, err)
+		}
+	}
+	if q := z.take(); len(q) != 1 {
+		t.Errorf("queries %v, want one answered from the cache", q)
+	}
+
+	if _, err := r.LookupIP(ctx, "ip4", "missing.example.com"); !isNotFound(err) {
+		t.Errorf("missing host: %v", err)
+	}
+	r.LookupIP(ctx, "ip4", "missing.example.com")
+	if q := z.take(); len(q) != 1 {
+		t.Errorf("queries of the missing host %v, want one cached", q)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	r.LookupIP(ctx, "ip4", "www.example.com")
+	if q := z.take(); len(q) != 1 {
+		t.Errorf("queries after the TTL %v, want one", q)
+	}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func TestResolverDomains(t *testing.T) {
+	public := &zone{names: map[string]string{"www.example.com": "192.0.2.1", "app.corp.example": "192.0.2.2"}, ttl: 60}
+	corp := &zone{names: map[string]string{"app.corp.example": "10.0.0.2"}, ttl: 60}
+	lab := &zone{names: map[string]string{"db.lab.corp.example": "10.1.0.3"}, ttl: 60}
+	domains, err := dns.ParseDomains("corp.example=" + serveUDP(t, corp) + "; lab.corp.example=https://lab.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains["lab.corp.example"] = serveDoH(t, lab)
+	r := &dns.Resolver{Upstream: serveDoH(t, public), Domains: domains}
+
+	tests := []struct{ host, want string }{
+		{"www.example.com", "192.0.2.1"},
+		{"APP.corp.example.", "10.0.0.2"},
+		{"db.lab.corp.example", "10.1.0.3"},
+	}
+	for _, tt := range tests {
+		ips, err := r.LookupIP(context.Background(), "ip", tt.host)
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(tt.want)) {
+			t.Errorf("LookupIP(%q) = %v %v, want %s", tt.host, ips, err, tt.want)
+		}
+	}
+	if q := public.take(); len(q) != 2 {
+		t.Errorf("public server saw %v", q)
+	}
+	if q := corp.take(); len(q) != 2 {
+		t.Errorf("corp server saw %v", q)
+	}
+	if q := lab.take(); len(q) != 2 {
+		t.Errorf("lab server saw %v", q)
+	}
+}
+
+func TestResolverProxy(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// new connections, resolved for their user
+		w.Header().Set("Connection", "close")
+		io.WriteString(w, "ok")
+	}))
+	defer site.Close()
+	_, port, _ := net.SplitHostPort(site.Listener.Addr().String())
+	z := &zone{names: map[string]string{"site.example": "127.0.0.1"}, ttl: 60}
+	hosts, err := dns.ParseHosts(strings.NewReader("# overrides\n127.0.0.1 pinned.example PINNED2.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &dns.Resolver{
+		Upstream:  serveDoH(t, z),
+		Hosts:     hosts,
+		UserHosts: map[string]map[string][]net.IP{"alice": {"staging.example": {net.ParseIP("127.0.0.1")}}},
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Resolver = r
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.User = req.Header.Get("X-User")
+		return req, nil
+	})
+	var mu sync.Mutex
+	var resolved []time.Duration
+	var upstreams []string
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		mu.Lock()
+		resolved = append(resolved, ctx.ResolveDuration)
+		if ctx.RoundTripDetails != nil && ctx.RoundTripDetails.TCPAddr != nil {
+			upstreams = append(upstreams, ctx.RoundTripDetails.TCPAddr.String())
+		}
+		mu.Unlock()
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	tests := []struct {
+		host, user string
+		status     int
+	}{
+		{"site.example", "", http.StatusOK},
+		{"pinned.example", "", http.StatusOK},
+		{"pinned2.example", "", http.StatusOK},
+		{"staging.example", "alice", http.StatusOK},
+		{"staging.example", "bob", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://"+tt.host+":"+port+"/", nil)
+		req.Header.Set("X-User", tt.user)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s as %q: %v", tt.host, tt.user, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s as %q: status %d, want %d", tt.host, tt.user, resp.StatusCode, tt.status)
+		}
+	}
+	if q := z.take(); len(q) != 4 {
+		// site.example, and staging.example for bob, A and AAAA
+		t.Errorf("DoH server saw %v", q)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(resolved) == 0 || resolved[0] <= 0 {
+		t.Errorf("resolution durations %v, want the one of site.example", resolved)
+	}
+	// the connections of the DoH queries are not those of the requests
+	for _, addr := range upstreams {
+		if addr != site.Listener.Addr().String() {
+			t.Errorf("requests sent to %v, want %v", upstreams, site.Listener.Addr())
+			break
+		}
+	}
+}
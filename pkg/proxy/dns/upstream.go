@@ -0,0 +1,235 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds the exchanges with the DNS servers whose context has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+// Upstream is a DNS server.
+type Upstream interface {
+	// Exchange sends the DNS message query and returns the answer
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// UDP is a DNS server queried over UDP, and over TCP when its answers are truncated.
+type UDP struct {
+	// Addr is the host:port of the server
+	Addr string
+	// Timeout bounds the exchanges, DefaultTimeout when 0
+	Timeout time.Duration
+}
+
+func (u *UDP) String() string {
+	return "udp://" + u.Addr
+}
+
+// Exchange sends query to the server.
+func (u *UDP) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, u.Timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// answers to other queries are ignored
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// truncated
+			return u.exchangeTCP(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (u *UDP) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DoH is a DNS over HTTPS server, RFC 8484.
+type DoH struct {
+	// URL is the URL of the queries, as "https://dns.example/dns-query"
+	URL string
+	// Client sends the queries, http.DefaultClient when nil. It should not go through
+	// the proxy resolving with the server
+	Client *http.Client
+	// Timeout bounds the exchanges, DefaultTimeout when 0
+	Timeout time.Duration
+}
+
+func (d *DoH) String() string {
+	return d.URL
+}
+
+// Exchange posts query to the server.
+func (d *DoH) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, d.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: %s answered %s", d.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// withTimeout returns a context ending with ctx, or after timeout when ctx has no deadline.
+// It keeps none of the values of ctx: the trace hooks of the request being proxied must
+// not see the connections of the queries, nor be called by their concurrent exchanges.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	c, cancel := context.WithDeadline(context.Background(), deadline)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-c.Done():
+		}
+	}()
+	return c, cancel
+}
+
+// ParseUpstream returns the DNS server of s, an IP address or a host:port queried over
+// UDP, a "udp://host:port" URL, or an https URL of a DNS over HTTPS server. The port
+// is 53 when missing.
+func ParseUpstream(s string) (Upstream, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("dns: no server in %q", s)
+		}
+		if u.Port() == "" {
+			return &UDP{Addr: net.JoinHostPort(u.Hostname(), "53")}, nil
+		}
+		return &UDP{Addr: u.Host}, nil
+	case "https", "http":
+		return &DoH{URL: u.String()}, nil
+	}
+	return nil, fmt.Errorf("dns: unsupported server scheme %q", u.Scheme)
+}
+
+// ParseDomains returns the DNS servers of the domains of s, the semicolon separated
+// servers being preceded by their domain and an equal sign, as in
+// "corp.example=10.0.0.53;lab.example=https://dns.lab.example/dns-query".
+func ParseDomains(s string) (map[string]Upstream, error) {
+	domains := make(map[string]Upstream)
+	for _, entry := range strings.Split(s, ";") {
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("dns: server %q has no domain", entry)
+		}
+		up, err := ParseUpstream(entry[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		domains[strings.ToLower(strings.Trim(strings.TrimSpace(entry[:i]), "."))] = up
+	}
+	return domains, nil
+}
+
+// ParseHosts reads the addresses of hosts in the format of /etc/hosts: an IP address
+// followed by host names per line, "#" starting the comments.
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("dns: invalid hosts line %d", line)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// The proxy forwards the Accept-Encoding of the client, so responses usually arrive
+// compressed. Handlers reading response bodies call DecodeBody first, and once all the
+// handlers ran, filterResponse compresses the decoded body again if the client accepts
+// its original encoding. Bodies no handler reads go through untouched.
+
+type decodedKey struct{}
+
+// contentCodings returns the codings of the Content-Encoding header, in the order they
+// were applied, without identity.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+func supportedCoding(coding string) bool {
+	switch coding {
+	case "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+// DecodeBody replaces the body of resp by its decoded content, according to its
+// Content-Encoding header, which is removed along with Content-Length. It does
+// nothing if the body is not encoded, or already decoded. Once the response handlers
+// ran, the proxy encodes the body again if the client accepts its original encoding.
+// Response handlers reading the body must call it first, and leave the body alone
+// when it returns an error, that is when the encoding is not supported.
+func DecodeBody(resp *http.Response, ctx *ProxyCtx) error {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	codings := contentCodings(resp.Header)
+	if len(codings) == 0 {
+		return nil
+	}
+	for _, c := range codings {
+		if !supportedCoding(c) {
+			return fmt.Errorf("unsupported content encoding %q", c)
+		}
+	}
+	var r io.Reader = resp.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		r = &lazyDecoder{coding: codings[i], src: r}
+	}
+	resp.Body = &decodedBody{Reader: r, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	ctx.SetValue(decodedKey{}, codings)
+	return nil
+}
+
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (d *decodedBody) Close() error {
+	if c, ok := d.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return d.body.Close()
+}
+
+// lazyDecoder creates its decoder on the first Read, so that decoding an empty body,
+// as those of HEAD requests, is not an error.
+type lazyDecoder struct {
+	coding string
+	src    io.Reader
+	r      io.Reader
+	err    error
+}
+
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = newDecoder(d.coding, d.src)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *lazyDecoder) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func newDecoder(coding string, src io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	if _, err := br.Peek(1); err == io.EOF {
+		return br, nil
+	}
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(br)
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some servers send raw deflate
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(br), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", coding)
+}
+
+func newEncoder(coding string, w io.Writer) io.WriteCloser {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w)
+	case "deflate":
+		return zlib.NewWriter(w)
+	case "br":
+		return brotli.NewWriter(w)
+	}
+	return nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the client allows coding.
+func acceptsEncoding(req *http.Request, coding string) bool {
+	if req == nil {
+		return false
+	}
+	if coding == "x-gzip" {
+		coding = "gzip"
+	}
+	star := false
+	for _, v := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			q := 1.0
+			if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+			}
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			if name == coding {
+				return q > 0
+			}
+			if name == "*" {
+				star = q > 0
+			}
+		}
+	}
+	return star
+}
+
+// encodeBody compresses again the body decoded by DecodeBody, with its original outermost
+// coding, if the client accepts it. Otherwise the client receives the decoded body.
+func encodeBody(resp *http.Response, ctx *ProxyCtx) {
+	codings, _ := ctx.Value(decodedKey{}).([]string)
+	if codings == nil || resp == nil || resp.Body == nil || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	ctx.SetValue(decodedKey{}, nil)
+	coding := codings[len(codings)-1]
+	// ctx.Req is the CONNECT request of the requests MITM'd in cleartext
+	req := resp.Request
+	if req == nil {
+		req = ctx.Req
+	}
+	if !acceptsEncoding(req, coding) {
+		return
+	}
+	// the headers are set before the copy starts, the wrappers of body may read them
+	// once it is consumed
+	resp.Header.Set("Content-Encoding", coding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = false
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		enc := newEncoder(coding, pw)
+		_, err := io.Copy(enc, body)
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = pr
+}
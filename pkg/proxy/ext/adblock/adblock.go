@@ -0,0 +1,343 @@
+// Package adblock blocks ads and trackers with filter lists in the Adblock Plus syntax,
+// as EasyList. Network filters reject the matching requests and CONNECT tunnels, and
+// element hiding filters hide elements of the HTML pages with an injected style sheet.
+//
+// The network filters support the ||, | and ^ anchors, * wildcards, regular expressions,
+// @@ exceptions and the $third-party, $domain, $match-case and request type options,
+// the types being guessed from the request headers. Filters with other options, and
+// extended or procedural cosmetic filters, are ignored.
+package adblock
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	proxy_html "github.com/acentior/go-httpproxy/pkg/proxy/ext/html"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+	"golang.org/x/net/publicsuffix"
+)
+
+var blockedTotal = metrics.NewCounterVec("proxy_adblock_blocked_total",
+	"Requests blocked by the filter lists.", "mode")
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Blocker applies the filter lists read from Files. Its methods are safe for
+// concurrent use, and the lists can be reloaded while the proxy runs.
+type Blocker struct {
+	Files []string
+	// OnError is called with the errors of the reloads triggered by Watch, the
+	// previous rules staying in use.
+	OnError func(err error)
+
+	mu     sync.RWMutex
+	rules  *ruleSet
+	stamps []fileStamp
+}
+
+// New returns a Blocker with the filter lists read from files.
+func New(files ...string) (*Blocker, error) {
+	b := &Blocker{Files: files}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the filter lists again. On error the previous rules are kept.
+func (b *Blocker) Reload() error {
+	rules := newRuleSet()
+	stamps := make([]fileStamp, len(b.Files))
+	for i, name := range b.Files {
+		stamp, err := loadFile(rules, name)
+		if err != nil {
+			return err
+		}
+		stamps[i] = stamp
+	}
+	b.mu.Lock()
+	b.rules, b.stamps = rules, stamps
+	b.mu.Unlock()
+	return nil
+}
+
+func loadFile(rules *ruleSet, name string) (fileStamp, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileStamp{}, err
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		// invalid and unsupported filters are skipped, as browsers do
+		rules.addLine(s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return fileStamp{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+func (b *Blocker) changed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for i, name := range b.Files {
+		info, err := os.Stat(name)
+		if err != nil || i >= len(b.stamps) ||
+			!info.ModTime().Equal(b.stamps[i].modTime) || info.Size() != b.stamps[i].size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the filter lists when one of the files changes, checking them every
+// interval, until stop is called.
+func (b *Blocker) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if !b.changed() {
+					continue
+				}
+				if err := b.Reload(); err != nil && b.OnError != nil {
+					b.OnError(err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Len returns the number of network and cosmetic filters in use.
+func (b *Blocker) Len() int {
+	rules := b.ruleSet()
+	return rules.network + len(rules.cosmetic)
+}
+
+func (b *Blocker) ruleSet() *ruleSet {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rules
+}
+
+// Match returns the filter blocking req, if any. Exceptions are taken into account.
+func (b *Blocker) Match(req *http.Request) (filter string, blocked bool) {
+	if r := b.ruleSet().match(newRequest(req, req.URL.String(), requestTypeOf(req))); r != nil {
+		return r.text, true
+	}
+	return "", false
+}
+
+func newRequest(req *http.Request, u string, typ requestType) *request {
+	q := &request{url: u, lower: strings.ToLower(u), typ: typ}
+	if i := strings.Index(q.lower, "://"); i >= 0 {
+		q.hostStart = i + 3
+		q.hostEnd = q.hostStart + strings.IndexAny(q.lower[q.hostStart:]+"/", "/?#")
+		// drop user info
+		if at := strings.LastIndexByte(q.lower[q.hostStart:q.hostEnd], '@'); at >= 0 {
+			q.hostStart += at + 1
+		}
+	}
+	host := hostname(q.lower[q.hostStart:q.hostEnd])
+	for _, h := range []string{req.Header.Get("Origin"), req.Header.Get("Referer")} {
+		if i := strings.Index(h, "://"); i >= 0 {
+			h = h[i+3:]
+			if j := strings.IndexAny(h, "/?#"); j >= 0 {
+				h = h[:j]
+			}
+			q.source = hostname(strings.ToLower(h))
+			break
+		}
+	}
+	q.thirdParty = q.source != "" && site(q.source) != site(host)
+	q.tokens = tokenize(q.lower)
+	return q
+}
+
+func hostname(hostport string) string {
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		return strings.Trim(h, "[]")
+	}
+	return hostport
+}
+
+// site returns the registrable domain of host.
+func site(host string) string {
+	if s, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return s
+	}
+	return host
+}
+
+var extensionTypes = map[string]requestType{
+	".js": typeScript, ".mjs": typeScript,
+	".css": typeStylesheet,
+	".png": typeImage, ".jpg": typeImage, ".jpeg": typeImage, ".gif": typeImage,
+	".webp": typeImage, ".avif": typeImage, ".svg": typeImage, ".ico": typeImage,
+	".woff": typeFont, ".woff2": typeFont, ".ttf": typeFont, ".otf": typeFont, ".eot": typeFont,
+	".mp4": typeMedia, ".webm": typeMedia, ".mp3": typeMedia, ".ogg": typeMedia, ".m3u8": typeMedia,
+	".swf": typeObject,
+}
+
+var fetchDestTypes = map[string]requestType{
+	"script": typeScript, "worker": typeScript, "sharedworker": typeScript, "serviceworker": typeScript,
+	"image": typeImage, "style": typeStylesheet, "font": typeFont,
+	"audio": typeMedia, "video": typeMedia, "track": typeMedia,
+	"document": typeDocument, "iframe": typeSubdocument, "frame": typeSubdocument,
+	"object": typeObject, "embed": typeObject,
+	"empty": typeXMLHTTPRequest,
+}
+
+// requestTypeOf guesses the type of a request, from the Sec-Fetch-Dest header sent by
+// browsers, or from the other headers and the extension of the path.
+func requestTypeOf(req *http.Request) requestType {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return typeWebsocket
+	}
+	if t, ok := fetchDestTypes[req.Header.Get("Sec-Fetch-Dest")]; ok {
+		return t
+	}
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return typeXMLHTTPRequest
+	}
+	if req.Header.Get("Ping-To") != "" || req.Header.Get("Content-Type") == "text/ping" {
+		return typePing
+	}
+	if t, ok := extensionTypes[strings.ToLower(path.Ext(req.URL.Path))]; ok {
+		return t
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.HasPrefix(accept, "text/css"):
+		return typeStylesheet
+	case strings.HasPrefix(accept, "image/"):
+		return typeImage
+	case strings.HasPrefix(accept, "text/html"):
+		return typeDocument
+	}
+	return typeOther
+}
+
+// Register adds the handlers of b to proxy: blocked requests and CONNECT tunnels are
+// rejected, and element hiding filters are applied to HTML responses.
+func (b *Blocker) Register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(b.HandleConnect())
+	proxy.OnRequest().Do(b.HandleRequest())
+	proxy.OnResponse(proxy_html.IsHtml).Do(b.HandleResponse())
+}
+
+func blockedResponse(req *http.Request, filter string) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by filter "+filter+"\n")
+}
+
+// HandleRequest returns the ReqHandler answering blocked requests with 403 Forbidden.
+func (b *Blocker) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		filter, blocked := b.Match(req)
+		if !blocked {
+			return req, nil
+		}
+		blockedTotal.With("request").Inc()
+		ctx.Logf("adblock: %s blocked by %s", req.URL, filter)
+		return req, blockedResponse(req, filter)
+	})
+}
+
+// HandleConnect returns the HttpsHandler rejecting the CONNECT requests to blocked
+// hosts. Only the filters without request type options, matching the whole host,
+// apply to tunnels.
+func (b *Blocker) HandleConnect() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		u := "https://" + host + "/"
+		if h, port, err := net.SplitHostPort(host); err == nil && port == "443" {
+			u = "https://" + h + "/"
+		}
+		r := b.ruleSet().match(newRequest(ctx.Req, u, 0))
+		if r == nil {
+			return nil, ""
+		}
+		blockedTotal.With("connect").Inc()
+		ctx.Logf("adblock: CONNECT %s blocked by %s", host, r.text)
+		ctx.Resp = blockedResponse(ctx.Req, r.text)
+		return goproxy.RejectConnect, host
+	})
+}
+
+type hidingKey struct{}
+
+// hidingStyle returns the style element hiding the elements matched by selectors.
+// Selectors are grouped in small rules, an invalid selector invalidating its group only.
+func hidingStyle(selectors []string) string {
+	var sb strings.Builder
+	sb.WriteString("<style>")
+	for i := 0; i < len(selectors); i += 20 {
+		j := i + 20
+		if j > len(selectors) {
+			j = len(selectors)
+		}
+		sb.WriteString(strings.Join(selectors[i:j], ","))
+		sb.WriteString("{display:none!important}")
+	}
+	sb.WriteString("</style>")
+	return sb.String()
+}
+
+// HandleResponse returns the RespHandler injecting in HTML pages the style sheet
+// hiding the elements matched by the element hiding filters. Pages allowed by
+// $document, $elemhide or $generichide exceptions are honored.
+func (b *Blocker) HandleResponse() goproxy.RespHandler {
+	rw := proxy_html.NewRewriter()
+	inject := func(el *proxy_html.Element, ctx *goproxy.ProxyCtx) {
+		if style, ok := ctx.Value(hidingKey{}).(string); ok {
+			ctx.SetValue(hidingKey{}, nil)
+			if el.Tag == "head" {
+				el.Append(style)
+			} else {
+				el.Prepend(style)
+			}
+		}
+	}
+	rw.On("head", inject)
+	rw.On("body", inject)
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || ctx.Req == nil {
+			return resp
+		}
+		rules := b.ruleSet()
+		page := ctx.Req.URL.String()
+		if rules.allow.find(newRequest(ctx.Req, page, typeElemHide|typeDocument)) != nil {
+			return resp
+		}
+		generic := rules.allow.find(newRequest(ctx.Req, page, typeGenericHide)) == nil
+		selectors := rules.selectors(strings.ToLower(ctx.Req.URL.Hostname()), generic)
+		if len(selectors) == 0 {
+			return resp
+		}
+		ctx.SetValue(hidingKey{}, hidingStyle(selectors))
+		return rw.Handle(resp, ctx)
+	})
+}
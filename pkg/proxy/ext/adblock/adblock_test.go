@@ -0,0 +1,217 @@
+package adblock_test
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/adblock"
+)
+
+const easyList = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+@@||ads.example.com/allowed/
+||tracker.net^$third-party
+/banner/*/img^
+||cdn.example.org/*.js$script
+|http://plain.example/start
+swf|
+/\/pixel\d+\.gif/$image
+||popup.example^$popup
+||doc.example^$document
+example.com,~shop.example.com##.sponsored
+example.com##.ad-banner
+##.generic-ad
+clean.example#@#.generic-ad
+@@||noads.example^$elemhide
+@@||nogeneric.example^$generichide
+example.com#?#.extended:-abp-has(.ad)
+`
+
+func writeList(t *testing.T, content string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "list.txt")
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestMatch(t *testing.T) {
+	b, err := adblock.New(writeList(t, easyList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		url     string
+		header  []string
+		blocked bool
+	}{
+		{"http://ads.example.com/x.js", nil, true},
+		{"https://sub.ads.example.com:8443/", nil, true},
+		{"http://notads.example.com/", nil, false},
+		{"http://ads.example.com.evil.net/", nil, false},
+		{"http://ads.example.com/allowed/x", nil, false},
+		{"http://tracker.net/p", []string{"Referer", "http://site.org/page"}, true},
+		{"http://tracker.net/p", []string{"Referer", "http://www.tracker.net/"}, false},
+		{"http://tracker.net/p", nil, false},
+		{"http://x.org/banner/big/img?x=1", nil, true},
+		{"http://x.org/banner/big/img.png", nil, false},
+		{"http://cdn.example.org/lib/app.js", nil, true},
+		{"http://cdn.example.org/lib/app.js", []string{"Sec-Fetch-Dest", "image"}, false},
+		{"http://plain.example/start/x", nil, true},
+		{"http://other.example/?u=http://plain.example/start", nil, false},
+		{"http://x.org/movie.swf", nil, true},
+		{"http://x.org/movie.swf?x", nil, false},
+		{"http://x.org/PIXEL42.gif", nil, true},
+		{"http://x.org/pixel42.gif", []string{"Sec-Fetch-Dest", "script"}, false},
+		{"http://popup.example/", nil, false},
+		{"http://doc.example/", []string{"Accept", "text/html"}, true},
+		{"http://doc.example/app.js", nil, false},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		for i := 0; i+1 < len(c.header); i += 2 {
+			req.Header.Set(c.header[i], c.header[i+1])
+		}
+		if filter, blocked := b.Match(req); blocked != c.blocked {
+			t.Errorf("%s %v: expected blocked %v, got %v %s", c.url, c.header, c.blocked, blocked, filter)
+		}
+	}
+}
+
+func TestMatchWildcards(t *testing.T) {
+	b, err := adblock.New(writeList(t, "[Adblock Plus 2.0]\n/a*a*a*a*b^\n||wild.example^*x*y*z|\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 20000)
+	start := time.Now()
+	for _, c := range []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://x.org/" + long, false},
+		{"http://x.org/" + long + "b?", true},
+		{"http://x.org/" + long + "b" + long, false},
+		{"http://wild.example/" + strings.Repeat("xy", 10000), false},
+		{"http://wild.example/" + strings.Repeat("xy", 10000) + "z", true},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if _, blocked := b.Match(req); blocked != c.blocked {
+			t.Errorf("%.40s...: expected blocked %v, got %v", c.url, c.blocked, blocked)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("matching long addresses took %v", d)
+	}
+}
+
+func TestElementHiding(t *testing.T) {
+	b, err := adblock.New(writeList(t, easyList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	h := b.HandleResponse()
+	const page = "<html><head><title>t</title></head><body></body></html>"
+	rewrite := func(u string) string {
+		req, _ := http.NewRequest("GET", u, nil)
+		resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}},
+			Body: ioutil.NopCloser(strings.NewReader(page)), Request: req}
+		resp = h.Handle(resp, &goproxy.ProxyCtx{Req: req, Proxy: proxy})
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	for _, c := range []struct {
+		url   string
+		style string
+	}{
+		{"http://www.example.com/", "<style>.generic-ad,.sponsored,.ad-banner{display:none!important}</style>"},
+		{"http://shop.example.com/", "<style>.generic-ad,.ad-banner{display:none!important}</style>"},
+		{"http://clean.example/", ""},
+		{"http://other.example/", "<style>.generic-ad{display:none!important}</style>"},
+		{"http://noads.example/", ""},
+		{"http://nogeneric.example/", ""},
+	} {
+		expected := strings.Replace(page, "</head>", c.style+"</head>", 1)
+		if got := rewrite(c.url); got != expected {
+			t.Errorf("%s: expected %s, got %s", c.url, expected, got)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer plain.Close()
+
+	list := writeList(t, "/banner/*/img^\n")
+	b, err := adblock.New(writeList(t, easyList), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := b.Watch(10 * time.Millisecond)
+	defer stop()
+	proxy := goproxy.NewProxyHttpServer()
+	b.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	resp, err := client.Get(plain.URL + "/banner/x/img?y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("request not blocked", resp.Status)
+	}
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("tunnel blocked", resp.Status)
+	}
+
+	// block the tunnels to the upstream server once the list is reloaded
+	n := b.Len()
+	if err := ioutil.WriteFile(list, []byte("/banner/*/img^\n||127.0.0.1^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(list, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	for i := 0; i < 100 && b.Len() == n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Len() != n+1 {
+		t.Fatal("list not reloaded")
+	}
+	client.CloseIdleConnections()
+	if _, err := client.Get(upstream.URL); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Error("tunnel not blocked", err)
+	}
+}
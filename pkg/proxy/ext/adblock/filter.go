@@ -0,0 +1,532 @@
+package adblock
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// requestType is a set of the request types of the filter options.
+type requestType uint32
+
+const (
+	typeOther requestType = 1 << iota
+	typeScript
+	typeImage
+	typeStylesheet
+	typeObject
+	typeXMLHTTPRequest
+	typeSubdocument
+	typeFont
+	typeMedia
+	typeWebsocket
+	typePing
+	typeDocument
+	typeElemHide
+	typeGenericHide
+)
+
+// specialTypes are only matched by the rules naming them explicitly.
+const specialTypes = typeDocument | typeElemHide | typeGenericHide
+
+var typeOptions = map[string]requestType{
+	"other":          typeOther,
+	"script":         typeScript,
+	"image":          typeImage,
+	"stylesheet":     typeStylesheet,
+	"css":            typeStylesheet,
+	"object":         typeObject,
+	"xmlhttprequest": typeXMLHTTPRequest,
+	"xhr":            typeXMLHTTPRequest,
+	"subdocument":    typeSubdocument,
+	"frame":          typeSubdocument,
+	"font":           typeFont,
+	"media":          typeMedia,
+	"websocket":      typeWebsocket,
+	"ping":           typePing,
+	"document":       typeDocument,
+	"doc":            typeDocument,
+	"elemhide":       typeElemHide,
+	"ehide":          typeElemHide,
+	"generichide":    typeGenericHide,
+	"ghide":          typeGenericHide,
+}
+
+// errUnsupported is returned for the valid lines the engine ignores: comments, and
+// filters using syntax or options it does not implement.
+var errUnsupported = errors.New("unsupported filter")
+
+// networkRule is a filter blocking requests, or an exception allowing them.
+type networkRule struct {
+	text      string
+	exception bool
+	// pattern is lower case, unless matchCase is set
+	pattern      string
+	domainAnchor bool
+	startAnchor  bool
+	endAnchor    bool
+	re           *regexp.Regexp
+	matchCase    bool
+	// party is 1 for $third-party rules, -1 for $~third-party rules
+	party      int8
+	types      requestType
+	notTypes   requestType
+	domains    []string
+	notDomains []string
+}
+
+// cosmeticRule hides the elements matching selector on the pages of domains.
+type cosmeticRule struct {
+	selector   string
+	exception  bool
+	domains    []string
+	notDomains []string
+}
+
+// parseLine parses a line of a filter list, returning either a network or a cosmetic rule.
+func parseLine(line string) (*networkRule, *cosmeticRule, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil, nil, errUnsupported
+	}
+	if i := strings.Index(line, "#"); i >= 0 {
+		for _, sep := range []string{"##", "#@#"} {
+			if j := strings.Index(line, sep); j == i {
+				r, err := parseCosmetic(line[:j], line[j+len(sep):], sep == "#@#")
+				return nil, r, err
+			}
+		}
+		for _, sep := range []string{"#?#", "#$#", "#%#", "#@?#", "#@$#", "#@%#"} {
+			if strings.Index(line, sep) == i {
+				return nil, nil, errUnsupported
+			}
+		}
+	}
+	r, err := parseNetwork(line)
+	return r, nil, err
+}
+
+// unsupportedSelectors are extended selectors browsers do not understand.
+var unsupportedSelectors = []string{":-abp-", ":has-text(", ":upward(", ":xpath(", ":style(", ":remove(",
+	":matches-css", ":min-text-length(", ":watch-attr(", ":contains("}
+
+func parseCosmetic(domains, selector string, exception bool) (*cosmeticRule, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "" || strings.ContainsAny(selector, "<{}") {
+		return nil, fmt.Errorf("invalid selector %q", selector)
+	}
+	// scriptlets and HTML filters
+	if strings.HasPrefix(selector, "+js(") || selector[0] == '^' {
+		return nil, errUnsupported
+	}
+	for _, s := range unsupportedSelectors {
+		if strings.Contains(selector, s) {
+			return nil, errUnsupported
+		}
+	}
+	r := &cosmeticRule{selector: selector, exception: exception}
+	r.domains, r.notDomains = parseDomains(domains, ",")
+	return r, nil
+}
+
+func parseDomains(list, sep string) (domains, notDomains []string) {
+	for _, d := range strings.Split(list, sep) {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "" || d == "~":
+		case d[0] == '~':
+			notDomains = append(notDomains, d[1:])
+		default:
+			domains = append(domains, d)
+		}
+	}
+	return
+}
+
+func parseNetwork(line string) (*networkRule, error) {
+	r := &networkRule{text: line}
+	if strings.HasPrefix(line, "@@") {
+		r.exception = true
+		line = line[2:]
+	}
+	isRegexp := len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/'
+	if i := strings.LastIndex(line, "$"); i >= 0 && !isRegexp {
+		if err := r.parseOptions(line[i+1:]); err != nil {
+			return nil, err
+		}
+		line = line[:i]
+		isRegexp = len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/'
+	}
+	if r.types&(typeElemHide|typeGenericHide) != 0 && !r.exception {
+		return nil, errUnsupported
+	}
+	if isRegexp {
+		expr := line[1 : len(line)-1]
+		if !r.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		r.re = re
+		return r, nil
+	}
+	switch {
+	case strings.HasPrefix(line, "||"):
+		r.domainAnchor = true
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		r.startAnchor = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "|") {
+		r.endAnchor = true
+		line = line[:len(line)-1]
+	}
+	for strings.Contains(line, "**") {
+		line = strings.ReplaceAll(line, "**", "*")
+	}
+	if !r.domainAnchor && !r.startAnchor {
+		line = strings.TrimLeft(line, "*")
+	}
+	if !r.endAnchor {
+		line = strings.TrimRight(line, "*")
+	}
+	if !r.matchCase {
+		line = strings.ToLower(line)
+	}
+	r.pattern = line
+	return r, nil
+}
+
+func (r *networkRule) parseOptions(options string) error {
+	for _, o := range strings.Split(options, ",") {
+		o = strings.TrimSpace(o)
+		name, value, _ := strings.Cut(o, "=")
+		name = strings.ToLower(name)
+		negated := strings.HasPrefix(name, "~")
+		name = strings.TrimPrefix(name, "~")
+		switch {
+		case name == "third-party" || name == "3p":
+			r.party = 1
+			if negated {
+				r.party = -1
+			}
+		case name == "first-party" || name == "1p":
+			r.party = -1
+			if negated {
+				r.party = 1
+			}
+		case name == "match-case" && !negated:
+			r.matchCase = true
+		case name == "domain" && !negated:
+			r.domains, r.notDomains = parseDomains(value, "|")
+		case typeOptions[name] != 0 && value == "":
+			if negated {
+				r.notTypes |= typeOptions[name]
+			} else {
+				r.types |= typeOptions[name]
+			}
+		default:
+			return errUnsupported
+		}
+	}
+	return nil
+}
+
+// request is what the rules match, a URL with its context.
+type request struct {
+	url       string
+	lower     string
+	hostStart int
+	hostEnd   int
+	typ       requestType
+	// source is the host of the page the request comes from, if known
+	source     string
+	thirdParty bool
+	tokens     []string
+}
+
+func (r *networkRule) matchesType(t requestType) bool {
+	if r.notTypes&t != 0 {
+		return false
+	}
+	if r.types == 0 {
+		return t&specialTypes == 0
+	}
+	return r.types&t != 0
+}
+
+func (r *networkRule) matches(q *request) bool {
+	if !r.matchesType(q.typ) ||
+		r.party == 1 && !q.thirdParty || r.party == -1 && q.thirdParty {
+		return false
+	}
+	if len(r.domains) > 0 && !matchDomains(q.source, r.domains) || matchDomains(q.source, r.notDomains) {
+		return false
+	}
+	u := q.lower
+	if r.matchCase {
+		u = q.url
+	}
+	if r.re != nil {
+		return r.re.MatchString(u)
+	}
+	switch {
+	case r.domainAnchor:
+		for i := q.hostStart; i < q.hostEnd; i++ {
+			if (i == q.hostStart || u[i-1] == '.') && matchAt(r.pattern, u[i:], r.endAnchor, false) {
+				return true
+			}
+		}
+		return false
+	case r.startAnchor:
+		return matchAt(r.pattern, u, r.endAnchor, false)
+	}
+	// skip the addresses without the literal prefix of the pattern
+	prefix := r.pattern
+	if i := strings.IndexAny(prefix, "*^"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if !strings.Contains(u, prefix) {
+		return false
+	}
+	return matchAt(r.pattern, u, r.endAnchor, true)
+}
+
+// matchDomains reports whether host is one of domains, or one of their subdomains.
+func matchDomains(host string, domains []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSeparator(c byte) bool {
+	return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '%')
+}
+
+// matchAt reports whether the pattern matches the start of s, or the whole of s with
+// end set, or anywhere in s with floating set. The pattern holds * wildcards and ^
+// separator placeholders, which also match the end of the address.
+//
+// Only the last * is backtracked to: matching the text after it at the first possible
+// position never prevents a match, so the time stays linear in len(p)*len(s).
+func matchAt(p, s string, end, floating bool) bool {
+	pi, si := 0, 0
+	// back is the index in p following the last *, -1 before any, and mark the
+	// position in s where the text after it is tried
+	back, mark := -1, 0
+	if floating {
+		back = 0
+	}
+	for {
+		switch {
+		case pi == len(p):
+			if !end || si == len(s) {
+				return true
+			}
+		case p[pi] == '*':
+			pi++
+			back, mark = pi, si
+			continue
+		case p[pi] == '^' && si == len(s):
+			pi++
+			continue
+		case si < len(s) && (p[pi] == s[si] || p[pi] == '^' && isSeparator(s[si])):
+			pi, si = pi+1, si+1
+			continue
+		}
+		if back < 0 || mark == len(s) {
+			return false
+		}
+		mark++
+		pi, si = back, mark
+	}
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '%'
+}
+
+// commonTokens appear in most URLs and would make poor index keys.
+var commonTokens = map[string]bool{"http": true, "https": true, "www": true, "com": true}
+
+// token returns the key indexing the rule: the longest run of token characters of its
+// pattern that is a whole token of every URL the rule matches. Rules without such a
+// token are checked on every request.
+func (r *networkRule) token() string {
+	if r.re != nil || r.matchCase {
+		return ""
+	}
+	p := r.pattern
+	best := ""
+	for i := 0; i < len(p); {
+		if !isTokenChar(p[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p) && isTokenChar(p[j]) {
+			j++
+		}
+		whole := (i > 0 && p[i-1] != '*' || i == 0 && (r.domainAnchor || r.startAnchor)) &&
+			(j < len(p) && p[j] != '*' || j == len(p) && r.endAnchor)
+		if whole && j-i > len(best) && !commonTokens[p[i:j]] {
+			best = p[i:j]
+		}
+		i = j
+	}
+	return best
+}
+
+// tokenize returns the distinct tokens of the lower case URL.
+func tokenize(u string) []string {
+	var tokens []string
+	seen := map[string]bool{}
+	for i := 0; i < len(u); {
+		if !isTokenChar(u[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(u) && isTokenChar(u[j]) {
+			j++
+		}
+		if t := u[i:j]; !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+		i = j
+	}
+	return tokens
+}
+
+// index finds the network rules matching a request among the few sharing a token with
+// its URL, instead of trying them all.
+type index struct {
+	byToken map[string][]*networkRule
+	generic []*networkRule
+}
+
+func (x *index) add(r *networkRule) {
+	if t := r.token(); t != "" {
+		if x.byToken == nil {
+			x.byToken = map[string][]*networkRule{}
+		}
+		x.byToken[t] = append(x.byToken[t], r)
+	} else {
+		x.generic = append(x.generic, r)
+	}
+}
+
+func (x *index) find(q *request) *networkRule {
+	for _, t := range q.tokens {
+		for _, r := range x.byToken[t] {
+			if r.matches(q) {
+				return r
+			}
+		}
+	}
+	for _, r := range x.generic {
+		if r.matches(q) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ruleSet holds the rules of the filter lists.
+type ruleSet struct {
+	block    index
+	allow    index
+	network  int
+	cosmetic []*cosmeticRule
+	// cosmetic rules by domain, and those applying to all domains
+	hideByDomain map[string][]*cosmeticRule
+	hideGeneric  []*cosmeticRule
+	// exceptions by selector
+	unhide map[string][]*cosmeticRule
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{hideByDomain: map[string][]*cosmeticRule{}, unhide: map[string][]*cosmeticRule{}}
+}
+
+func (s *ruleSet) addLine(line string) error {
+	n, c, err := parseLine(line)
+	switch {
+	case err != nil:
+		return err
+	case n != nil && n.exception:
+		s.allow.add(n)
+		s.network++
+	case n != nil:
+		s.block.add(n)
+		s.network++
+	case c.exception:
+		s.unhide[c.selector] = append(s.unhide[c.selector], c)
+		s.cosmetic = append(s.cosmetic, c)
+	case len(c.domains) == 0:
+		s.hideGeneric = append(s.hideGeneric, c)
+		s.cosmetic = append(s.cosmetic, c)
+	default:
+		for _, d := range c.domains {
+			s.hideByDomain[d] = append(s.hideByDomain[d], c)
+		}
+		s.cosmetic = append(s.cosmetic, c)
+	}
+	return nil
+}
+
+// match returns the rule blocking q, unless an exception allows it.
+func (s *ruleSet) match(q *request) *networkRule {
+	r := s.block.find(q)
+	if r == nil || s.allow.find(q) != nil {
+		return nil
+	}
+	return r
+}
+
+// selectors returns the selectors of the elements to hide on the pages of host.
+// generic tells whether the rules applying to all domains are included.
+func (s *ruleSet) selectors(host string, generic bool) []string {
+	var selectors []string
+	seen := map[string]bool{}
+	add := func(r *cosmeticRule) {
+		if seen[r.selector] || matchDomains(host, r.notDomains) {
+			return
+		}
+		for _, e := range s.unhide[r.selector] {
+			if len(e.domains) == 0 && !matchDomains(host, e.notDomains) || matchDomains(host, e.domains) {
+				return
+			}
+		}
+		seen[r.selector] = true
+		selectors = append(selectors, r.selector)
+	}
+	if generic {
+		for _, r := range s.hideGeneric {
+			add(r)
+		}
+	}
+	for d := host; d != ""; {
+		for _, r := range s.hideByDomain[d] {
+			add(r)
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return selectors
+}
@@ -8,8 +8,13 @@ import (
 	"strings"
 
 	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
 )
 
+var authFailuresTotal = metrics.NewCounterVec("proxy_auth_failures_total",
+	"Requests rejected for missing or wrong proxy credentials, by request kind (http or connect).",
+	"kind")
+
 var unauthorizedMsg = []byte("407 Proxy Authentication Required")
 
 func BasicUnauthorized(req *http.Request, realm string) *http.Response {
@@ -30,9 +35,14 @@ func BasicUnauthorized(req *http.Request, realm string) *http.Response {
 
 var proxyAuthorizationHeader = "Proxy-Authorization"
 
-func auth(req *http.Request, f func(req *http.Request, user, passwd string) bool) bool {
+// auth checks the credentials of req with f, and records the authenticated user in ctx.
+// Users already authenticated, by a client certificate for instance, are accepted.
+func auth(req *http.Request, ctx *goproxy.ProxyCtx, f func(req *http.Request, user, passwd string) bool) bool {
 	authheader := strings.SplitN(req.Header.Get(proxyAuthorizationHeader), " ", 2)
 	req.Header.Del(proxyAuthorizationHeader)
+	if ctx.User != "" {
+		return true
+	}
 	if len(authheader) != 2 || authheader[0] != "Basic" {
 		return false
 	}
@@ -44,7 +54,11 @@ func auth(req *http.Request, f func(req *http.Request, user, passwd string) bool
 	if len(userpass) != 2 {
 		return false
 	}
-	return f(req, userpass[0], userpass[1])
+	if !f(req, userpass[0], userpass[1]) {
+		return false
+	}
+	ctx.User = userpass[0]
+	return true
 }
 
 // Basic returns a basic HTTP authentication handler for requests
@@ -52,23 +66,27 @@ func auth(req *http.Request, f func(req *http.Request, user, passwd string) bool
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func Basic(realm string, f func(req *http.Request, user, passwd string) bool) goproxy.ReqHandler {
 	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		if !auth(req, f) {
+		if !auth(req, ctx, f) {
+			authFailuresTotal.With("http").Inc()
 			return nil, BasicUnauthorized(req, realm)
 		}
 		return req, nil
 	})
 }
 
-// BasicConnect returns a basic HTTP authentication handler for CONNECT requests
+// BasicConnect returns a basic HTTP authentication handler for CONNECT requests. The
+// authenticated requests get no ConnectAction, the handlers registered after it deciding
+// of their tunnel.
 //
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func BasicConnect(realm string, f func(req *http.Request, user, passwd string) bool) goproxy.HttpsHandler {
 	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if !auth(ctx.Req, f) {
+		if !auth(ctx.Req, ctx, f) {
+			authFailuresTotal.With("connect").Inc()
 			ctx.Resp = BasicUnauthorized(ctx.Req, realm)
 			return goproxy.RejectConnect, host
 		}
-		return goproxy.OkConnect, host
+		return nil, ""
 	})
 }
 
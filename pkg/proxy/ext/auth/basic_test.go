@@ -104,6 +104,11 @@ func TestBasicAuth(t *testing.T) {
 	proxy.OnRequest().Do(auth.Basic("my_realm", func(req *http.Request, user, passwd string) bool {
 		return user == "user" && passwd == "open sesame"
 	}))
+	var authenticated string
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		authenticated = ctx.User
+		return req, nil
+	})
 	client, proxyserver := oneShotProxy(proxy)
 	defer proxyserver.Close()
 
@@ -133,6 +138,9 @@ func TestBasicAuth(t *testing.T) {
 	if resp.StatusCode != 200 {
 		t.Error("Expected status 200 OK, got", resp.Status)
 	}
+	if authenticated != "user" {
+		t.Error("Expected ctx.User to be user, got", authenticated)
+	}
 	msg, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
@@ -162,7 +170,7 @@ func TestWithBrowser(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	go func() {
 		<-ch
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"net/http"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// CertUser returns the user of the verified TLS client certificate of req, the common
+// name of its subject, when the proxy is served over TLS with client certificates.
+func CertUser(req *http.Request) (string, bool) {
+	if req == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	user := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	return user, user != ""
+}
+
+// certAuth records in ctx the user of the client certificate of req, if f accepts it.
+func certAuth(req *http.Request, ctx *goproxy.ProxyCtx, f func(req *http.Request, user string) bool) {
+	if user, ok := CertUser(req); ok && (f == nil || f(req, user)) {
+		ctx.User = user
+	}
+}
+
+// ClientCert returns the handler authenticating requests by their TLS client
+// certificate, the user being checked by f when not nil. Requests without accepted
+// certificate go on to the next handlers, as Basic, which accepts the users already
+// authenticated.
+func ClientCert(f func(req *http.Request, user string) bool) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		certAuth(req, ctx, f)
+		return req, nil
+	})
+}
+
+// ClientCertConnect is like ClientCert, for CONNECT requests.
+func ClientCertConnect(f func(req *http.Request, user string) bool) goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		certAuth(ctx.Req, ctx, f)
+		return nil, ""
+	})
+}
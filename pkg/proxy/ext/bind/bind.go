@@ -0,0 +1,167 @@
+// Package bind chooses the local address of the connections the proxy makes to the
+// servers, so that users or requests go out through their own IP addresses. The
+// address is taken from a Pool chosen by the proxy user, a request header or rules,
+// and applies to plain requests, CONNECT tunnels, MITM'd requests and websockets.
+//
+//	b := &bind.Binder{
+//		Users:   map[string]*bind.Pool{"alice": bind.NewPool(net.ParseIP("203.0.113.7"))},
+//		Default: bind.NewPool(net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")),
+//	}
+//	b.Add(bind.NewPool(net.ParseIP("2001:db8::1")), goproxy.ReqHostIs("ipv6.example.com:443"))
+//	b.Register(proxy) // after the authentication handlers
+package bind
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// Pool is a set of local addresses, taken in turn.
+type Pool struct {
+	addrs []net.IP
+	next  uint32
+}
+
+// NewPool returns the Pool of addrs.
+func NewPool(addrs ...net.IP) *Pool {
+	return &Pool{addrs: addrs}
+}
+
+// ParsePool returns the Pool of the comma separated IP addresses of s.
+func ParsePool(s string) (*Pool, error) {
+	var addrs []net.IP
+	for _, a := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil {
+			return nil, fmt.Errorf("bind: invalid IP address %q", a)
+		}
+		addrs = append(addrs, ip)
+	}
+	return NewPool(addrs...), nil
+}
+
+// ParsePools returns the pools of s, the semicolon separated pools being named by the
+// text before their equal sign, as in "alice=192.0.2.1,192.0.2.2;bob=192.0.2.3".
+func ParsePools(s string) (map[string]*Pool, error) {
+	pools := make(map[string]*Pool)
+	for _, entry := range strings.Split(s, ";") {
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("bind: pool %q has no name", entry)
+		}
+		p, err := ParsePool(entry[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		pools[strings.TrimSpace(entry[:i])] = p
+	}
+	return pools, nil
+}
+
+// Next returns the next address of the pool, nil when it is empty.
+func (p *Pool) Next() net.IP {
+	if p == nil || len(p.addrs) == 0 {
+		return nil
+	}
+	return p.addrs[(atomic.AddUint32(&p.next, 1)-1)%uint32(len(p.addrs))]
+}
+
+type rule struct {
+	pool  *Pool
+	conds []goproxy.ReqCondition
+}
+
+// Binder sets the LocalAddr of the transactions. The pool of a transaction is, in
+// order, the pool named by its Header, the pool of its user, the pool of the first rule
+// it matches, and Default.
+type Binder struct {
+	// Header is the request header naming the pool of the request among Pools, removed
+	// from the requests. Any client can name any pool, so it is meant for trusted
+	// clients
+	Header string
+	// Pools are the pools named by Header
+	Pools map[string]*Pool
+	// Users are the pools of the proxy users
+	Users map[string]*Pool
+	// Default is the pool of the other transactions, nil letting the system choose
+	Default *Pool
+
+	rules []rule
+}
+
+// Add binds to the addresses of pool the transactions whose request matches all the
+// conds. For CONNECT tunnels, the request is the CONNECT request.
+func (b *Binder) Add(pool *Pool, conds ...goproxy.ReqCondition) {
+	b.rules = append(b.rules, rule{pool: pool, conds: conds})
+}
+
+// Register adds the handlers of b to proxy, after the authentication handlers setting
+// the proxy users.
+func (b *Binder) Register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(b.HandleRequest())
+	proxy.OnRequest().HandleConnect(b.HandleConnect())
+}
+
+// HandleRequest returns the ReqHandler binding the plain requests, and the MITM'd
+// requests of the tunnels that HandleConnect did not bind.
+func (b *Binder) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.LocalAddr != nil {
+			// MITM'd in a bound tunnel
+			if b.Header != "" {
+				req.Header.Del(b.Header)
+			}
+			return req, nil
+		}
+		b.bind(req, ctx)
+		return req, nil
+	})
+}
+
+// HandleConnect returns the HttpsHandler binding the CONNECT tunnels, and the requests
+// MITM'd in them.
+func (b *Binder) HandleConnect() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		b.bind(ctx.Req, ctx)
+		return nil, ""
+	})
+}
+
+func (b *Binder) bind(req *http.Request, ctx *goproxy.ProxyCtx) {
+	if ip := b.pool(req, ctx).Next(); ip != nil {
+		ctx.LocalAddr = ip
+	}
+}
+
+func (b *Binder) pool(req *http.Request, ctx *goproxy.ProxyCtx) *Pool {
+	if b.Header != "" {
+		name := req.Header.Get(b.Header)
+		req.Header.Del(b.Header)
+		if p, ok := b.Pools[name]; ok {
+			return p
+		}
+	}
+	if p, ok := b.Users[ctx.User]; ok && ctx.User != "" {
+		return p
+	}
+	for _, r := range b.rules {
+		if matches(r.conds, req, ctx) {
+			return r.pool
+		}
+	}
+	return b.Default
+}
+
+func matches(conds []goproxy.ReqCondition, req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	for _, cond := range conds {
+		if !cond.HandleReq(req, ctx) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package bind_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/bind"
+)
+
+// sources records the source addresses of the connections of a server.
+type sources struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (s *sources) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		s.mu.Lock()
+		s.addrs = append(s.addrs, host)
+		s.mu.Unlock()
+		if r.Header.Get("Upgrade") == "websocket" {
+			c, _, _ := w.(http.Hijacker).Hijack()
+			io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			c.Close()
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+}
+
+func (s *sources) last() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.addrs) == 0 {
+		return ""
+	}
+	return s.addrs[len(s.addrs)-1]
+}
+
+func TestBinder(t *testing.T) {
+	// the loopback aliases are local addresses on Linux, not on every system
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot bind loopback aliases: %v", err)
+	}
+	l.Close()
+
+	var seen sources
+	plain := httptest.NewServer(seen.handler())
+	defer plain.Close()
+	secure := httptest.NewTLSServer(seen.handler())
+	defer secure.Close()
+	mitm := httptest.NewTLSServer(seen.handler())
+	defer mitm.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.User == "" {
+			ctx.User = req.Header.Get("X-User")
+		}
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.User = ctx.Req.Header.Get("X-User")
+		return nil, ""
+	})
+	b := &bind.Binder{
+		Header:  "X-Bind",
+		Pools:   map[string]*bind.Pool{"premium": bind.NewPool(net.ParseIP("127.0.0.5"))},
+		Users:   map[string]*bind.Pool{"alice": bind.NewPool(net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3"))},
+		Default: bind.NewPool(net.ParseIP("127.0.0.1")),
+	}
+	b.Add(bind.NewPool(net.ParseIP("127.0.0.4")), goproxy.ReqHostIs(secure.Listener.Addr().String()))
+	b.Register(proxy)
+	proxy.OnRequest(goproxy.ReqHostIs(mitm.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: tr}
+
+	tests := []struct {
+		name, url string
+		header    http.Header
+		want      string
+	}{
+		{"user pool", plain.URL, http.Header{"X-User": {"alice"}}, "127.0.0.2"},
+		{"user pool in turn", plain.URL, http.Header{"X-User": {"alice"}}, "127.0.0.3"},
+		{"default pool", plain.URL, http.Header{"X-User": {"bob"}}, "127.0.0.1"},
+		{"header pool", plain.URL, http.Header{"X-User": {"alice"}, "X-Bind": {"premium"}}, "127.0.0.5"},
+		{"rule tunnel", secure.URL, http.Header{"X-User": {"bob"}}, "127.0.0.4"},
+		{"user tunnel", secure.URL, http.Header{"X-User": {"alice"}}, "127.0.0.2"},
+		{"user mitm", mitm.URL, http.Header{"X-User": {"alice"}}, "127.0.0.3"},
+	}
+	for _, tt := range tests {
+		tr.ProxyConnectHeader = tt.header
+		tr.CloseIdleConnections()
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.Header = tt.header
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if got := seen.last(); got != tt.want {
+			t.Errorf("%s: server saw %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// websocket upgrade of plain requests
+	c, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET "+plain.URL+"/ws HTTP/1.1\r\nHost: "+plain.Listener.Addr().String()+
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nX-Bind: premium\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || seen.last() != "127.0.0.5" {
+		t.Errorf("websocket: status %d, server saw %s, want 127.0.0.5", resp.StatusCode, seen.last())
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	pools, err := bind.ParsePools("alice=192.0.2.1, 192.0.2.2;bob=2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := pools["alice"].Next(); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("first address of alice = %s", ip)
+	}
+	if ip := pools["alice"].Next(); !ip.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("second address of alice = %s", ip)
+	}
+	if ip := pools["bob"].Next(); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("address of bob = %s", ip)
+	}
+	for _, s := range []string{"alice", "alice=192.0.2"} {
+		if _, err := bind.ParsePools(s); err == nil {
+			t.Errorf("ParsePools(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package blocklist blocks the requests and CONNECT tunnels to the domains of large lists,
+// as the threat intelligence feeds distributed as hosts files, domain lists or DNS
+// response policy zones (RPZ).
+//
+// The lines of a list are either:
+//
+//	0.0.0.0 bad.example.com other.example.net   hosts file entries
+//	bad.example.com                              plain domains
+//	||bad.example.com^                           adblock style domains
+//	*.bad.example.com                            subdomains only
+//	bad.example.com CNAME .                      RPZ records
+//
+// Hosts file, plain and adblock style entries block the domain and its subdomains. RPZ
+// records follow the zone semantics: the owner name only, or its subdomains for a
+// wildcard owner, rpz-passthru records allowing the domain. Comments start with # or ;
+// or !, and the lines that are not understood are skipped.
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+)
+
+var blockedTotal = metrics.NewCounterVec("proxy_blocklist_blocked_total",
+	"Requests blocked by the domain blocklist.", "mode")
+
+// hostsNames are the names of the hosts files that are not blocked domains.
+var hostsNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// normalize returns the lower case domain without trailing dot, and whether it is valid.
+func normalize(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return "", false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return "", false
+		}
+	}
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", false
+		}
+	}
+	return domain, true
+}
+
+func newEntry(domain string, flags uint8) (entry, bool) {
+	domain, ok := normalize(domain)
+	if !ok {
+		return entry{}, false
+	}
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return entry{labels, flags}, true
+}
+
+// parser reads the lines of the lists, adding their domains to block or allow.
+type parser struct {
+	block, allow []entry
+	// origin is the $ORIGIN of an RPZ zone, with leading dot
+	origin string
+	// inParens is set within the parentheses of a multi-line record, as SOA records
+	inParens bool
+}
+
+func (p *parser) add(list *[]entry, domain string, flags uint8) {
+	if e, ok := newEntry(domain, flags); ok {
+		*list = append(*list, e)
+	}
+}
+
+func (p *parser) parseLine(line string) {
+	if i := strings.IndexAny(line, "#;!"); i >= 0 {
+		line = line[:i]
+	}
+	if p.inParens {
+		p.inParens = !strings.Contains(line, ")")
+		return
+	}
+	if strings.Contains(line, "(") && !strings.Contains(line, ")") {
+		p.inParens = true
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	switch {
+	case strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1:
+		p.origin = "." + strings.TrimSuffix(strings.ToLower(fields[1]), ".")
+	case strings.HasPrefix(fields[0], "$"):
+	case len(fields) == 1:
+		domain := fields[0]
+		flags := matchExact | matchSubdomains
+		switch {
+		case strings.HasPrefix(domain, "||"):
+			domain = strings.TrimSuffix(domain[2:], "^")
+		case strings.HasPrefix(domain, "*."):
+			domain, flags = domain[2:], matchSubdomains
+		}
+		p.add(&p.block, domain, flags)
+	case net.ParseIP(fields[0]) != nil:
+		for _, domain := range fields[1:] {
+			if !hostsNames[strings.ToLower(domain)] {
+				p.add(&p.block, domain, matchExact|matchSubdomains)
+			}
+		}
+	default:
+		p.parseRecord(fields)
+	}
+}
+
+// parseRecord parses an RPZ resource record: owner [ttl] [class] type rdata.
+func (p *parser) parseRecord(fields []string) {
+	owner := strings.ToLower(fields[0])
+	i := 1
+	for ; i < len(fields); i++ {
+		f := strings.ToUpper(fields[i])
+		if f != "IN" && strings.Trim(f, "0123456789") != "" {
+			break
+		}
+	}
+	if i+1 >= len(fields) {
+		return
+	}
+	typ, rdata := strings.ToUpper(fields[i]), strings.ToLower(fields[i+1])
+	switch typ {
+	case "SOA", "NS":
+		return
+	}
+	if strings.HasSuffix(owner, ".") {
+		owner = strings.TrimSuffix(strings.TrimSuffix(owner, "."), p.origin)
+	}
+	flags := matchExact
+	if strings.HasPrefix(owner, "*.") {
+		owner, flags = owner[2:], matchSubdomains
+	}
+	if typ == "CNAME" && rdata == "rpz-passthru." {
+		p.add(&p.allow, owner, flags)
+	} else {
+		p.add(&p.block, owner, flags)
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (p *parser) parseFile(name string) (fileStamp, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileStamp{}, err
+	}
+	p.origin, p.inParens = "", false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p.parseLine(s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return fileStamp{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return fileStamp{info.ModTime(), info.Size()}, nil
+}
+
+// lists are the tries in use, replaced as a whole on reload.
+type lists struct {
+	block, allow *trie
+	stamps       []fileStamp
+}
+
+// Blocklist blocks the domains of the lists read from Files, and their subdomains,
+// unless they are in the lists read from AllowFiles. It is a ReqCondition matching
+// the requests to blocked domains, and an HttpsHandler rejecting the CONNECT requests
+// to them. Its methods are safe for concurrent use, and the lists can be reloaded
+// without disturbing the traffic.
+type Blocklist struct {
+	Files      []string
+	AllowFiles []string
+	// BlockPage returns the response to a request blocked because of domain. The
+	// default is a 403 Forbidden HTML page.
+	BlockPage func(req *http.Request, domain string) *http.Response
+	// OnError is called with the errors of the reloads triggered by Watch, the
+	// previous lists staying in use.
+	OnError func(err error)
+
+	lists atomic.Value
+}
+
+// New returns a Blocklist with the lists read from files, and the allowlists read
+// from allowFiles.
+func New(files, allowFiles []string) (*Blocklist, error) {
+	b := &Blocklist{Files: files, AllowFiles: allowFiles}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the lists again, and uses them once they are all read. On error the
+// previous lists are kept.
+func (b *Blocklist) Reload() error {
+	p := &parser{}
+	var stamps []fileStamp
+	for _, name := range b.Files {
+		stamp, err := p.parseFile(name)
+		if err != nil {
+			return err
+		}
+		stamps = append(stamps, stamp)
+	}
+	// allowlists are read as lists, their entries allowing domains
+	allow := &parser{}
+	for _, name := range b.AllowFiles {
+		stamp, err := allow.parseFile(name)
+		if err != nil {
+			return err
+		}
+		stamps = append(stamps, stamp)
+	}
+	allowed := append(p.allow, allow.block...)
+	allowed = append(allowed, allow.allow...)
+	b.lists.Store(&lists{block: buildTrie(p.block), allow: buildTrie(allowed), stamps: stamps})
+	return nil
+}
+
+func (b *Blocklist) current() *lists {
+	l, _ := b.lists.Load().(*lists)
+	if l == nil {
+		return &lists{}
+	}
+	return l
+}
+
+func (b *Blocklist) changed() bool {
+	stamps := b.current().stamps
+	for i, name := range append(append([]string(nil), b.Files...), b.AllowFiles...) {
+		info, err := os.Stat(name)
+		if err != nil || i >= len(stamps) ||
+			!info.ModTime().Equal(stamps[i].modTime) || info.Size() != stamps[i].size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the lists when one of the files changes, checking them every interval,
+// until stop is called.
+func (b *Blocklist) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if !b.changed() {
+					continue
+				}
+				if err := b.Reload(); err != nil && b.OnError != nil {
+					b.OnError(err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Len returns the number of blocked entries.
+func (b *Blocklist) Len() int {
+	if t := b.current().block; t != nil {
+		return t.size
+	}
+	return 0
+}
+
+// Match returns the listed domain blocking host, which may hold a port, if any.
+func (b *Blocklist) Match(host string) (domain string, blocked bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	l := b.current()
+	if _, allowed := l.allow.match(host); allowed {
+		return "", false
+	}
+	return l.block.match(host)
+}
+
+func (b *Blocklist) HandleReq(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	if req == nil {
+		return false
+	}
+	_, blocked := b.Match(req.URL.Host)
+	return blocked
+}
+
+func (b *Blocklist) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return b.HandleReq(ctx.Req, ctx)
+}
+
+// HandleConnect rejects the CONNECT requests to blocked domains with 403 Forbidden.
+func (b *Blocklist) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	domain, blocked := b.Match(host)
+	if !blocked {
+		return nil, ""
+	}
+	blockedTotal.With("connect").Inc()
+	ctx.Logf("blocklist: CONNECT %s blocked by %s", host, domain)
+	ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked domain "+domain+"\n")
+	return goproxy.RejectConnect, host
+}
+
+// HandleRequest returns the ReqHandler answering the requests to blocked domains with
+// BlockPage.
+func (b *Blocklist) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		domain, blocked := b.Match(req.URL.Host)
+		if !blocked {
+			return req, nil
+		}
+		blockedTotal.With("request").Inc()
+		ctx.Logf("blocklist: %s blocked by %s", req.URL, domain)
+		if b.BlockPage != nil {
+			return req, b.BlockPage(req, domain)
+		}
+		return req, defaultBlockPage(req, domain)
+	})
+}
+
+func defaultBlockPage(req *http.Request, domain string) *http.Response {
+	d := html.EscapeString(domain)
+	return goproxy.NewResponse(req, goproxy.ContentTypeHtml+"; charset=utf-8", http.StatusForbidden,
+		"<!DOCTYPE html>\n<html><head><title>Blocked</title></head><body><h1>Access blocked</h1>"+
+			"<p>The domain <b>"+d+"</b> is on a security blocklist.</p></body></html>\n")
+}
+
+// Register adds the handlers of b to proxy.
+func (b *Blocklist) Register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(b)
+	proxy.OnRequest().Do(b.HandleRequest())
+}
@@ -0,0 +1,178 @@
+package blocklist_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/blocklist"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+const hosts = `# threat feed
+127.0.0.1 localhost
+0.0.0.0 malware.example.com phishing.example.net
+::1 ip6-localhost
+`
+
+const domains = `bad.example.org
+||tracker.example^
+*.wild.example
+`
+
+const rpz = `$TTL 300
+$ORIGIN rpz.local.
+@ IN SOA localhost. admin.localhost. (
+	1 ; serial
+	3600 )
+  IN NS localhost.
+exact.example CNAME .
+*.zone.example CNAME .
+evil.example.rpz.local. 300 IN CNAME rpz-drop.
+ok.malware.example.com CNAME rpz-passthru.
+`
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	b, err := blocklist.New(
+		[]string{writeFile(t, dir, "hosts", hosts), writeFile(t, dir, "domains", domains), writeFile(t, dir, "zone.rpz", rpz)},
+		[]string{writeFile(t, dir, "allow", "good.bad.example.org\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host    string
+		blocked string
+	}{
+		{"malware.example.com", "malware.example.com"},
+		{"cdn.malware.example.com:443", "malware.example.com"},
+		{"MALWARE.example.com.", "malware.example.com"},
+		{"example.com", ""},
+		{"notmalware.example.com", ""},
+		{"phishing.example.net", "phishing.example.net"},
+		{"localhost", ""},
+		{"bad.example.org", "bad.example.org"},
+		{"good.bad.example.org", ""},
+		{"www.good.bad.example.org", ""},
+		{"tracker.example", "tracker.example"},
+		{"wild.example", ""},
+		{"a.wild.example", "wild.example"},
+		{"exact.example", "exact.example"},
+		{"sub.exact.example", ""},
+		{"zone.example", ""},
+		{"x.y.zone.example", "zone.example"},
+		{"evil.example", "evil.example"},
+		{"ok.malware.example.com", ""},
+		{"1", ""},
+		{"3600", ""},
+	} {
+		domain, blocked := b.Match(c.host)
+		if blocked != (c.blocked != "") || domain != c.blocked {
+			t.Errorf("%s: expected %q, got %q %v", c.host, c.blocked, domain, blocked)
+		}
+	}
+}
+
+func TestLargeList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "large")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	const n = 200000
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(w, "0.0.0.0 host%d.domain%d.com\n", i, i%1000)
+	}
+	w.Flush()
+	f.Close()
+
+	b, err := blocklist.New([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != n {
+		t.Errorf("expected %d entries, got %d", n, b.Len())
+	}
+	for _, i := range []int{0, 1, n / 2, n - 1} {
+		host := fmt.Sprintf("www.host%d.domain%d.com", i, i%1000)
+		if _, blocked := b.Match(host); !blocked {
+			t.Error(host, "not blocked")
+		}
+	}
+	if _, blocked := b.Match("host1.domain2.com"); blocked {
+		t.Error("unlisted host blocked")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	dir := t.TempDir()
+	list := writeFile(t, dir, "list", "blocked.test\n")
+	b, err := blocklist.New([]string{list}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	b.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get("http://www.blocked.test/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "blocked.test") {
+		t.Errorf("expected the block page, got %s %s", resp.Status, body)
+	}
+	if _, err := client.Get("https://blocked.test/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Error("CONNECT not rejected", err)
+	}
+
+	b.BlockPage = func(req *http.Request, domain string) *http.Response {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusUnavailableForLegalReasons, "custom "+domain)
+	}
+	writeFile(t, dir, "list", "other.test\n")
+	if err := b.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get("http://other.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons || string(body) != "custom other.test" {
+		t.Errorf("expected the custom block page, got %s %s", resp.Status, body)
+	}
+	if _, blocked := b.Match("blocked.test"); blocked {
+		t.Error("reloaded list still blocks the removed domain")
+	}
+
+	os.Remove(list)
+	if err := b.Reload(); err == nil {
+		t.Error("reloading a missing list should fail")
+	}
+	if _, blocked := b.Match("other.test"); !blocked {
+		t.Error("failed reload dropped the lists")
+	}
+}
@@ -0,0 +1,131 @@
+package blocklist
+
+import (
+	"sort"
+	"strings"
+)
+
+// Flags of the trie nodes.
+const (
+	// matchExact matches the domain of the node itself
+	matchExact uint8 = 1 << iota
+	// matchSubdomains matches the subdomains of the node
+	matchSubdomains
+)
+
+// node is a label of a trie. The children of a node are contiguous in the nodes of the
+// trie, sorted by label.
+type node struct {
+	labelOff   uint32
+	childStart uint32
+	childCount uint32
+	labelLen   uint8
+	flags      uint8
+}
+
+// trie is an immutable suffix trie of domains, indexed from their last label. It is
+// stored in a few flat slices, labels being interned in a single string, to keep the
+// memory low with millions of domains.
+type trie struct {
+	nodes  []node
+	labels string
+	size   int
+}
+
+// entry is a domain to add to a trie, with its labels from the last one.
+type entry struct {
+	labels []string
+	flags  uint8
+}
+
+func compareLabels(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// buildTrie builds the trie of entries, which it sorts. Domains below a domain whose
+// subdomains all match are dropped.
+func buildTrie(entries []entry) *trie {
+	sort.Slice(entries, func(i, j int) bool { return compareLabels(entries[i].labels, entries[j].labels) < 0 })
+	t := &trie{nodes: []node{{}}}
+	var labels strings.Builder
+	interned := map[string]uint32{}
+	intern := func(label string) uint32 {
+		if off, ok := interned[label]; ok {
+			return off
+		}
+		off := uint32(labels.Len())
+		labels.WriteString(label)
+		interned[label] = off
+		return off
+	}
+
+	// breadth first, so that the children of a node are added together
+	type span struct {
+		node   uint32
+		lo, hi int
+		depth  int
+	}
+	queue := []span{{0, 0, len(entries), 0}}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		i := s.lo
+		// the domain of the node itself sorts first
+		for ; i < s.hi && len(entries[i].labels) == s.depth; i++ {
+			t.nodes[s.node].flags |= entries[i].flags
+		}
+		if t.nodes[s.node].flags&matchSubdomains != 0 {
+			continue
+		}
+		t.nodes[s.node].childStart = uint32(len(t.nodes))
+		for i < s.hi {
+			label := entries[i].labels[s.depth]
+			j := i + 1
+			for j < s.hi && entries[j].labels[s.depth] == label {
+				j++
+			}
+			t.nodes = append(t.nodes, node{labelOff: intern(label), labelLen: uint8(len(label))})
+			t.nodes[s.node].childCount++
+			queue = append(queue, span{uint32(len(t.nodes) - 1), i, j, s.depth + 1})
+			i = j
+		}
+	}
+	t.labels = labels.String()
+	t.size = len(entries)
+	// the slice may have grown much larger than needed
+	t.nodes = append([]node(nil), t.nodes...)
+	return t
+}
+
+func (t *trie) label(n *node) string {
+	return t.labels[n.labelOff : n.labelOff+uint32(n.labelLen)]
+}
+
+// match returns the suffix of host matched by the trie, if any. host must be lower case,
+// without trailing dot.
+func (t *trie) match(host string) (string, bool) {
+	if t == nil || len(t.nodes) == 0 {
+		return "", false
+	}
+	n := &t.nodes[0]
+	for end := len(host); end > 0; {
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		label := host[start:end]
+		children := t.nodes[n.childStart : n.childStart+n.childCount]
+		i := sort.Search(len(children), func(i int) bool { return t.label(&children[i]) >= label })
+		if i == len(children) || t.label(&children[i]) != label {
+			return "", false
+		}
+		n = &children[i]
+		if start == 0 && n.flags&matchExact != 0 || start > 0 && n.flags&matchSubdomains != 0 {
+			return host[start:], true
+		}
+		end = start - 1
+	}
+	return "", false
+}
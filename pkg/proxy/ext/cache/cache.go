@@ -0,0 +1,500 @@
+// Package cache is a shared HTTP cache following RFC 9111, for plain HTTP requests as
+// well as MITM'd HTTPS ones. It honors Cache-Control, Expires, Vary, and revalidates
+// stale responses with ETag and Last-Modified, in the background when the response
+// allows stale-while-revalidate.
+//
+//	storage, err := cache.NewDiskStorage("/var/cache/proxy", 1<<30)
+//	cache.New(storage).Register(proxy)
+//
+// Responses go through the cache with an X-Cache header telling how they were
+// obtained: HIT, STALE (served stale, possibly while revalidating), REVALIDATED
+// (validated with the origin server) or MISS.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// DefaultMaxEntrySize is the MaxEntrySize of the caches returned by New.
+const DefaultMaxEntrySize = 10 << 20
+
+// maxVariants is the number of variants of a resource kept, for responses with Vary.
+const maxVariants = 8
+
+// entry is a stored response.
+type entry struct {
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary holds the values of the request headers selected by the Vary header
+	Vary map[string]string
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return currentAge(e.Header, e.RequestTime, e.ResponseTime, now)
+}
+
+func (e *entry) lifetime() time.Duration {
+	return freshnessLifetime(e.Header, e.Status, e.ResponseTime)
+}
+
+// matches reports whether e can answer req according to its Vary header.
+func (e *entry) matches(req *http.Request) bool {
+	for _, name := range varyNames(e.Header) {
+		if name == "*" || e.Vary[name] != varyValue(req.Header, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func varyValue(h http.Header, name string) string {
+	values := h.Values(name)
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ", ")
+}
+
+// hopByHop are the headers describing a connection, never stored.
+var hopByHop = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "X-Cache",
+}
+
+// Cache is a shared HTTP cache, see the package documentation. It has a request and a
+// response handler, both of which must be registered, as Register does.
+type Cache struct {
+	Storage Storage
+	// MaxEntrySize is the size of the largest body stored
+	MaxEntrySize int64
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// New returns a Cache keeping responses in storage.
+func New(storage Storage) *Cache {
+	return &Cache{Storage: storage, MaxEntrySize: DefaultMaxEntrySize}
+}
+
+// Register caches the responses to the requests matching all of conds.
+func (c *Cache) Register(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).Do(c.HandleRequest())
+	proxy.OnResponse().Do(c.HandleResponse())
+}
+
+// HandleRequest returns the ReqHandler answering requests from the cache.
+func (c *Cache) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(c.handleRequest)
+}
+
+// HandleResponse returns the RespHandler storing the responses of the requests seen by
+// HandleRequest.
+func (c *Cache) HandleResponse() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(c.handleResponse)
+}
+
+// cacheKey returns the key of the responses to req. The requests MITM'd in cleartext have
+// relative URLs, their host is the one of their Host header, or else of their tunnel.
+func cacheKey(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	k := *req.URL
+	k.Fragment, k.RawFragment = "", ""
+	if k.Host == "" {
+		k.Scheme, k.Host = "http", req.Host
+		if k.Host == "" && ctx.Req != nil {
+			k.Host = ctx.Req.Host
+		}
+	}
+	return k.String()
+}
+
+func (c *Cache) load(key string) []*entry {
+	b, ok := c.Storage.Get(key)
+	if !ok {
+		return nil
+	}
+	var entries []*entry
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&entries); err != nil {
+		c.Storage.Delete(key)
+		return nil
+	}
+	return entries
+}
+
+func (c *Cache) save(key string, entries []*entry) {
+	if len(entries) == 0 {
+		c.Storage.Delete(key)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entries); err == nil {
+		c.Storage.Set(key, buf.Bytes())
+	}
+}
+
+func (c *Cache) lookup(key string, req *http.Request) *entry {
+	for _, e := range c.load(key) {
+		if e.matches(req) {
+			return e
+		}
+	}
+	return nil
+}
+
+// store adds e to the variants of key, replacing the variant of the same request.
+func (c *Cache) store(key string, e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vary := strings.Join(varyNames(e.Header), ",")
+	variants := []*entry{}
+	for _, v := range c.load(key) {
+		if strings.Join(varyNames(v.Header), ",") != vary {
+			continue
+		}
+		same := true
+		for name, value := range e.Vary {
+			if v.Vary[name] != value {
+				same = false
+			}
+		}
+		if !same {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) >= maxVariants {
+		variants = variants[len(variants)-maxVariants+1:]
+	}
+	c.save(key, append(variants, e))
+}
+
+type stateKey struct{}
+
+// state is the cache state of a transaction.
+type state struct {
+	key         string
+	req         *http.Request
+	requestTime time.Time
+	noStore     bool
+	// served is set when the response comes from the cache
+	served bool
+	// revalidating is the entry validated by the conditional request
+	revalidating *entry
+	// invalidate is set for unsafe requests, whose success invalidates the entry
+	invalidate bool
+}
+
+func isSafe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func (c *Cache) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	st := &state{key: cacheKey(req, ctx), req: req, requestTime: time.Now()}
+	ctx.SetValue(stateKey{}, st)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		st.invalidate = !isSafe(req.Method)
+		st.noStore = true
+		return req, nil
+	}
+	reqCC := parseCacheControl(req.Header)
+	st.noStore = reqCC.has("no-store")
+	e := c.lookup(st.key, req)
+	if e == nil {
+		if reqCC.has("only-if-cached") {
+			return req, c.gatewayTimeout(req, st)
+		}
+		return req, nil
+	}
+
+	now := time.Now()
+	age, lifetime := e.age(now), e.lifetime()
+	respCC := parseCacheControl(e.Header)
+	mustRevalidate := respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+	fresh := age < lifetime
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		fresh = false
+	}
+	noCache := requestNoCache(req.Header, reqCC) || respCC.has("no-cache")
+	if fresh && !noCache {
+		st.served = true
+		ctx.Logf("cache: hit %v", st.key)
+		return req, c.response(req, e, now, "HIT")
+	}
+	if !fresh && !noCache && !mustRevalidate {
+		staleness := age - lifetime
+		if maxStale, ok := reqCC["max-stale"]; ok {
+			if d, _ := reqCC.seconds("max-stale"); maxStale == "" || staleness <= d {
+				st.served = true
+				return req, c.response(req, e, now, "STALE")
+			}
+		}
+		if swr, ok := respCC.seconds("stale-while-revalidate"); ok && staleness <= swr {
+			st.served = true
+			go c.revalidate(st.key, req, ctx)
+			return req, c.response(req, e, now, "STALE")
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		return req, c.gatewayTimeout(req, st)
+	}
+	if !hasConditional(req.Header) && addConditional(req.Header, e) {
+		st.revalidating = e
+	}
+	return req, nil
+}
+
+func (c *Cache) gatewayTimeout(req *http.Request, st *state) *http.Response {
+	st.served = true
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "cache: no stored response\n")
+	resp.Header.Set("X-Cache", "MISS")
+	return resp
+}
+
+func hasConditional(h http.Header) bool {
+	return h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" ||
+		h.Get("If-Match") != "" || h.Get("If-Unmodified-Since") != "" || h.Get("If-Range") != ""
+}
+
+// addConditional makes h validate e with the origin server. It reports whether e has a validator.
+func addConditional(h http.Header, e *entry) bool {
+	if etag := e.Header.Get("ETag"); etag != "" {
+		h.Set("If-None-Match", etag)
+		return true
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+		return true
+	}
+	return false
+}
+
+// response builds the response to req from e.
+func (c *Cache) response(req *http.Request, e *entry, now time.Time, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", status)
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	body := e.Body
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		ContentLength: int64(len(e.Body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req,
+	}
+}
+
+func (c *Cache) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	st, _ := ctx.Value(stateKey{}).(*state)
+	if st == nil || st.served || resp == nil {
+		return resp
+	}
+	ctx.SetValue(stateKey{}, nil)
+	if st.invalidate {
+		if resp.StatusCode < 400 {
+			c.mu.Lock()
+			c.Storage.Delete(st.key)
+			c.mu.Unlock()
+		}
+		return resp
+	}
+	if st.revalidating != nil && resp.StatusCode == http.StatusNotModified {
+		e := c.refresh(st.key, st.revalidating, resp, st.requestTime)
+		resp.Body.Close()
+		ctx.Logf("cache: revalidated %v", st.key)
+		return c.response(st.req, e, time.Now(), "REVALIDATED")
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	if !st.noStore && c.storable(st.req, resp) {
+		c.capture(st.key, st.req, resp, st.requestTime)
+	}
+	return resp
+}
+
+// refresh updates e with the headers of a 304 response, RFC 9111 section 4.3.4.
+func (c *Cache) refresh(key string, e *entry, resp *http.Response, requestTime time.Time) *entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range resp.Header {
+		if name != "Content-Length" {
+			updated.Header[name] = values
+		}
+	}
+	for _, name := range hopByHop {
+		updated.Header.Del(name)
+	}
+	updated.RequestTime, updated.ResponseTime = requestTime, time.Now()
+	c.store(key, &updated)
+	return &updated
+}
+
+// storable reports whether a shared cache may store resp, RFC 9111 section 3.
+func (c *Cache) storable(req *http.Request, resp *http.Response) bool {
+	// a 304 answers the conditional request of a client, with no content to store: it
+	// only refreshes the entry validated by the cache, see handleResponse
+	if req.Method != http.MethodGet || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if resp.ContentLength > c.MaxEntrySize {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	if cc.has("max-age") || cc.has("s-maxage") || cc.has("public") || resp.Header.Get("Expires") != "" {
+		return true
+	}
+	return heuristicallyCacheable[resp.StatusCode] &&
+		(resp.Header.Get("Last-Modified") != "" || resp.Header.Get("ETag") != "")
+}
+
+func newEntry(req *http.Request, resp *http.Response, body []byte, requestTime time.Time) *entry {
+	h := resp.Header.Clone()
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+	e := &entry{
+		Status:       resp.StatusCode,
+		Header:       h,
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		Vary:         map[string]string{},
+	}
+	for _, name := range varyNames(h) {
+		e.Vary[name] = varyValue(req.Header, name)
+	}
+	return e
+}
+
+// capture stores resp once its body is read by the client, unless it is too large.
+func (c *Cache) capture(key string, req *http.Request, resp *http.Response, requestTime time.Time) {
+	// the headers as they are now, before the proxy adapts them for the client
+	stored := &http.Response{StatusCode: resp.StatusCode, Header: resp.Header.Clone()}
+	resp.Body = &captureBody{
+		ReadCloser: resp.Body,
+		max:        c.MaxEntrySize,
+		done: func(body []byte) {
+			c.store(key, newEntry(req, stored, body, requestTime))
+		},
+	}
+}
+
+// captureBody buffers a body, and calls done with it once it is completely read.
+type captureBody struct {
+	io.ReadCloser
+	max      int64
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+	done     func(body []byte)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.max {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow {
+		b.once.Do(func() { b.done(b.buf.Bytes()) })
+	}
+	return n, err
+}
+
+// revalidate refreshes the entry of key in the background, while a stale response is served.
+func (c *Cache) revalidate(key string, req *http.Request, ctx *goproxy.ProxyCtx) {
+	c.mu.Lock()
+	if c.revalidating == nil {
+		c.revalidating = make(map[string]bool)
+	}
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.revalidating, key)
+		c.mu.Unlock()
+	}()
+
+	r := req.Clone(context.Background())
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	r.Header.Del("Proxy-Connection")
+	e := c.lookup(key, r)
+	if e == nil {
+		return
+	}
+	validating := addConditional(r.Header, e)
+	requestTime := time.Now()
+	bgCtx := &goproxy.ProxyCtx{Req: r, Session: ctx.Session, User: ctx.User, RoundTripper: ctx.RoundTripper, Proxy: ctx.Proxy}
+	resp, err := bgCtx.RoundTrip(r)
+	if err != nil {
+		ctx.Warnf("cache: cannot revalidate %v: %v", key, err)
+		return
+	}
+	defer resp.Body.Close()
+	if validating && resp.StatusCode == http.StatusNotModified {
+		c.refresh(key, e, resp, requestTime)
+		return
+	}
+	if !c.storable(r, resp) {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxEntrySize+1))
+	if err != nil || int64(len(body)) > c.MaxEntrySize {
+		return
+	}
+	c.store(key, newEntry(r, resp, body, requestTime))
+}
@@ -0,0 +1,265 @@
+package cache_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/cache"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/internal/proxytest"
+)
+
+type origin struct {
+	mu   sync.Mutex
+	hits map[string]int
+	// conditional records the If-None-Match headers received
+	conditional []string
+}
+
+func (o *origin) count(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits[path]
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.hits[r.URL.Path]++
+	n := o.hits[r.URL.Path]
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		o.conditional = append(o.conditional, inm)
+	}
+	o.mu.Unlock()
+	h := w.Header()
+	switch r.URL.Path {
+	case "/fresh":
+		h.Set("Cache-Control", "max-age=60")
+	case "/nostore":
+		h.Set("Cache-Control", "no-store")
+	case "/private":
+		h.Set("Cache-Control", "private, max-age=60")
+	case "/expires":
+		h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		h.Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	case "/etag":
+		h.Set("Cache-Control", "max-age=0")
+		h.Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	case "/validated":
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	case "/vary":
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%s ", r.Header.Get("Accept-Language"))
+	case "/swr":
+		h.Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		h.Set("Age", "5")
+	}
+	fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+}
+
+func TestCache(t *testing.T) {
+	o := &origin{hits: map[string]int{}}
+	upstream := httptest.NewServer(o)
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	cache.New(cache.NewMemoryStorage(1 << 20)).Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	expect := func(path, xcache, body string, header ...string) *http.Response {
+		t.Helper()
+		resp, b, err := proxytest.Do(client, "GET", upstream.URL+path, "", header...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("X-Cache"); got != xcache || b != body {
+			t.Errorf("%s: expected %s %q, got %s %q", path, xcache, body, got, b)
+		}
+		return resp
+	}
+
+	expect("/fresh", "MISS", "/fresh 1")
+	resp := expect("/fresh", "HIT", "/fresh 1")
+	if resp.Header.Get("Age") == "" || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Error("unexpected cached headers", resp.Header)
+	}
+	expect("/fresh", "MISS", "/fresh 2", "Cache-Control", "no-cache")
+	expect("/fresh", "HIT", "/fresh 2")
+
+	expect("/nostore", "MISS", "/nostore 1")
+	expect("/nostore", "MISS", "/nostore 2")
+	expect("/private", "MISS", "/private 1")
+	expect("/private", "MISS", "/private 2")
+	expect("/expires", "MISS", "/expires 1")
+	expect("/expires", "HIT", "/expires 1")
+
+	expect("/etag", "MISS", "/etag 1")
+	expect("/etag", "REVALIDATED", "/etag 1")
+	if o.count("/etag") != 2 || len(o.conditional) != 1 || o.conditional[0] != `"v1"` {
+		t.Error("expected a conditional request", o.conditional)
+	}
+
+	// the 304 answering the conditional request of a client is not stored
+	resp = expect("/validated", "MISS", "", "If-None-Match", `"v1"`)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Error("expected the 304 of the origin server", resp.StatusCode)
+	}
+	resp = expect("/validated", "MISS", "/validated 2")
+	if resp.StatusCode != http.StatusOK {
+		t.Error("expected the content of the origin server", resp.StatusCode)
+	}
+	expect("/validated", "HIT", "/validated 2")
+
+	expect("/vary", "MISS", "en /vary 1", "Accept-Language", "en")
+	expect("/vary", "MISS", "fr /vary 2", "Accept-Language", "fr")
+	expect("/vary", "HIT", "en /vary 1", "Accept-Language", "en")
+	expect("/vary", "HIT", "fr /vary 2", "Accept-Language", "fr")
+
+	expect("/swr", "MISS", "/swr 1")
+	expect("/swr", "STALE", "/swr 1")
+	for i := 0; i < 100 && o.count("/swr") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if o.count("/swr") != 2 {
+		t.Error("stale response not revalidated in the background")
+	}
+
+	req, _ := http.NewRequest("POST", upstream.URL+"/fresh", strings.NewReader("x"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect("/fresh", "MISS", "/fresh 4")
+
+	if resp, _, err := proxytest.Do(client, "GET", upstream.URL+"/never", "", "Cache-Control", "only-if-cached"); err != nil || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("only-if-cached should fail without stored response", resp, err)
+	}
+}
+
+func TestMitmDiskCache(t *testing.T) {
+	o := &origin{hits: map[string]int{}}
+	upstream := httptest.NewTLSServer(o)
+	defer upstream.Close()
+	dir := t.TempDir()
+	storage, err := cache.NewDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	cache.New(storage).Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	proxytest.Do(client, "GET", upstream.URL+"/fresh", "")
+	if resp, b, err := proxytest.Do(client, "GET", upstream.URL+"/fresh", ""); err != nil || resp.Header.Get("X-Cache") != "HIT" || b != "/fresh 1" {
+		t.Errorf("MITM response not cached: %v %q %v", resp, b, err)
+	}
+
+	// a new storage on the same directory finds the entry
+	storage, err = cache.NewDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.Size() == 0 {
+		t.Error("disk entries not reloaded")
+	}
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	cache.New(storage).Register(proxy)
+	client = proxytest.Client(t, proxy)
+	if resp, b, err := proxytest.Do(client, "GET", upstream.URL+"/fresh", ""); err != nil || resp.Header.Get("X-Cache") != "HIT" || b != "/fresh 1" {
+		t.Errorf("disk entry not used: %v %q %v", resp, b, err)
+	}
+}
+
+func TestHTTPMitmCache(t *testing.T) {
+	o1, o2 := &origin{hits: map[string]int{}}, &origin{hits: map[string]int{}}
+	up1, up2 := httptest.NewServer(o1), httptest.NewServer(o2)
+	defer up1.Close()
+	defer up2.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	cache.New(cache.NewMemoryStorage(1 << 20)).Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// the requests of the tunnels have relative URLs, the same for both hosts
+	get := func(host string) (string, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("CONNECT failed", err)
+		}
+		io.WriteString(conn, "GET /fresh HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("X-Cache"), string(b)
+	}
+	for _, tt := range []struct {
+		host, xcache string
+	}{
+		{up1.Listener.Addr().String(), "MISS"},
+		{up2.Listener.Addr().String(), "MISS"},
+		{up1.Listener.Addr().String(), "HIT"},
+		{up2.Listener.Addr().String(), "HIT"},
+	} {
+		if xcache, b := get(tt.host); xcache != tt.xcache || b != "/fresh 1" {
+			t.Errorf("%s: expected %s, got %s %q", tt.host, tt.xcache, xcache, b)
+		}
+	}
+	if o1.count("/fresh") != 1 || o2.count("/fresh") != 1 {
+		t.Errorf("origins hit %d and %d times, want once each", o1.count("/fresh"), o2.count("/fresh"))
+	}
+}
+
+func TestStorageLimits(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := cache.NewDiskStorage(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []cache.Storage{cache.NewMemoryStorage(10), disk} {
+		s.Set("a", []byte("12345"))
+		s.Set("b", []byte("12345"))
+		s.Get("a")
+		s.Set("c", []byte("12345"))
+		if _, ok := s.Get("b"); ok {
+			t.Errorf("%T: least recently used entry not evicted", s)
+		}
+		if v, ok := s.Get("a"); !ok || string(v) != "12345" {
+			t.Errorf("%T: recently used entry evicted", s)
+		}
+		s.Set("big", []byte("12345678901"))
+		if _, ok := s.Get("big"); ok {
+			t.Errorf("%T: entry larger than the storage stored", s)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of Cache-Control headers, by lower case name.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// invalid values are treated as stale, RFC 9111 section 1.2.2
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// noCache reports whether the request asks for a response validated with the origin,
+// with Cache-Control or with the legacy Pragma header.
+func requestNoCache(h http.Header, cc cacheControl) bool {
+	if cc.has("no-cache") {
+		return true
+	}
+	return len(h.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache")
+}
+
+// heuristicallyCacheable are the status codes that can be stored without explicit
+// freshness, RFC 9110 section 15.1.
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+func parseHTTPDate(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// freshnessLifetime returns how long a response stays fresh in a shared cache,
+// RFC 9111 section 4.2.1. The heuristic lifetime is a tenth of the time since the
+// resource was last modified.
+func freshnessLifetime(h http.Header, status int, responseTime time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, ok := parseHTTPDate(h.Get("Date"))
+	if !ok {
+		date = responseTime
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, ok := parseHTTPDate(v)
+		if !ok {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lastModified, ok := parseHTTPDate(h.Get("Last-Modified")); ok && heuristicallyCacheable[status] && lastModified.Before(date) {
+		return date.Sub(lastModified) / 10
+	}
+	return 0
+}
+
+// currentAge implements the age calculation of RFC 9111 section 4.2.3.
+func currentAge(h http.Header, requestTime, responseTime, now time.Time) time.Duration {
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	date, ok := parseHTTPDate(h.Get("Date"))
+	if !ok {
+		date = responseTime
+	}
+	apparentAge := responseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	correctedAgeValue := ageValue + responseTime.Sub(requestTime)
+	initialAge := apparentAge
+	if correctedAgeValue > initialAge {
+		initialAge = correctedAgeValue
+	}
+	return initialAge + now.Sub(responseTime)
+}
@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage keeps the serialized cache entries. Implementations must be safe for
+// concurrent use, and may drop entries at any time.
+type Storage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+type memoryItem struct {
+	key   string
+	value []byte
+}
+
+// MemoryStorage keeps entries in memory, evicting the least recently used ones beyond
+// MaxSize bytes.
+type MemoryStorage struct {
+	MaxSize int64
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+// NewMemoryStorage returns a MemoryStorage holding up to maxSize bytes.
+func NewMemoryStorage(maxSize int64) *MemoryStorage {
+	return &MemoryStorage{MaxSize: maxSize, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (m *MemoryStorage) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(el)
+	return el.Value.(*memoryItem).value, true
+}
+
+func (m *MemoryStorage) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if int64(len(value)) > m.MaxSize {
+		m.remove(key)
+		return
+	}
+	if el, ok := m.items[key]; ok {
+		item := el.Value.(*memoryItem)
+		m.size += int64(len(value) - len(item.value))
+		item.value = value
+		m.ll.MoveToFront(el)
+	} else {
+		m.items[key] = m.ll.PushFront(&memoryItem{key, value})
+		m.size += int64(len(value))
+	}
+	for m.size > m.MaxSize {
+		m.remove(m.ll.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (m *MemoryStorage) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+func (m *MemoryStorage) remove(key string) {
+	if el, ok := m.items[key]; ok {
+		m.size -= int64(len(el.Value.(*memoryItem).value))
+		m.ll.Remove(el)
+		delete(m.items, key)
+	}
+}
+
+// Size returns the number of bytes stored.
+func (m *MemoryStorage) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// DiskStorage keeps entries in files of a directory, one per key, evicting the least
+// recently used ones beyond MaxSize bytes. The files left by a previous DiskStorage
+// on the same directory are reused.
+type DiskStorage struct {
+	Dir     string
+	MaxSize int64
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+// NewDiskStorage returns a DiskStorage storing up to maxSize bytes in dir, which is
+// created if needed.
+func NewDiskStorage(dir string, maxSize int64) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &DiskStorage{Dir: dir, MaxSize: maxSize, ll: list.New(), items: make(map[string]*list.Element)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type file struct {
+		item  *diskItem
+		mtime time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(e.Name()) != ".cache" {
+			continue
+		}
+		files = append(files, file{&diskItem{e.Name(), info.Size()}, info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		d.items[f.item.name] = d.ll.PushFront(f.item)
+		d.size += f.item.size
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	return d, nil
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
+
+func (d *DiskStorage) Get(key string) ([]byte, bool) {
+	name := fileName(key)
+	d.mu.Lock()
+	el, ok := d.items[name]
+	if ok {
+		d.ll.MoveToFront(el)
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	b, err := os.ReadFile(filepath.Join(d.Dir, name))
+	if err != nil {
+		d.Delete(key)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(d.Dir, name), now, now)
+	return b, true
+}
+
+func (d *DiskStorage) Set(key string, value []byte) {
+	name := fileName(key)
+	if int64(len(value)) > d.MaxSize {
+		d.Delete(key)
+		return
+	}
+	tmp, err := os.CreateTemp(d.Dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(d.Dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.items[name]; ok {
+		item := el.Value.(*diskItem)
+		d.size += int64(len(value)) - item.size
+		item.size = int64(len(value))
+		d.ll.MoveToFront(el)
+	} else {
+		d.items[name] = d.ll.PushFront(&diskItem{name, int64(len(value))})
+		d.size += int64(len(value))
+	}
+	d.evict()
+}
+
+func (d *DiskStorage) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(fileName(key))
+}
+
+func (d *DiskStorage) remove(name string) {
+	if el, ok := d.items[name]; ok {
+		d.size -= el.Value.(*diskItem).size
+		d.ll.Remove(el)
+		delete(d.items, name)
+		os.Remove(filepath.Join(d.Dir, name))
+	}
+}
+
+func (d *DiskStorage) evict() {
+	for d.size > d.MaxSize && d.ll.Len() > 0 {
+		d.remove(d.ll.Back().Value.(*diskItem).name)
+	}
+}
+
+// Size returns the number of bytes stored.
+func (d *DiskStorage) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
@@ -0,0 +1,410 @@
+// Package chaos injects faults in the traffic going through the proxy, to test how
+// clients cope with slow, failing or misbehaving servers. Faults apply to plain HTTP
+// requests and to MITM'd HTTPS requests through a ReqHandler and a RespHandler, and to
+// CONNECT tunnels through an HttpsHandler.
+//
+//	c := chaos.New()
+//	c.Add(chaos.Latency("slow-api", 2*time.Second, time.Second), goproxy.ReqHostIs("api.example.com"))
+//	c.Add(chaos.Error("flaky-api", http.StatusServiceUnavailable, 0.1), goproxy.UrlMatches(regexp.MustCompile(`/v1/`)))
+//	c.Register(proxy)
+//	c.Enable("slow-api", false) // at any time, from any goroutine
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+)
+
+var injectedTotal = metrics.NewCounterVec("proxy_chaos_faults_total",
+	"Faults injected by the chaos handlers.", "fault")
+
+// ErrReset is returned by the response bodies reset by a fault.
+var ErrReset = errors.New("chaos: connection reset")
+
+// Fault describes the faults injected in the transactions it applies to. Its effects
+// combine, a Fault can for example both delay a response and throttle it. The After,
+// Reset, Stall and Truncate fields act on the response body, or on the bytes sent by
+// the server in a tunnel.
+type Fault struct {
+	// Name identifies the fault in the Chaos
+	Name string
+	// Probability is the chance, between 0 and 1, of injecting the fault in a transaction
+	// it applies to: 0 never injects it, and 1 every time. The constructors other than
+	// Error set it to 1
+	Probability float64
+	// Latency delays the request by Latency plus a random duration up to Jitter
+	Latency, Jitter time.Duration
+	// Status answers the request with this status instead of forwarding it
+	Status int
+	// After is the number of body bytes sent before Stall, Truncate and Reset happen
+	After int64
+	// Stall pauses the body for this long once After bytes are sent
+	Stall time.Duration
+	// Truncate ends the body once After bytes are sent, as if the server ended it
+	Truncate bool
+	// Reset aborts the connection once After bytes are sent
+	Reset bool
+	// BytesPerSecond throttles the body, and both directions of tunnels, 0 disables it
+	BytesPerSecond int64
+
+	conds    []goproxy.ReqCondition
+	disabled int32
+}
+
+// Latency returns a Fault delaying requests by d plus a random duration up to jitter.
+func Latency(name string, d, jitter time.Duration) *Fault {
+	return &Fault{Name: name, Latency: d, Jitter: jitter, Probability: 1}
+}
+
+// Error returns a Fault answering requests with status, with the given probability.
+func Error(name string, status int, probability float64) *Fault {
+	return &Fault{Name: name, Status: status, Probability: probability}
+}
+
+// Reset returns a Fault aborting the connection after sending after body bytes.
+func Reset(name string, after int64) *Fault {
+	return &Fault{Name: name, After: after, Reset: true, Probability: 1}
+}
+
+// Stall returns a Fault pausing the body for d after sending after bytes.
+func Stall(name string, after int64, d time.Duration) *Fault {
+	return &Fault{Name: name, After: after, Stall: d, Probability: 1}
+}
+
+// Truncate returns a Fault ending the body after sending after bytes.
+func Truncate(name string, after int64) *Fault {
+	return &Fault{Name: name, After: after, Truncate: true, Probability: 1}
+}
+
+// Throttle returns a Fault limiting the bandwidth to bytesPerSecond.
+func Throttle(name string, bytesPerSecond int64) *Fault {
+	return &Fault{Name: name, BytesPerSecond: bytesPerSecond, Probability: 1}
+}
+
+// Enabled reports whether the fault is injected.
+func (f *Fault) Enabled() bool {
+	return atomic.LoadInt32(&f.disabled) == 0
+}
+
+func (f *Fault) actsOnBody() bool {
+	return f.Stall > 0 || f.Truncate || f.Reset || f.BytesPerSecond > 0
+}
+
+// Chaos holds the faults registered on a proxy. Its methods are safe for concurrent use.
+type Chaos struct {
+	mu     sync.RWMutex
+	faults []*Fault
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// New returns a Chaos without faults.
+func New() *Chaos {
+	return &Chaos{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Add injects f, enabled, in the transactions matching all of conds. The faults are
+// evaluated in the order they are added.
+func (c *Chaos) Add(f *Fault, conds ...goproxy.ReqCondition) *Fault {
+	f.conds = conds
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults, f)
+	return f
+}
+
+// Remove removes the faults with the given name.
+func (c *Chaos) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	faults := c.faults[:0:0]
+	for _, f := range c.faults {
+		if f.Name != name {
+			faults = append(faults, f)
+		}
+	}
+	c.faults = faults
+}
+
+// Enable enables or disables the faults with the given name. It reports whether there was any.
+func (c *Chaos) Enable(name string, enabled bool) bool {
+	disabled := int32(1)
+	if enabled {
+		disabled = 0
+	}
+	found := false
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.faults {
+		if f.Name == name {
+			atomic.StoreInt32(&f.disabled, disabled)
+			found = true
+		}
+	}
+	return found
+}
+
+// Faults returns the registered faults.
+func (c *Chaos) Faults() []*Fault {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]*Fault(nil), c.faults...)
+}
+
+func (c *Chaos) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	if p >= 1 {
+		return true
+	}
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Float64() < p
+}
+
+func (c *Chaos) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return time.Duration(c.rand.Int63n(int64(max)))
+}
+
+// active returns the enabled faults applying to req, after rolling their probability.
+func (c *Chaos) active(req *http.Request, ctx *goproxy.ProxyCtx) []*Fault {
+	var active []*Fault
+	for _, f := range c.Faults() {
+		if !f.Enabled() {
+			continue
+		}
+		matches := true
+		for _, cond := range f.conds {
+			if !cond.HandleReq(req, ctx) {
+				matches = false
+				break
+			}
+		}
+		if matches && c.roll(f.Probability) {
+			injectedTotal.With(f.Name).Inc()
+			active = append(active, f)
+		}
+	}
+	return active
+}
+
+// delay sleeps for the latency of faults, or until ctx is done.
+func (c *Chaos) delay(req *http.Request, faults []*Fault) {
+	var d time.Duration
+	for _, f := range faults {
+		d += f.Latency + c.jitter(f.Jitter)
+	}
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-req.Context().Done():
+	}
+}
+
+// Register adds the handlers injecting the faults of c to proxy. CONNECT requests to which
+// a fault applies are tunneled by c, so to apply faults to the requests of MITM'd
+// connections instead, register the HttpsHandlers deciding to MITM first.
+func (c *Chaos) Register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(c.HandleRequest())
+	proxy.OnResponse().Do(c.HandleResponse())
+	proxy.OnRequest().HandleConnect(c.HandleConnect())
+}
+
+type activeKey struct{}
+
+// HandleRequest returns the ReqHandler delaying and failing requests.
+func (c *Chaos) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		faults := c.active(req, ctx)
+		// the requests of a tunnel MITM'd in cleartext share its ctx, the faults of the
+		// previous one must not act on this one
+		ctx.SetValue(activeKey{}, faults)
+		if len(faults) == 0 {
+			return req, nil
+		}
+		ctx.Logf("chaos: injecting %d faults", len(faults))
+		c.delay(req, faults)
+		for _, f := range faults {
+			if f.Status != 0 {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, f.Status,
+					"chaos: injected "+strconv.Itoa(f.Status)+" "+http.StatusText(f.Status)+"\n")
+			}
+		}
+		return req, nil
+	})
+}
+
+// HandleResponse returns the RespHandler applying the faults acting on response bodies.
+func (c *Chaos) HandleResponse() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		faults, _ := ctx.Value(activeKey{}).([]*Fault)
+		if resp == nil || resp.Body == nil {
+			return resp
+		}
+		for _, f := range faults {
+			if f.actsOnBody() {
+				resp.Body = newFaultyReader(resp.Body, f)
+			}
+		}
+		return resp
+	})
+}
+
+// HandleConnect returns the HttpsHandler tunneling the CONNECT requests to which faults
+// apply, and leaving the others to the next handlers.
+func (c *Chaos) HandleConnect() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		faults := c.active(ctx.Req, ctx)
+		if len(faults) == 0 {
+			return nil, ""
+		}
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectHijack,
+			Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				c.tunnel(req, client, ctx, host, faults)
+			},
+		}, host
+	})
+}
+
+func (c *Chaos) tunnel(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx, host string, faults []*Fault) {
+	defer client.Close()
+	c.delay(req, faults)
+	for _, f := range faults {
+		if f.Status != 0 {
+			io.WriteString(client, "HTTP/1.1 "+strconv.Itoa(f.Status)+" "+http.StatusText(f.Status)+"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+	}
+	remote, err := ctx.Dial("tcp", host)
+	if err != nil {
+		ctx.Warnf("chaos: cannot dial %v: %v", host, err)
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer remote.Close()
+	if _, err := io.WriteString(client, "HTTP/1.0 200 OK\r\n\r\n"); err != nil {
+		return
+	}
+
+	var upstream, downstream io.Reader = remote, client
+	for _, f := range faults {
+		if f.actsOnBody() {
+			upstream = newFaultyReader(io.NopCloser(upstream), f)
+		}
+		if f.BytesPerSecond > 0 {
+			downstream = newFaultyReader(io.NopCloser(downstream), &Fault{BytesPerSecond: f.BytesPerSecond})
+		}
+	}
+	go func() {
+		io.Copy(remote, downstream)
+		remote.Close()
+	}()
+	_, err = io.Copy(client, upstream)
+	if err == ErrReset {
+		if l, ok := client.(interface{ SetLinger(sec int) error }); ok {
+			// a zero linger sends a RST instead of a FIN
+			l.SetLinger(0)
+		}
+	}
+}
+
+// faultyReader applies the body faults of f to a body.
+type faultyReader struct {
+	io.ReadCloser
+	f       *Fault
+	n       int64
+	stalled bool
+	start   time.Time
+}
+
+func newFaultyReader(r io.ReadCloser, f *Fault) *faultyReader {
+	return &faultyReader{ReadCloser: r, f: f}
+}
+
+func (r *faultyReader) Read(p []byte) (int, error) {
+	f := r.f
+	if r.n >= f.After {
+		if f.Stall > 0 && !r.stalled {
+			r.stalled = true
+			time.Sleep(f.Stall)
+		}
+		if f.Truncate {
+			return 0, io.EOF
+		}
+		if f.Reset {
+			return 0, ErrReset
+		}
+	} else if f.Stall > 0 || f.Truncate || f.Reset {
+		// stop exactly at After
+		if rest := f.After - r.n; int64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+	if f.BytesPerSecond > 0 && int64(len(p)) > f.BytesPerSecond {
+		p = p[:f.BytesPerSecond]
+	}
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if f.BytesPerSecond > 0 {
+		// sleep until the bytes read so far are within the allowed rate
+		due := r.start.Add(time.Duration(r.n * int64(time.Second) / f.BytesPerSecond))
+		if d := time.Until(due); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
+
+// ServeHTTP lists the faults as JSON, and enables or disables them on POST requests
+// with the name and enabled form values:
+//
+//	curl -d name=slow-api -d enabled=false http://localhost:9090/chaos
+func (c *Chaos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled value", http.StatusBadRequest)
+			return
+		}
+		if !c.Enable(r.FormValue("name"), enabled) {
+			http.Error(w, "no such fault", http.StatusNotFound)
+			return
+		}
+	}
+	type fault struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}
+	faults := []fault{}
+	for _, f := range c.Faults() {
+		faults = append(faults, fault{f.Name, f.Enabled()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faults)
+}
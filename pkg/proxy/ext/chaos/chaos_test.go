@@ -0,0 +1,187 @@
+package chaos_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/chaos"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/internal/proxytest"
+)
+
+var body = strings.Repeat("0123456789", 200)
+
+func upstream() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2000")
+		io.WriteString(w, body)
+	})
+}
+
+func TestFaults(t *testing.T) {
+	plain := httptest.NewServer(upstream())
+	defer plain.Close()
+	secure := httptest.NewTLSServer(upstream())
+	defer secure.Close()
+	secureHost := secure.Listener.Addr().String()
+
+	c := chaos.New()
+	c.Add(chaos.Latency("slow", 100*time.Millisecond, 0), goproxy.UrlMatches(regexp.MustCompile(`/slow$`)))
+	c.Add(chaos.Error("fail", http.StatusServiceUnavailable, 1), goproxy.UrlMatches(regexp.MustCompile(`/fail$`)))
+	c.Add(chaos.Truncate("truncate", 5), goproxy.UrlMatches(regexp.MustCompile(`/truncate$`)))
+	c.Add(chaos.Reset("reset", 5), goproxy.UrlMatches(regexp.MustCompile(`/reset$`)))
+	c.Add(chaos.Stall("stall", 5, 100*time.Millisecond), goproxy.UrlMatches(regexp.MustCompile(`/stall$`)))
+	c.Add(chaos.Throttle("throttle", 10000), goproxy.UrlMatches(regexp.MustCompile(`/throttle$`)))
+	c.Add(chaos.Error("never", http.StatusInternalServerError, 0), goproxy.UrlMatches(regexp.MustCompile(`/never$`)))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(secureHost)).HandleConnect(goproxy.AlwaysMitm)
+	c.Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	for _, base := range []string{plain.URL, secure.URL} {
+		start := time.Now()
+		if _, b, err := proxytest.Do(client, "GET", base+"/slow", ""); err != nil || b != body || time.Since(start) < 100*time.Millisecond {
+			t.Errorf("%s/slow: expected a delayed response, got %v after %v", base, err, time.Since(start))
+		}
+		if resp, _, err := proxytest.Do(client, "GET", base+"/fail", ""); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s/fail: expected 503, got %v %v", base, resp, err)
+		}
+		if resp, _, err := proxytest.Do(client, "GET", base+"/ok", ""); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s/ok: expected 200, got %v %v", base, resp, err)
+		}
+		if resp, _, err := proxytest.Do(client, "GET", base+"/never", ""); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s/never: fault of probability 0 injected, got %v %v", base, resp, err)
+		}
+		if _, b, err := proxytest.Do(client, "GET", base+"/truncate", ""); err != nil || b != "01234" {
+			t.Errorf("%s/truncate: expected a short body, got %q %v", base, b, err)
+		}
+		if _, b, err := proxytest.Do(client, "GET", base+"/reset", ""); err == nil || len(b) > 5 {
+			t.Errorf("%s/reset: expected an aborted body, got %d bytes %v", base, len(b), err)
+		}
+		start = time.Now()
+		if _, b, err := proxytest.Do(client, "GET", base+"/stall", ""); err != nil || b != body || time.Since(start) < 100*time.Millisecond {
+			t.Errorf("%s/stall: expected a stalled body, got %v after %v", base, err, time.Since(start))
+		}
+		start = time.Now()
+		if _, b, err := proxytest.Do(client, "GET", base+"/throttle", ""); err != nil || b != body || time.Since(start) < 150*time.Millisecond {
+			t.Errorf("%s/throttle: expected a throttled body, got %v after %v", base, err, time.Since(start))
+		}
+	}
+
+	if !c.Enable("fail", false) {
+		t.Fatal("fault not found")
+	}
+	if resp, _, err := proxytest.Do(client, "GET", plain.URL+"/fail", ""); err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("disabled fault still injected", resp, err)
+	}
+}
+
+func TestTunnelFaults(t *testing.T) {
+	secure := httptest.NewTLSServer(upstream())
+	defer secure.Close()
+	host := secure.Listener.Addr().String()
+
+	c := chaos.New()
+	fail := c.Add(chaos.Error("fail", http.StatusBadGateway, 1), goproxy.ReqHostIs(host))
+	c.Add(chaos.Reset("reset", 100), goproxy.ReqHostIs(host))
+	c.Enable("reset", false)
+	proxy := goproxy.NewProxyHttpServer()
+	c.Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	if _, _, err := proxytest.Do(client, "GET", secure.URL+"/", ""); err == nil || !strings.Contains(err.Error(), "Bad Gateway") {
+		t.Error("expected the CONNECT request to fail, got", err)
+	}
+	c.Enable("fail", false)
+	if fail.Enabled() {
+		t.Fatal("fault not disabled")
+	}
+	if _, b, err := proxytest.Do(client, "GET", secure.URL+"/", ""); err != nil || b != body {
+		t.Error("tunnel without enabled faults failed", err)
+	}
+	c.Enable("reset", true)
+	if _, _, err := proxytest.Do(client, "GET", secure.URL+"/", ""); err == nil {
+		t.Error("expected the tunnel to be reset")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	c := chaos.New()
+	c.Add(chaos.Latency("slow", time.Second, 0))
+	admin := httptest.NewServer(c)
+	defer admin.Close()
+
+	resp, err := http.PostForm(admin.URL, url.Values{"name": {"slow"}, "enabled": {"false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var faults []struct {
+		Name    string
+		Enabled bool
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&faults); err != nil {
+		t.Fatal(err)
+	}
+	if len(faults) != 1 || faults[0].Name != "slow" || faults[0].Enabled {
+		t.Errorf("unexpected faults %+v", faults)
+	}
+	resp, _ = http.PostForm(admin.URL, url.Values{"name": {"unknown"}, "enabled": {"true"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("unknown fault toggled", resp.StatusCode)
+	}
+}
+
+func TestMitmTunnelFaults(t *testing.T) {
+	plain := httptest.NewServer(upstream())
+	defer plain.Close()
+	host := plain.Listener.Addr().String()
+
+	c := chaos.New()
+	c.Add(chaos.Stall("stall", 5, time.Second), goproxy.UrlMatches(regexp.MustCompile(`/stall$`)))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	c.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("CONNECT failed", err)
+	}
+	// the requests of the tunnel share its ctx, the faults of the first one must not
+	// act on the second one
+	for _, path := range []string{"/stall", "/ok"} {
+		start := time.Now()
+		io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil || string(b) != body {
+			t.Fatalf("%s: got %d bytes, %v", path, len(b), err)
+		}
+		if stalled := time.Since(start) >= time.Second; stalled != (path == "/stall") {
+			t.Errorf("%s: stalled %v after %v", path, stalled, time.Since(start))
+		}
+	}
+}
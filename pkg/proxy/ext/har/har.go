@@ -0,0 +1,186 @@
+// Package har records the traffic going through the proxy, MITM'd HTTPS requests included,
+// as HTTP Archive 1.2 files (http://www.softwareishard.com/blog/har-12-spec/).
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/rotate"
+)
+
+// HAR is the root object of a HAR file.
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is one request and its response. The fields prefixed with an underscore in
+// JSON are extensions describing the proxy transaction.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is the total time of the request in milliseconds
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           Cache    `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	ServerIPAddress string   `json:"serverIPAddress,omitempty"`
+	Comment         string   `json:"comment,omitempty"`
+	Session         int64    `json:"_session,omitempty"`
+	User            string   `json:"_user,omitempty"`
+	// Error is set when no response could be obtained from the upstream server
+	Error string `json:"_error,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int64       `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type Cookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is the body of a request. Bodies that are not valid UTF-8 are base64
+// encoded, with Encoding set to "base64".
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	// Truncated is set when the body was larger than the recorded Text
+	Truncated bool `json:"_truncated,omitempty"`
+}
+
+// Body returns the decoded body.
+func (p *PostData) Body() ([]byte, error) {
+	return decodeText(p.Text, p.Encoding)
+}
+
+// Content is the body of a response, decoded from its Content-Encoding: Size counts
+// the decoded bytes. The bodies of the content codings the proxy does not support,
+// see goproxy.DecodeBody, are recorded as received.
+type Content struct {
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+// Body returns the decoded body.
+func (c *Content) Body() ([]byte, error) {
+	return decodeText(c.Text, c.Encoding)
+}
+
+type Cache struct{}
+
+// Timings are the durations of the phases of a request in milliseconds, -1 when the
+// phase did not happen, for example DNS and Connect on a reused connection. As the HAR
+// specification mandates, Connect includes SSL.
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func decodeText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+var creator = Creator{Name: "go-httpproxy", Version: "1.0"}
+
+// Header, Separator and Footer turn a stream of JSON entries into a HAR file.
+var (
+	Header    = []byte(`{"log":{"version":"1.2","creator":{"name":"` + creator.Name + `","version":"` + creator.Version + `"},"entries":[` + "\n")
+	Separator = []byte(",\n")
+	Footer    = []byte("\n]}}\n")
+)
+
+// NewFile returns a rotating file for a Recorder, every file of which is a complete
+// HAR file once closed or rotated.
+func NewFile(path string, maxSize int64) *rotate.File {
+	f := rotate.New(path, maxSize)
+	f.Header, f.Separator, f.Footer = Header, Separator, Footer
+	return f
+}
+
+// Load reads the HAR file at path.
+func Load(path string) (*HAR, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(bytes.NewReader(b))
+}
+
+// Decode reads a HAR file from r. A file written by NewFile that is still open, and so
+// lacks its footer, is accepted too.
+func Decode(r io.Reader) (*HAR, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var h HAR
+	err = json.Unmarshal(b, &h)
+	if err != nil && bytes.HasPrefix(b, Header) && !bytes.HasSuffix(b, Footer) {
+		if err2 := json.Unmarshal(append(b, Footer...), &h); err2 == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
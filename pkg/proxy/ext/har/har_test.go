@@ -0,0 +1,205 @@
+package har_test
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/har"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/replay"
+)
+
+func echoServer() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "42"})
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	plain := httptest.NewServer(echoServer())
+	defer plain.Close()
+	secure := httptest.NewTLSServer(echoServer())
+	defer secure.Close()
+
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	file := har.NewFile(path, 0)
+	rec := har.NewRecorder(file)
+	rec.MaxBodySize = 16
+	rec.OnError = func(err error) { t.Error(err) }
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlIs("/skip")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.User = "other"
+		return req, nil
+	})
+	rec.Register(proxy, goproxy.Not(goproxy.UserIs("other")))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	do := func(method, u, body string) {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, _ := http.NewRequest(method, u, r)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	do("GET", plain.URL+"/get?b=2&a=1", "")
+	do("POST", plain.URL+"/post", "a long request body")
+	do("GET", secure.URL+"/mitm", "")
+	do("GET", plain.URL+"/skip", "")
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := har.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Log.Version != "1.2" {
+		t.Error("unexpected version", h.Log.Version)
+	}
+	entries := h.Log.Entries
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	get := entries[0]
+	if get.Request.Method != "GET" || get.Response.Status != 200 || get.Response.Content.Text != "GET /get " {
+		t.Errorf("unexpected entry %+v", get)
+	}
+	if len(get.Request.QueryString) != 2 || get.Request.QueryString[0] != (har.NameValue{Name: "b", Value: "2"}) {
+		t.Error("unexpected query string", get.Request.QueryString)
+	}
+	if len(get.Response.Cookies) != 1 || get.Response.Cookies[0].Name != "session" {
+		t.Error("cookies not recorded", get.Response.Cookies)
+	}
+	if get.Timings.Connect < 0 || get.Timings.Send < 0 || get.Timings.Wait < 0 || get.Timings.Receive < 0 || get.Timings.SSL != -1 {
+		t.Errorf("unexpected timings %+v", get.Timings)
+	}
+	if get.ServerIPAddress != "127.0.0.1" {
+		t.Error("unexpected server address", get.ServerIPAddress)
+	}
+
+	post := entries[1]
+	if post.Request.PostData == nil || post.Request.PostData.Text != "a long request b" || !post.Request.PostData.Truncated ||
+		post.Request.BodySize != int64(len("a long request body")) {
+		t.Errorf("unexpected post data %+v", post.Request)
+	}
+	if !post.Response.Content.Truncated || post.Response.Content.Size != int64(len("POST /post a long request body")) {
+		t.Errorf("unexpected content %+v", post.Response.Content)
+	}
+
+	mitm := entries[2]
+	if !strings.HasPrefix(mitm.Request.URL, "https://") || mitm.Response.Content.Text != "GET /mitm " {
+		t.Errorf("MITM request not recorded %+v", mitm)
+	}
+	if mitm.Timings.SSL < 0 || mitm.Timings.Connect < mitm.Timings.SSL {
+		t.Errorf("unexpected TLS timings %+v", mitm.Timings)
+	}
+}
+
+func TestDecodeUnterminated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "open.har")
+	file := har.NewFile(path, 0)
+	file.Write([]byte(`{"request":{"method":"GET","url":"http://example.com/"}}`))
+	defer file.Close()
+	h, err := har.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Log.Entries) != 1 || h.Log.Entries[0].Request.URL != "http://example.com/" {
+		t.Errorf("unexpected entries %+v", h.Log.Entries)
+	}
+}
+
+func TestRecorderDecodes(t *testing.T) {
+	compressed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, "compressed body")
+		gz.Close()
+	}))
+	defer compressed.Close()
+
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	file := har.NewFile(path, 0)
+	proxy := goproxy.NewProxyHttpServer()
+	har.NewRecorder(file).Register(proxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(compressed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "compressed body" || !resp.Uncompressed {
+		t.Errorf("client got %q, uncompressed by its transport %v", body, resp.Uncompressed)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := har.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Log.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(h.Log.Entries))
+	}
+	if c := h.Log.Entries[0].Response.Content; c.Text != "compressed body" || c.Size != int64(len("compressed body")) {
+		t.Errorf("content %+v, want the decoded body", c)
+	}
+	for _, nv := range h.Log.Entries[0].Response.Headers {
+		if strings.EqualFold(nv.Name, "Content-Encoding") {
+			t.Errorf("decoded body recorded with the header %s: %s", nv.Name, nv.Value)
+		}
+	}
+
+	// the recording replays as it was received
+	r, err := replay.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaying := goproxy.NewProxyHttpServer()
+	r.Register(replaying)
+	replayServer := httptest.NewServer(replaying)
+	defer replayServer.Close()
+	replayURL, _ := url.Parse(replayServer.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(replayURL)}}
+	resp, err = client.Get(compressed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "compressed body" {
+		t.Errorf("replayed body %q %v", body, err)
+	}
+}
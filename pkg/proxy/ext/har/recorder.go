@@ -0,0 +1,367 @@
+package har
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// DefaultMaxBodySize is the MaxBodySize of the recorders returned by NewRecorder.
+const DefaultMaxBodySize = 1 << 20
+
+// Recorder writes a HAR entry for every request it handles. It has a request and a
+// response handler, both of which must be registered, as Register does. Handlers see the
+// traffic as left by the handlers registered before them, so a Recorder registered
+// last records what is actually sent upstream and to the client.
+type Recorder struct {
+	// Out receives every entry as one JSON object per Write, see NewFile
+	Out io.Writer
+	// MaxBodySize is the number of bytes recorded from the request and response bodies,
+	// 0 records none, a negative value records the whole bodies
+	MaxBodySize int64
+	// OnError is called with the errors writing to Out, if not nil
+	OnError func(error)
+
+	mu sync.Mutex
+}
+
+// NewRecorder returns a Recorder writing to out, keeping the first DefaultMaxBodySize
+// bytes of bodies.
+func NewRecorder(out io.Writer) *Recorder {
+	return &Recorder{Out: out, MaxBodySize: DefaultMaxBodySize}
+}
+
+// Register records the requests matching all of conds, for example
+//
+//	rec.Register(proxy, goproxy.ReqHostIs("api.example.com:443"), goproxy.UserIs("ci"))
+func (rec *Recorder) Register(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).Do(rec.HandleRequest())
+	proxy.OnResponse().Do(rec.HandleResponse())
+}
+
+// HandleRequest returns the ReqHandler starting the entry of a request.
+func (rec *Recorder) HandleRequest() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(rec.handleRequest)
+}
+
+// HandleResponse returns the RespHandler completing the entries started by HandleRequest.
+// The entry is written once the client has read the whole response body.
+func (rec *Recorder) HandleResponse() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(rec.handleResponse)
+}
+
+type transactionKey struct{}
+
+func (rec *Recorder) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	t := &transaction{rec: rec, ctx: ctx, start: time.Now()}
+	if req.Body != nil && req.Body != http.NoBody {
+		t.reqBody = &capture{ReadCloser: req.Body, max: rec.MaxBodySize}
+		req.Body = t.reqBody
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+	t.req = req
+	ctx.SetValue(transactionKey{}, t)
+	return req, nil
+}
+
+func (rec *Recorder) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	t, _ := ctx.Value(transactionKey{}).(*transaction)
+	if t == nil {
+		return resp
+	}
+	ctx.SetValue(transactionKey{}, nil)
+	t.mu.Lock()
+	t.responded = time.Now()
+	t.mu.Unlock()
+	if resp == nil {
+		t.finish(nil, nil, ctx.Error)
+		return resp
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		t.finish(resp, nil, nil)
+		return resp
+	}
+	// the content is recorded decoded, the proxy encoding it again for the client
+	if err := goproxy.DecodeBody(resp, ctx); err != nil {
+		ctx.Warnf("har: recording the body as received: %v", err)
+	}
+	t.header = resp.Header.Clone()
+	body := &capture{ReadCloser: resp.Body, max: rec.MaxBodySize}
+	body.done = func(err error) { t.finish(resp, body, err) }
+	resp.Body = body
+	return resp
+}
+
+func (rec *Recorder) write(e *Entry) {
+	b, err := json.Marshal(e)
+	if err == nil {
+		rec.mu.Lock()
+		_, err = rec.Out.Write(b)
+		rec.mu.Unlock()
+	}
+	if err != nil && rec.OnError != nil {
+		rec.OnError(err)
+	}
+}
+
+// capture records the first max bytes read from a body, and calls done once the body
+// is read or closed.
+type capture struct {
+	io.ReadCloser
+	max int64
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	n    int64
+	done func(err error)
+	once sync.Once
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	c.n += int64(n)
+	keep := int64(n)
+	if c.max >= 0 && keep > c.max-int64(c.buf.Len()) {
+		keep = c.max - int64(c.buf.Len())
+	}
+	c.buf.Write(p[:keep])
+	c.mu.Unlock()
+	if err != nil {
+		if err == io.EOF {
+			c.finish(nil)
+		} else {
+			c.finish(err)
+		}
+	}
+	return n, err
+}
+
+func (c *capture) Close() error {
+	err := c.ReadCloser.Close()
+	c.finish(nil)
+	return err
+}
+
+func (c *capture) finish(err error) {
+	if c.done != nil {
+		c.once.Do(func() { c.done(err) })
+	}
+}
+
+// text returns the recorded bytes as HAR text and encoding, and the total body size.
+func (c *capture) text() (text, encoding string, size int64, truncated bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.buf.Bytes()
+	text = string(b)
+	if !utf8.Valid(b) {
+		text, encoding = base64.StdEncoding.EncodeToString(b), "base64"
+	}
+	return text, encoding, c.n, c.n > int64(len(b))
+}
+
+// transaction collects the timings of a request through httptrace.
+type transaction struct {
+	rec     *Recorder
+	ctx     *goproxy.ProxyCtx
+	req     *http.Request
+	reqBody *capture
+	start   time.Time
+	// header of the response once its body is decoded, before the proxy encodes it again
+	header http.Header
+
+	mu                        sync.Mutex
+	getConn, gotConn          time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wroteRequest, firstByte   time.Time
+	responded                 time.Time
+}
+
+func (t *transaction) clientTrace() *httptrace.ClientTrace {
+	set := func(dst *time.Time, first bool) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !first || dst.IsZero() {
+			*dst = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		GetConn:              func(string) { set(&t.getConn, true) },
+		GotConn:              func(httptrace.GotConnInfo) { set(&t.gotConn, false) },
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&t.dnsStart, true) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&t.dnsDone, false) },
+		ConnectStart:         func(string, string) { set(&t.connectStart, true) },
+		ConnectDone:          func(string, string, error) { set(&t.connectDone, false) },
+		TLSHandshakeStart:    func() { set(&t.tlsStart, true) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&t.tlsDone, false) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&t.wroteRequest, false) },
+		GotFirstResponseByte: func() { set(&t.firstByte, true) },
+	}
+}
+
+// ms returns the duration from a to b in milliseconds, -1 if either is unknown.
+func ms(a, b time.Time) float64 {
+	if a.IsZero() || b.IsZero() {
+		return -1
+	}
+	return float64(b.Sub(a)) / float64(time.Millisecond)
+}
+
+func (t *transaction) timings(end time.Time) Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tm := Timings{
+		DNS:     ms(t.dnsStart, t.dnsDone),
+		Connect: ms(t.connectStart, t.connectDone),
+		SSL:     ms(t.tlsStart, t.tlsDone),
+		Blocked: -1,
+	}
+	if tm.SSL >= 0 && tm.Connect >= 0 {
+		tm.Connect += tm.SSL
+	}
+	if d := ms(t.getConn, t.gotConn); d >= 0 {
+		tm.Blocked = d - max0(tm.DNS) - max0(tm.Connect)
+		if tm.Blocked < 0 {
+			tm.Blocked = 0
+		}
+	}
+	tm.Send = max0(ms(t.gotConn, t.wroteRequest))
+	tm.Wait = max0(ms(t.wroteRequest, t.firstByte))
+	firstByte := t.firstByte
+	if firstByte.IsZero() {
+		firstByte = t.responded
+	}
+	tm.Receive = max0(ms(firstByte, end))
+	return tm
+}
+
+func max0(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	return f
+}
+
+func (t *transaction) finish(resp *http.Response, body *capture, err error) {
+	end := time.Now()
+	req, ctx := t.req, t.ctx
+	e := &Entry{
+		StartedDateTime: t.start,
+		Time:            ms(t.start, end),
+		Timings:         t.timings(end),
+		Session:         ctx.Session,
+		User:            ctx.User,
+		Request: Request{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     cookies(req.Cookies()),
+			Headers:     headers(req.Header),
+			QueryString: queryString(req.URL.RawQuery),
+			HeadersSize: -1,
+		},
+	}
+	if ctx.RoundTripDetails != nil && ctx.RoundTripDetails.TCPAddr != nil {
+		e.ServerIPAddress = ctx.RoundTripDetails.TCPAddr.IP.String()
+	}
+	if t.reqBody != nil {
+		text, encoding, size, truncated := t.reqBody.text()
+		e.Request.BodySize = size
+		e.Request.PostData = &PostData{
+			MimeType:  req.Header.Get("Content-Type"),
+			Text:      text,
+			Encoding:  encoding,
+			Truncated: truncated,
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if resp != nil {
+		header := resp.Header
+		if t.header != nil {
+			header = t.header
+		}
+		e.Response = Response{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" "),
+			HTTPVersion: resp.Proto,
+			Cookies:     cookies(resp.Cookies()),
+			Headers:     headers(header),
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			Content:     Content{MimeType: header.Get("Content-Type")},
+		}
+		if body != nil {
+			c := &e.Response.Content
+			c.Text, c.Encoding, c.Size, c.Truncated = body.text()
+			e.Response.BodySize = c.Size
+		}
+	} else {
+		e.Response = Response{Cookies: []Cookie{}, Headers: []NameValue{}, HeadersSize: -1, BodySize: -1}
+	}
+	t.rec.write(e)
+}
+
+func headers(h http.Header) []NameValue {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	nv := []NameValue{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			nv = append(nv, NameValue{k, v})
+		}
+	}
+	return nv
+}
+
+// queryString splits the query in its original order, which url.ParseQuery loses.
+func queryString(raw string) []NameValue {
+	nv := []NameValue{}
+	for _, kv := range strings.Split(raw, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if uv, err := url.QueryUnescape(v); err == nil {
+			v = uv
+		}
+		nv = append(nv, NameValue{k, v})
+	}
+	return nv
+}
+
+func cookies(cs []*http.Cookie) []Cookie {
+	out := []Cookie{}
+	for _, c := range cs {
+		hc := Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			hc.Expires = &expires
+		}
+		out = append(out, hc)
+	}
+	return out
+}
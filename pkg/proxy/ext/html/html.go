@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 
@@ -21,20 +22,31 @@ var IsCss goproxy.RespCondition = goproxy.ContentTypeIs("text/css")
 var IsJavaScript goproxy.RespCondition = goproxy.ContentTypeIs("text/javascript",
 	"application/javascript")
 
-var IsJson goproxy.RespCondition = goproxy.ContentTypeIs("text/json")
+// IsJson matches application/json, text/json and +json responses.
+var IsJson goproxy.RespCondition = goproxy.RespConditionFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	if resp == nil {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json"))
+})
 
 var IsXml goproxy.RespCondition = goproxy.ContentTypeIs("text/xml")
 
-var IsWebRelatedText goproxy.RespCondition = goproxy.ContentTypeIs("text/html",
+var isWebRelatedType = goproxy.ContentTypeIs("text/html",
 	"text/css",
 	"text/javascript", "application/javascript",
-	"text/xml",
-	"text/json")
+	"text/xml")
+
+var IsWebRelatedText goproxy.RespCondition = goproxy.RespConditionFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return isWebRelatedType.HandleResp(resp, ctx) || IsJson.HandleResp(resp, ctx)
+})
 
 // HandleString will receive a function that filters a string, and will convert the
 // request body to a utf8 string, according to the charset specified in the Content-Type
 // header.
-// guessing Html charset encoding from the <META> tags is not yet implemented.
+// The charset declared by <META> tags is not looked for, and the whole body is buffered,
+// see Rewriter to process HTML documents while they stream.
 func HandleString(f func(s string, ctx *goproxy.ProxyCtx) string) goproxy.RespHandler {
 	return HandleStringReader(func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader {
 		b, err := ioutil.ReadAll(r)
@@ -53,6 +65,10 @@ func HandleStringReader(f func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader) go
 		if ctx.Error != nil {
 			return nil
 		}
+		if err := goproxy.DecodeBody(resp, ctx); err != nil {
+			ctx.Warnf("Cannot decode response: %v", err)
+			return resp
+		}
 		charsetName := ctx.Charset()
 		if charsetName == "" {
 			charsetName = "utf-8"
@@ -0,0 +1,377 @@
+package proxy_html
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"golang.org/x/net/html"
+	htmlcharset "golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// Element is an HTML element matched by a Rewriter handler. Its start tag has been
+// read, but neither its content nor its end tag, so handlers can change its attributes,
+// insert HTML around or inside it, or remove it.
+type Element struct {
+	// Tag is the lower case name of the element.
+	Tag string
+
+	attrs   []html.Attribute
+	changed bool
+	removed bool
+	before  []string
+	after   []string
+	prepend []string
+	append  []string
+}
+
+// Attr returns the value of the attribute name, and whether it is set.
+func (e *Element) Attr(name string) (string, bool) {
+	for _, a := range e.attrs {
+		if a.Namespace == "" && a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// SetAttr sets the value of the attribute name.
+func (e *Element) SetAttr(name, value string) {
+	e.changed = true
+	for i, a := range e.attrs {
+		if a.Namespace == "" && a.Key == name {
+			e.attrs[i].Val = value
+			return
+		}
+	}
+	e.attrs = append(e.attrs, html.Attribute{Key: name, Val: value})
+}
+
+// RemoveAttr removes the attribute name.
+func (e *Element) RemoveAttr(name string) {
+	for i, a := range e.attrs {
+		if a.Namespace == "" && a.Key == name {
+			e.changed = true
+			e.attrs = append(e.attrs[:i], e.attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove removes the element and its content. HTML inserted with Before and After is
+// still written.
+func (e *Element) Remove() { e.removed = true }
+
+// Removed reports whether the element has been removed.
+func (e *Element) Removed() bool { return e.removed }
+
+// Before inserts raw HTML before the start tag of the element.
+func (e *Element) Before(s string) { e.before = append(e.before, s) }
+
+// After inserts raw HTML after the end tag of the element.
+func (e *Element) After(s string) { e.after = append(e.after, s) }
+
+// Prepend inserts raw HTML after the start tag of the element.
+func (e *Element) Prepend(s string) { e.prepend = append(e.prepend, s) }
+
+// Append inserts raw HTML before the end tag of the element, as </head> or </body>.
+func (e *Element) Append(s string) { e.append = append(e.append, s) }
+
+func (e *Element) startTag(selfClosing bool) string {
+	t := html.Token{Type: html.StartTagToken, Data: e.Tag, Attr: e.attrs}
+	if selfClosing {
+		t.Type = html.SelfClosingTagToken
+	}
+	return t.String()
+}
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "keygen": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+type elementHandler struct {
+	sel selector
+	f   func(el *Element, ctx *goproxy.ProxyCtx)
+}
+
+// Rewriter rewrites HTML documents while they stream through the proxy, calling
+// handlers on the elements matching their selector. Documents are never buffered
+// entirely: handlers only see the start tag of the elements. Rewriter is a RespHandler
+// which leaves alone the responses that are not HTML.
+type Rewriter struct {
+	handlers []elementHandler
+}
+
+// NewRewriter returns a Rewriter without handlers.
+func NewRewriter() *Rewriter {
+	return &Rewriter{}
+}
+
+// On calls f on the elements matching the CSS selector, in the order of the document.
+// Handlers are called in the order they were added. The selector supports type, #id,
+// .class and [attr] selectors with the usual operators, the descendant and child
+// combinators, and comma separated groups.
+func (rw *Rewriter) On(sel string, f func(el *Element, ctx *goproxy.ProxyCtx)) error {
+	s, err := parseSelector(sel)
+	if err != nil {
+		return err
+	}
+	rw.handlers = append(rw.handlers, elementHandler{s, f})
+	return nil
+}
+
+// InjectHead inserts raw HTML, as scripts or styles, before </head>.
+func (rw *Rewriter) InjectHead(s string) {
+	rw.On("head", func(el *Element, ctx *goproxy.ProxyCtx) { el.Append(s) })
+}
+
+// InjectBody inserts raw HTML before </body>.
+func (rw *Rewriter) InjectBody(s string) {
+	rw.On("body", func(el *Element, ctx *goproxy.ProxyCtx) { el.Append(s) })
+}
+
+// Handle rewrites the body of HTML responses, converting it to utf-8 for the handlers
+// and back to its charset, detected with DetectCharset.
+func (rw *Rewriter) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || !IsHtml.HandleResp(resp, ctx) ||
+		ctx.Req != nil && ctx.Req.Method == "HEAD" ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return resp
+	}
+	if err := goproxy.DecodeBody(resp, ctx); err != nil {
+		ctx.Warnf("Cannot decode response: %v", err)
+		return resp
+	}
+	br := bufio.NewReaderSize(resp.Body, 1024)
+	head, _ := br.Peek(1024)
+	enc, name := DetectCharset(head, resp.Header.Get("Content-Type"))
+	var r io.Reader = br
+	if name != "utf-8" {
+		r = transform.NewReader(br, enc.NewDecoder())
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		var tw io.WriteCloser
+		if name != "utf-8" {
+			tw = transform.NewWriter(pw, encoding.ReplaceUnsupported(enc.NewEncoder()))
+			w = tw
+		}
+		err := rw.Rewrite(w, r, ctx)
+		if tw != nil {
+			if cerr := tw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			ctx.Warnf("Cannot rewrite html: %v", err)
+		}
+		pw.CloseWithError(err)
+	}()
+	resp.Body = &readFirstCloseBoth{pr, resp.Body}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return resp
+}
+
+// DetectCharset returns the encoding of an HTML document, and its canonical name, from
+// the first bytes of the document and its Content-Type. The byte order mark wins, then
+// the <meta charset> and <meta http-equiv="Content-Type"> tags, then the charset of the
+// header. Documents default to utf-8.
+func DetectCharset(head []byte, contentType string) (encoding.Encoding, string) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+		return htmlcharset.Lookup("utf-8")
+	case bytes.HasPrefix(head, []byte{0xfe, 0xff}):
+		return htmlcharset.Lookup("utf-16be")
+	case bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+		return htmlcharset.Lookup("utf-16le")
+	}
+	if label := metaCharset(head); label != "" {
+		if enc, name := htmlcharset.Lookup(label); enc != nil {
+			// a document read as ascii cannot be utf-16, it is utf-8
+			if strings.HasPrefix(name, "utf-16") {
+				return htmlcharset.Lookup("utf-8")
+			}
+			return enc, name
+		}
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, name := htmlcharset.Lookup(params["charset"]); enc != nil {
+			return enc, name
+		}
+	}
+	return htmlcharset.Lookup("utf-8")
+}
+
+// metaCharset returns the charset declared by the <meta> tags of head, which ends
+// at the first element not allowed in the head of a document.
+func metaCharset(head []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(head))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "meta":
+				var httpEquiv, content string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "charset":
+						return strings.TrimSpace(a.Val)
+					case "http-equiv":
+						httpEquiv = a.Val
+					case "content":
+						content = a.Val
+					}
+				}
+				if strings.EqualFold(httpEquiv, "content-type") {
+					if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+						return params["charset"]
+					}
+				}
+			case "html", "head", "title", "base", "link", "style", "script", "noscript":
+			default:
+				return ""
+			}
+		}
+	}
+}
+
+// Rewrite copies the utf-8 HTML document r to w, calling the handlers on the matching
+// elements.
+func (rw *Rewriter) Rewrite(w io.Writer, r io.Reader, ctx *goproxy.ProxyCtx) error {
+	bw := bufio.NewWriter(w)
+	z := html.NewTokenizer(r)
+	var stack []*Element
+	// skipping is the element removed, whose content is skipped until its end tag
+	var skipping *Element
+	skipDepth := 0
+
+	writeAll := func(list []string) {
+		for _, s := range list {
+			bw.WriteString(s)
+		}
+	}
+	// closeTo pops the elements of the stack down to i, writing the end tag of the
+	// element i if any
+	closeTo := func(i int, endTag []byte) {
+		for j := len(stack) - 1; j >= i; j-- {
+			el := stack[j]
+			writeAll(el.append)
+			if j == i && endTag != nil {
+				bw.Write(endTag)
+			}
+			writeAll(el.after)
+		}
+		stack = stack[:i]
+	}
+	indexOf := func(tag string) int {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].Tag == tag {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				bw.Flush()
+				return z.Err()
+			}
+			if skipping != nil {
+				writeAll(skipping.after)
+			}
+			closeTo(0, nil)
+			return bw.Flush()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := append([]byte(nil), z.Raw()...)
+			t := z.Token()
+			void := tt == html.SelfClosingTagToken || voidElements[t.Data]
+			if skipping != nil {
+				if t.Data == skipping.Tag && !void {
+					skipDepth++
+				}
+				continue
+			}
+			if t.Data == "body" {
+				// the head ends with the body, even without </head>
+				if i := indexOf("head"); i >= 0 {
+					closeTo(i, nil)
+				}
+			}
+			el := &Element{Tag: t.Data, attrs: t.Attr}
+			for _, h := range rw.handlers {
+				if h.sel.matches(el, stack) {
+					h.f(el, ctx)
+				}
+			}
+			writeAll(el.before)
+			if el.removed {
+				if void {
+					writeAll(el.after)
+				} else {
+					skipping, skipDepth = el, 1
+				}
+				continue
+			}
+			if el.changed {
+				bw.WriteString(el.startTag(tt == html.SelfClosingTagToken))
+			} else {
+				bw.Write(raw)
+			}
+			writeAll(el.prepend)
+			if void {
+				writeAll(el.append)
+				writeAll(el.after)
+			} else {
+				stack = append(stack, el)
+			}
+
+		case html.EndTagToken:
+			raw := append([]byte(nil), z.Raw()...)
+			name, _ := z.TagName()
+			tag := string(name)
+			if skipping != nil {
+				if tag == skipping.Tag {
+					if skipDepth--; skipDepth == 0 {
+						writeAll(skipping.after)
+						skipping = nil
+					}
+					continue
+				}
+				if indexOf(tag) < 0 {
+					continue
+				}
+				// an ancestor ends, so does the removed element
+				writeAll(skipping.after)
+				skipping = nil
+			}
+			if i := indexOf(tag); i >= 0 {
+				closeTo(i, raw)
+			} else {
+				bw.Write(raw)
+			}
+
+		default:
+			if skipping == nil {
+				bw.Write(z.Raw())
+			}
+		}
+	}
+}
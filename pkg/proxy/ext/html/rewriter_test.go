@@ -0,0 +1,123 @@
+package proxy_html_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	proxy_html "github.com/acentior/go-httpproxy/pkg/proxy/ext/html"
+)
+
+func TestRewrite(t *testing.T) {
+	rw := proxy_html.NewRewriter()
+	rw.InjectHead(`<script src="/inject.js"></script>`)
+	rw.InjectBody(`<p>footer</p>`)
+	if err := rw.On(`a[href^="http://"]`, func(el *proxy_html.Element, ctx *goproxy.ProxyCtx) {
+		href, _ := el.Attr("href")
+		el.SetAttr("href", "https://"+strings.TrimPrefix(href, "http://"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.On(".ad, div > img[src$='.gif']", func(el *proxy_html.Element, ctx *goproxy.ProxyCtx) {
+		el.Remove()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.On("ul li#last", func(el *proxy_html.Element, ctx *goproxy.ProxyCtx) {
+		el.Before("<!-- last -->")
+		el.Prepend("* ")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ in, out string }{
+		{
+			`<html><head><title>t</title></head><body><a href="http://a/">a</a><a href="/b">b</a></body></html>`,
+			`<html><head><title>t</title><script src="/inject.js"></script></head><body><a href="https://a/">a</a><a href="/b">b</a><p>footer</p></body></html>`,
+		},
+		{
+			// no </head>, nor </body>
+			`<title>t</title><body><div class="x ad"><div>nested</div> ad</div><div><img src="x.gif"><img src="y.png"></div>`,
+			`<title>t</title><body><div><img src="y.png"></div><p>footer</p>`,
+		},
+		{
+			`<ul><li>1<li id="last">2</ul><script>var s = "<div class=ad>";</script>`,
+			`<ul><li>1<!-- last --><li id="last">* 2</ul><script>var s = "<div class=ad>";</script>`,
+		},
+		{
+			// an unclosed removed element ends with its parent
+			`<div><p class="ad">ad</div><p>kept</p>`,
+			`<div></div><p>kept</p>`,
+		},
+	} {
+		var out bytes.Buffer
+		if err := rw.Rewrite(&out, strings.NewReader(c.in), nil); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != c.out {
+			t.Errorf("rewriting %s\nexpected %s\ngot      %s", c.in, c.out, out.String())
+		}
+	}
+
+	if err := rw.On("a[href", nil); err == nil {
+		t.Error("invalid selector accepted")
+	}
+}
+
+func TestDetectCharset(t *testing.T) {
+	for _, c := range []struct {
+		head, contentType, name string
+	}{
+		{"\xef\xbb\xbf<meta charset=iso-8859-8>", "text/html; charset=windows-1255", "utf-8"},
+		{"\xff\xfe<\x00", "text/html", "utf-16le"},
+		{`<html><head><meta charset="iso-8859-8">`, "text/html; charset=utf-8", "iso-8859-8"},
+		{`<meta http-equiv="Content-Type" content="text/html; charset=windows-1255">`, "text/html", "windows-1255"},
+		{`<meta charset="utf-16">`, "text/html", "utf-8"},
+		{`<body><meta charset="iso-8859-8">`, "text/html; charset=windows-1255", "windows-1255"},
+		{`<p>no charset`, "text/html", "utf-8"},
+	} {
+		if _, name := proxy_html.DetectCharset([]byte(c.head), c.contentType); name != c.name {
+			t.Errorf("%q %q: expected %s, got %s", c.head, c.contentType, c.name, name)
+		}
+	}
+}
+
+func TestRewriterCharset(t *testing.T) {
+	// DALET & PEH SOFIT in ISO-8859-8, declared by the meta tag only
+	page := "<html><head><meta charset=\"iso-8859-8\"></head><body><p>\xe3\xf3</p></body></html>"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(page))
+	}))
+	defer s.Close()
+
+	rw := proxy_html.NewRewriter()
+	rw.On("p", func(el *proxy_html.Element, ctx *goproxy.ProxyCtx) {
+		el.Before("<h1>דף</h1>")
+	})
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(rw)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyUrl, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<html><head><meta charset=\"iso-8859-8\"></head><body><h1>\xe3\xf3</h1><p>\xe3\xf3</p></body></html>"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, b)
+	}
+}
@@ -0,0 +1,289 @@
+package proxy_html
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selector is a group of CSS selectors, matching elements any of them matches.
+type selector []complexSelector
+
+// complexSelector is a chain of compound selectors, from the outermost element to the
+// matched one.
+type complexSelector []compoundSelector
+
+type compoundSelector struct {
+	// combinator relates the compound to the previous one of the chain, ' ' for a
+	// descendant or '>' for a child. It is zero for the first compound.
+	combinator byte
+	tag        string
+	id         string
+	classes    []string
+	attrs      []attrSelector
+}
+
+type attrSelector struct {
+	name, op, value string
+}
+
+// parseSelector parses the supported subset of CSS selectors: type, universal, #id,
+// .class and [attr] selectors, with the =, ~=, |=, ^=, $= and *= operators, the
+// descendant and child combinators, and comma separated groups.
+func parseSelector(s string) (selector, error) {
+	p := &selectorParser{s: s}
+	var sel selector
+	for {
+		c, err := p.complex()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, c)
+		p.skipSpace()
+		if p.eof() {
+			return sel, nil
+		}
+		if p.s[p.i] != ',' {
+			return nil, p.errorf("unexpected %q", p.s[p.i])
+		}
+		p.i++
+	}
+}
+
+type selectorParser struct {
+	s string
+	i int
+}
+
+func (p *selectorParser) eof() bool { return p.i >= len(p.s) }
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("selector %q at %d: %s", p.s, p.i, fmt.Sprintf(format, args...))
+}
+
+func (p *selectorParser) skipSpace() bool {
+	start := p.i
+	for !p.eof() && strings.IndexByte(" \t\n\r\f", p.s[p.i]) >= 0 {
+		p.i++
+	}
+	return p.i > start
+}
+
+func isIdentByte(c byte) bool {
+	return c == '-' || c == '_' || c >= 0x80 ||
+		'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func (p *selectorParser) ident() (string, error) {
+	start := p.i
+	for !p.eof() && isIdentByte(p.s[p.i]) {
+		p.i++
+	}
+	if p.i == start {
+		return "", p.errorf("expected identifier")
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *selectorParser) complex() (complexSelector, error) {
+	p.skipSpace()
+	var c complexSelector
+	var combinator byte
+	for {
+		compound, err := p.compound()
+		if err != nil {
+			return nil, err
+		}
+		compound.combinator = combinator
+		c = append(c, compound)
+		space := p.skipSpace()
+		switch {
+		case p.eof() || p.s[p.i] == ',':
+			return c, nil
+		case p.s[p.i] == '>':
+			p.i++
+			p.skipSpace()
+			combinator = '>'
+		case space:
+			combinator = ' '
+		default:
+			return nil, p.errorf("unexpected %q", p.s[p.i])
+		}
+	}
+}
+
+func (p *selectorParser) compound() (compoundSelector, error) {
+	var c compoundSelector
+	start := p.i
+	if !p.eof() && p.s[p.i] == '*' {
+		p.i++
+	} else if !p.eof() && isIdentByte(p.s[p.i]) {
+		c.tag, _ = p.ident()
+		c.tag = strings.ToLower(c.tag)
+	}
+	for !p.eof() {
+		var err error
+		switch p.s[p.i] {
+		case '#':
+			p.i++
+			c.id, err = p.ident()
+		case '.':
+			p.i++
+			var class string
+			class, err = p.ident()
+			c.classes = append(c.classes, class)
+		case '[':
+			p.i++
+			var a attrSelector
+			a, err = p.attr()
+			c.attrs = append(c.attrs, a)
+		default:
+			if p.i == start {
+				return c, p.errorf("expected selector")
+			}
+			return c, nil
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	if p.i == start {
+		return c, p.errorf("expected selector")
+	}
+	return c, nil
+}
+
+func (p *selectorParser) attr() (attrSelector, error) {
+	var a attrSelector
+	p.skipSpace()
+	name, err := p.ident()
+	if err != nil {
+		return a, err
+	}
+	a.name = strings.ToLower(name)
+	p.skipSpace()
+	if p.eof() {
+		return a, p.errorf("unterminated attribute selector")
+	}
+	if p.s[p.i] == ']' {
+		p.i++
+		return a, nil
+	}
+	if strings.IndexByte("~|^$*", p.s[p.i]) >= 0 {
+		a.op = p.s[p.i : p.i+1]
+		p.i++
+	}
+	if p.eof() || p.s[p.i] != '=' {
+		return a, p.errorf("expected =")
+	}
+	a.op += "="
+	p.i++
+	p.skipSpace()
+	if p.eof() {
+		return a, p.errorf("unterminated attribute selector")
+	}
+	if q := p.s[p.i]; q == '"' || q == '\'' {
+		end := strings.IndexByte(p.s[p.i+1:], q)
+		if end < 0 {
+			return a, p.errorf("unterminated string")
+		}
+		a.value = p.s[p.i+1 : p.i+1+end]
+		p.i += end + 2
+	} else if a.value, err = p.ident(); err != nil {
+		return a, err
+	}
+	p.skipSpace()
+	if p.eof() || p.s[p.i] != ']' {
+		return a, p.errorf("expected ]")
+	}
+	p.i++
+	return a, nil
+}
+
+func (sel selector) matches(el *Element, ancestors []*Element) bool {
+	for _, c := range sel {
+		if c.matches(el, ancestors) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c complexSelector) matches(el *Element, ancestors []*Element) bool {
+	last := len(c) - 1
+	return c[last].matches(el) && c.matchAncestors(last, ancestors)
+}
+
+// matchAncestors reports whether the compounds before c[i] match ancestors, c[i]
+// matching the element following them.
+func (c complexSelector) matchAncestors(i int, ancestors []*Element) bool {
+	if i == 0 {
+		return true
+	}
+	if c[i].combinator == '>' {
+		n := len(ancestors)
+		return n > 0 && c[i-1].matches(ancestors[n-1]) && c.matchAncestors(i-1, ancestors[:n-1])
+	}
+	for j := len(ancestors) - 1; j >= 0; j-- {
+		if c[i-1].matches(ancestors[j]) && c.matchAncestors(i-1, ancestors[:j]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compoundSelector) matches(el *Element) bool {
+	if c.tag != "" && c.tag != el.Tag {
+		return false
+	}
+	if c.id != "" {
+		if id, _ := el.Attr("id"); id != c.id {
+			return false
+		}
+	}
+	if len(c.classes) > 0 {
+		v, _ := el.Attr("class")
+		classes := strings.Fields(v)
+		for _, want := range c.classes {
+			if !contains(classes, want) {
+				return false
+			}
+		}
+	}
+	for _, a := range c.attrs {
+		if !a.matches(el) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (a attrSelector) matches(el *Element) bool {
+	v, ok := el.Attr(a.name)
+	if !ok {
+		return false
+	}
+	switch a.op {
+	case "=":
+		return v == a.value
+	case "~=":
+		return contains(strings.Fields(v), a.value)
+	case "|=":
+		return v == a.value || strings.HasPrefix(v, a.value+"-")
+	case "^=":
+		return a.value != "" && strings.HasPrefix(v, a.value)
+	case "$=":
+		return a.value != "" && strings.HasSuffix(v, a.value)
+	case "*=":
+		return a.value != "" && strings.Contains(v, a.value)
+	}
+	return true
+}
@@ -2,15 +2,21 @@ package proxy_image
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
-	_ "image/gif"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	. "github.com/acentior/go-httpproxy/pkg/proxy"
-	"github.com/acentior/go-httpproxy/pkg/proxy/regretable"
 )
 
 var RespIsImage = ContentTypeIs("image/gif",
@@ -21,59 +27,405 @@ var RespIsImage = ContentTypeIs("image/gif",
 
 // "image/tiff" tiff support is in external package, and rarely used, so we omitted it
 
+// Formats of the images handled.
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	FormatGif  = "gif"
+)
+
+// sniffedFormats are the formats of the content types found by http.DetectContentType.
+var sniffedFormats = map[string]string{
+	"image/jpeg": FormatJpeg,
+	"image/png":  FormatPng,
+	"image/gif":  FormatGif,
+}
+
+var contentTypes = map[string]string{
+	FormatJpeg: "image/jpeg",
+	FormatPng:  "image/png",
+	FormatGif:  "image/gif",
+}
+
+// Default limits of the images decoded, larger images going through unchanged.
+const (
+	DefaultMaxPixels = 40 << 20
+	DefaultMaxBytes  = 16 << 20
+)
+
+// Options control how images are decoded and encoded again.
+type Options struct {
+	// Format is the format of the resulting images, FormatJpeg, FormatPng or FormatGif.
+	// The default is the format of the original image.
+	Format string
+	// Quality is the quality of JPEG images, from 1 to 100. The default is
+	// jpeg.DefaultQuality.
+	Quality int
+	// MaxPixels is the largest number of pixels of an image, all the frames of an
+	// animated GIF counted, to protect from decompression bombs. The default is
+	// DefaultMaxPixels.
+	MaxPixels int64
+	// MaxBytes is the size of the largest image read. The default is DefaultMaxBytes.
+	MaxBytes int64
+}
+
+func (o *Options) maxPixels() int64 {
+	if o.MaxPixels > 0 {
+		return o.MaxPixels
+	}
+	return DefaultMaxPixels
+}
+
+func (o *Options) maxBytes() int64 {
+	if o.MaxBytes > 0 {
+		return o.MaxBytes
+	}
+	return DefaultMaxBytes
+}
+
+func (o *Options) quality() int {
+	if o.Quality > 0 {
+		return o.Quality
+	}
+	return jpeg.DefaultQuality
+}
+
+// HandleImage returns the RespHandler replacing the images of responses by the result
+// of f, keeping their format. The frames of animated GIFs are passed to f one by one.
 func HandleImage(f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler {
+	return HandleImageWith(Options{}, f)
+}
+
+// HandleImageWith is like HandleImage, with the format, quality and limits of opts.
+// The type of the images is sniffed from their content, whatever their Content-Type,
+// and the responses whose images cannot be handled are left unchanged.
+func HandleImageWith(opts Options, f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler {
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
-		if !RespIsImage.HandleResp(resp, ctx) {
+		src, ok := opts.read(resp, ctx)
+		if !ok {
 			return resp
 		}
-		if resp.StatusCode != 200 {
-			// we might get 304 - not modified response without data
+		b, format, err := opts.encode(src, f, ctx)
+		if err != nil {
+			ctx.Warnf("Cannot encode image, returning orig %v %v", requestLine(resp, ctx), err)
 			return resp
 		}
-		contentType := resp.Header.Get("Content-Type")
+		setBody(resp, b, format)
+		return resp
+	})
+}
+
+// source is an image read from a response.
+type source struct {
+	data   []byte
+	format string
+	// img is the decoded image, or anim the decoded GIF
+	img  image.Image
+	anim *gif.GIF
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
 
-		const kb = 1024
-		regret := regretable.NewRegretableReaderCloserSize(resp.Body, 16*kb)
-		resp.Body = regret
-		img, imgType, err := image.Decode(resp.Body)
+// read decodes the image of resp, if any and within the limits of o. The body of resp
+// is replaced by a body replaying what was read.
+func (o *Options) read(resp *http.Response, ctx *ProxyCtx) (*source, bool) {
+	if resp == nil || resp.Body == nil || !RespIsImage.HandleResp(resp, ctx) {
+		return nil, false
+	}
+	if resp.StatusCode != 200 || ctx.Req != nil && ctx.Req.Method == "HEAD" {
+		// we might get 304 - not modified response without data
+		return nil, false
+	}
+	maxBytes := o.maxBytes()
+	if resp.Header.Get("Content-Encoding") == "" && resp.ContentLength > maxBytes {
+		ctx.Logf("image of %d bytes left alone", resp.ContentLength)
+		return nil, false
+	}
+	if err := DecodeBody(resp, ctx); err != nil {
+		ctx.Warnf("Cannot decode image: %v", err)
+		return nil, false
+	}
+
+	body := resp.Body
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	head = head[:n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(head), body), body}
+		ctx.Warnf("Cannot read image: %v", err)
+		return nil, false
+	}
+	format, ok := sniffedFormats[http.DetectContentType(head)]
+	if !ok {
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(head), body), body}
+		return nil, false
+	}
+	rest, err := ioutil.ReadAll(io.LimitReader(body, maxBytes-int64(n)+1))
+	data := append(head, rest...)
+	if err != nil || int64(len(data)) > maxBytes {
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(data), body), body}
 		if err != nil {
-			regret.Regret()
-			ctx.Warnf("%s: %s", ctx.Req.Method+" "+ctx.Req.URL.String()+" Image from "+ctx.Req.RequestURI+"content type"+
-				contentType+"cannot be decoded returning original image", err)
-			return resp
+			ctx.Warnf("Cannot read image: %v", err)
+		} else {
+			ctx.Logf("image larger than %d bytes left alone", maxBytes)
+		}
+		return nil, false
+	}
+	body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		ctx.Warnf("%s: image cannot be decoded, returning original image: %v", requestLine(resp, ctx), err)
+		return nil, false
+	}
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if pixels > o.maxPixels() {
+		ctx.Logf("image of %dx%d pixels left alone", cfg.Width, cfg.Height)
+		return nil, false
+	}
+	src := &source{data: data, format: format}
+	if format == FormatGif {
+		// the frames are counted before being decoded, each of them taking up to the
+		// pixels of the whole image
+		var frames int64
+		frames, err = gifFrames(data)
+		if err == nil && pixels*frames > o.maxPixels() {
+			ctx.Logf("animated image of %d frames of %dx%d pixels left alone", frames, cfg.Width, cfg.Height)
+			return nil, false
 		}
-		result := f(img, ctx)
-		buf := bytes.NewBuffer([]byte{})
-		switch contentType {
-		// No gif image encoder in go - convert to png
-		case "image/gif", "image/png":
-			if err := png.Encode(buf, result); err != nil {
-				ctx.Warnf("Cannot encode image, returning orig %v %v", ctx.Req.URL.String(), err)
-				return resp
+		if err == nil {
+			src.anim, err = gif.DecodeAll(bytes.NewReader(data))
+		}
+	} else {
+		src.img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		ctx.Warnf("%s: image cannot be decoded, returning original image: %v", requestLine(resp, ctx), err)
+		return nil, false
+	}
+	return src, true
+}
+
+var errGifFormat = errors.New("gif: invalid format")
+
+// gifFrames returns the number of frames of the GIF data, reading its blocks without
+// decompressing them.
+func gifFrames(data []byte) (int64, error) {
+	// header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, errGifFormat
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	// skipBlocks skips the data sub-blocks at i
+	skipBlocks := func(i int) (int, error) {
+		for i < len(data) {
+			n := int(data[i])
+			i++
+			if n == 0 {
+				return i, nil
 			}
-			resp.Header.Set("Content-Type", "image/png")
-		case "image/jpeg", "image/pjpeg":
-			if err := jpeg.Encode(buf, result, nil); err != nil {
-				ctx.Warnf("Cannot encode image, returning orig %v %v", ctx.Req.URL.String(), err)
-				return resp
+			i += n
+		}
+		return 0, errGifFormat
+	}
+	var frames int64
+	var err error
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: label and sub-blocks
+			if i, err = skipBlocks(i + 2); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor, local color table, LZW code size and sub-blocks
+			if i+10 > len(data) {
+				return 0, errGifFormat
+			}
+			frames++
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
 			}
-		case "application/octet-stream":
-			switch imgType {
-			case "jpeg":
-				if err := jpeg.Encode(buf, result, nil); err != nil {
-					ctx.Warnf("Cannot encode image as jpeg, returning orig %v %v", ctx.Req.URL.String(), err)
-					return resp
-				}
-			case "png", "gif":
-				if err := png.Encode(buf, result); err != nil {
-					ctx.Warnf("Cannot encode image as png, returning orig %v %v", ctx.Req.URL.String(), err)
-					return resp
-				}
+			if i, err = skipBlocks(i + 1); err != nil {
+				return 0, err
 			}
+		case 0x3b: // trailer
+			return frames, nil
 		default:
-			panic("unhandlable type" + contentType)
+			return 0, errGifFormat
 		}
-		resp.Body = ioutil.NopCloser(buf)
-		return resp
+	}
+	// the decoder reports the missing trailer
+	return frames, nil
+}
+
+// requestLine returns the method and URL of the request of resp, for the logs.
+func requestLine(resp *http.Response, ctx *ProxyCtx) string {
+	req := resp.Request
+	if req == nil {
+		req = ctx.Req
+	}
+	if req == nil || req.URL == nil {
+		return "image"
+	}
+	return req.Method + " " + req.URL.String()
+}
+
+// encode encodes the image of src transformed by f, in the format of o.
+func (o *Options) encode(src *source, f func(img image.Image, ctx *ProxyCtx) image.Image, ctx *ProxyCtx) ([]byte, string, error) {
+	format := o.Format
+	if format == "" {
+		format = src.format
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FormatGif:
+		var anim *gif.GIF
+		if src.anim != nil {
+			anim = transformFrames(src.anim, f, ctx)
+		} else {
+			anim = &gif.GIF{Image: []*image.Paletted{paletted(f(src.img, ctx))}, Delay: []int{0}}
+		}
+		err = gif.EncodeAll(&buf, anim)
+	case FormatJpeg:
+		err = jpeg.Encode(&buf, f(src.first(), ctx), &jpeg.Options{Quality: o.quality()})
+	case FormatPng:
+		err = png.Encode(&buf, f(src.first(), ctx))
+	default:
+		err = fmt.Errorf("unknown image format %q", format)
+	}
+	return buf.Bytes(), format, err
+}
+
+// first returns the image of src, or the first frame of an animated GIF.
+func (src *source) first() image.Image {
+	if src.anim == nil {
+		return src.img
+	}
+	var first image.Image
+	eachFrame(src.anim, func(frame *image.RGBA) bool {
+		first = frame
+		return false
 	})
+	return first
+}
+
+func setBody(resp *http.Response, b []byte, format string) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	resp.Header.Set("Content-Type", contentTypes[format])
+}
+
+// eachFrame calls fn with the frames of anim as they are displayed, the frames being
+// drawn over the previous ones according to their disposal, until fn returns false.
+func eachFrame(anim *gif.GIF, fn func(frame *image.RGBA) bool) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	for i, p := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = clone(canvas)
+		}
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		if !fn(clone(canvas)) {
+			return
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+func clone(img *image.RGBA) *image.RGBA {
+	c := *img
+	c.Pix = append([]byte(nil), img.Pix...)
+	return &c
+}
+
+// transformFrames returns the animation of the frames of anim transformed by f. The
+// frames are whole, each one replacing the previous one.
+func transformFrames(anim *gif.GIF, f func(img image.Image, ctx *ProxyCtx) image.Image, ctx *ProxyCtx) *gif.GIF {
+	out := &gif.GIF{LoopCount: anim.LoopCount}
+	var bounds image.Rectangle
+	i := 0
+	eachFrame(anim, func(frame *image.RGBA) bool {
+		p := paletted(f(frame, ctx))
+		bounds = bounds.Union(p.Bounds())
+		out.Image = append(out.Image, p)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		delay := 0
+		if i < len(anim.Delay) {
+			delay = anim.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+		i++
+		return true
+	})
+	out.Config = image.Config{Width: bounds.Max.X, Height: bounds.Max.Y}
+	return out
+}
+
+// gifPalette is the palette of the GIF frames, with the web safe colors, grays and a
+// transparent color.
+var gifPalette = func() color.Palette {
+	p := append(color.Palette{color.Transparent}, palette.WebSafe...)
+	for i := 1; len(p) < 256; i++ {
+		p = append(p, color.Gray{uint8(i * 255 / 40)})
+	}
+	return p
+}()
+
+// paletted returns img as a paletted image. Images of at most 256 colors keep their
+// colors, others are dithered with gifPalette.
+func paletted(img image.Image) *image.Paletted {
+	if p, ok := img.(*image.Paletted); ok && len(p.Palette) <= 256 {
+		return p
+	}
+	b := img.Bounds()
+	if pal, ok := exactPalette(img); ok {
+		p := image.NewPaletted(b, pal)
+		draw.Draw(p, b, img, b.Min, draw.Src)
+		return p
+	}
+	p := image.NewPaletted(b, gifPalette)
+	draw.FloydSteinberg.Draw(p, b, img, b.Min)
+	return p
+}
+
+// exactPalette returns the colors of img, if there are at most 256 of them.
+func exactPalette(img image.Image) (color.Palette, bool) {
+	b := img.Bounds()
+	seen := map[color.RGBA64]bool{}
+	var pal color.Palette
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64)
+			if seen[c] {
+				continue
+			}
+			if len(pal) == 256 {
+				return nil, false
+			}
+			seen[c] = true
+			pal = append(pal, c)
+		}
+	}
+	return pal, true
 }
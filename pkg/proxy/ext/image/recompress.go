@@ -0,0 +1,145 @@
+package proxy_image
+
+import (
+	"image"
+	"image/draw"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/bandwidth"
+)
+
+// DefaultRecompressQuality is the quality of the JPEG images encoded again by a
+// Recompressor without Quality.
+const DefaultRecompressQuality = 60
+
+// OriginalLengthHeader is the header of the recompressed responses holding the size of
+// the original image.
+const OriginalLengthHeader = "X-Original-Content-Length"
+
+// Recompressor saves bandwidth by downscaling the images larger than MaxDimension and
+// by encoding the JPEG images again at a lower quality. The result is only kept when
+// it is smaller than the original image, the bytes saved being reported to the
+// bandwidth statistics of the proxy user. Responses with Cache-Control: no-transform,
+// or requested with it, are left unchanged.
+type Recompressor struct {
+	// Options are the limits of the images handled, and the format and the quality of
+	// the recompressed images, the quality defaulting to DefaultRecompressQuality.
+	Options
+	// MaxDimension is the largest width or height of the images, larger images being
+	// downscaled keeping their aspect ratio. Images are not downscaled when zero.
+	MaxDimension int
+}
+
+// Handle recompresses the image of resp. It is a RespHandler function.
+func (r *Recompressor) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil || noTransform(resp.Header) || ctx.Req != nil && noTransform(ctx.Req.Header) {
+		return resp
+	}
+	opts := r.Options
+	if opts.Quality == 0 {
+		opts.Quality = DefaultRecompressQuality
+	}
+	src, ok := opts.read(resp, ctx)
+	if !ok {
+		return resp
+	}
+	size := src.size()
+	large := r.MaxDimension > 0 && (size.X > r.MaxDimension || size.Y > r.MaxDimension)
+	// other formats are lossless, and worth encoding again only when downscaled
+	if !large && src.format != FormatJpeg && (opts.Format == "" || opts.Format == src.format) {
+		return resp
+	}
+	b, format, err := opts.encode(src, func(img image.Image, ctx *ProxyCtx) image.Image {
+		if large {
+			return downscale(img, r.MaxDimension)
+		}
+		return img
+	}, ctx)
+	if err != nil {
+		ctx.Warnf("Cannot recompress image, returning orig %v %v", requestLine(resp, ctx), err)
+		return resp
+	}
+	if len(b) >= len(src.data) {
+		ctx.Logf("recompressed image of %d bytes not smaller than %d bytes, returning orig", len(b), len(src.data))
+		return resp
+	}
+	setBody(resp, b, format)
+	resp.Header.Set(OriginalLengthHeader, strconv.Itoa(len(src.data)))
+	bandwidth.AddSaved(ctx.User, len(src.data)-len(b))
+	ctx.Logf("image recompressed from %d to %d bytes", len(src.data), len(b))
+	return resp
+}
+
+// Register adds r to the response handlers of proxy.
+func (r *Recompressor) Register(proxy *ProxyHttpServer) {
+	proxy.OnResponse().Do(FuncRespHandler(r.Handle))
+}
+
+func noTransform(h http.Header) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// size returns the width and the height of the image of src.
+func (src *source) size() image.Point {
+	if src.anim != nil {
+		return image.Pt(src.anim.Config.Width, src.anim.Config.Height)
+	}
+	return src.img.Bounds().Size()
+}
+
+// downscale returns img scaled down to fit in max by max pixels, keeping its aspect
+// ratio. Each pixel is the average of the pixels of img it covers.
+func downscale(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+	dw, dh := max, max
+	if w > h {
+		dh = h * max / w
+	} else {
+		dw = w * max / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			d := dst.PixOffset(x, y)
+			for i := range sum {
+				dst.Pix[d+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
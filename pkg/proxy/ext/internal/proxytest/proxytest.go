@@ -0,0 +1,47 @@
+// Package proxytest holds the helpers shared by the tests of the extensions.
+package proxytest
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// Client returns a client going through a server of proxy, closed at the end of the test.
+// It trusts the certificates of the MITM'd servers, and opens a connection per request.
+func Client(t testing.TB, proxy *goproxy.ProxyHttpServer) *http.Client {
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(u),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+}
+
+// Do sends a request with the given body and header name-value pairs through client,
+// and returns the response with its body read and closed. The response is nil when the
+// request fails.
+func Do(client *http.Client, method, u, body string, header ...string) (*http.Response, string, error) {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp, string(b), err
+}
@@ -0,0 +1,237 @@
+// Package proxy_json inspects and transforms the JSON bodies of requests and responses.
+package proxy_json
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// DefaultMaxSize is the size of the largest body parsed by conditions and by a new
+// Transformer. Larger bodies go through unchanged.
+const DefaultMaxSize = 1 << 20
+
+// IsJsonType reports whether the media type of contentType is JSON: application/json,
+// text/json or a +json type.
+func IsJsonType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || mt == "text/json" || strings.HasSuffix(mt, "+json")
+}
+
+// Condition tests the JSON body of requests, or of responses when used with
+// OnResponse. Bodies that are not JSON never match.
+type Condition func(v interface{}) bool
+
+func (c Condition) HandleReq(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	v, ok := requestValue(req, ctx, DefaultMaxSize)
+	return ok && c(v)
+}
+
+func (c Condition) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	v, ok := responseValue(resp, ctx, DefaultMaxSize)
+	return ok && c(v)
+}
+
+// IsJson matches requests, or responses, with a JSON Content-Type.
+var IsJson goproxy.ReqCondition = contentTypeCondition{}
+
+type contentTypeCondition struct{}
+
+func (contentTypeCondition) HandleReq(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	return req != nil && IsJsonType(req.Header.Get("Content-Type"))
+}
+
+func (contentTypeCondition) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return resp != nil && IsJsonType(resp.Header.Get("Content-Type"))
+}
+
+// PathExists matches JSON bodies with a value at path. Paths starting with a slash
+// are JSON Pointers, RFC 6901, others are dot separated, as "items.0.id".
+func PathExists(path string) Condition {
+	tokens := splitPath(path)
+	return func(v interface{}) bool {
+		_, err := get(v, tokens)
+		return err == nil
+	}
+}
+
+// PathEquals matches JSON bodies whose value at path equals value, once encoded in
+// JSON. Numbers are compared by value.
+func PathEquals(path string, value interface{}) Condition {
+	tokens := splitPath(path)
+	value = normalize(value)
+	return func(v interface{}) bool {
+		got, err := get(v, tokens)
+		return err == nil && equal(got, value)
+	}
+}
+
+// parsed caches the value of a body parsed by a condition, so that the next
+// conditions and handlers do not parse it again, as long as the body is the same.
+type parsed struct {
+	body  io.ReadCloser
+	size  int64
+	value interface{}
+}
+
+func cached(ctx *goproxy.ProxyCtx, key interface{}, body io.ReadCloser, max int64) (v interface{}, ok, found bool) {
+	p, found := ctx.Value(key).(*parsed)
+	if !found || p.body != body {
+		return nil, false, false
+	}
+	return p.value, p.size <= max, true
+}
+
+type requestKey struct{}
+type responseKey struct{}
+
+func requestValue(req *http.Request, ctx *goproxy.ProxyCtx, max int64) (interface{}, bool) {
+	if req == nil || req.Body == nil || req.Body == http.NoBody ||
+		!IsJsonType(req.Header.Get("Content-Type")) || req.Header.Get("Content-Encoding") != "" {
+		return nil, false
+	}
+	if v, ok, found := cached(ctx, requestKey{}, req.Body, max); found {
+		return v, ok
+	}
+	body, size, v, ok := parseBody(req.Body, max, ctx)
+	req.Body = body
+	if ok {
+		ctx.SetValue(requestKey{}, &parsed{body, size, v})
+	}
+	return v, ok
+}
+
+func responseValue(resp *http.Response, ctx *goproxy.ProxyCtx, max int64) (interface{}, bool) {
+	if resp == nil || resp.Body == nil || !IsJsonType(resp.Header.Get("Content-Type")) {
+		return nil, false
+	}
+	if v, ok, found := cached(ctx, responseKey{}, resp.Body, max); found {
+		return v, ok
+	}
+	if err := goproxy.DecodeBody(resp, ctx); err != nil {
+		ctx.Warnf("Cannot decode response: %v", err)
+		return nil, false
+	}
+	body, size, v, ok := parseBody(resp.Body, max, ctx)
+	resp.Body = body
+	if ok {
+		ctx.SetValue(responseKey{}, &parsed{body, size, v})
+	}
+	return v, ok
+}
+
+// parseBody parses the JSON body, unless it is larger than max bytes, and returns a
+// body replaying it.
+func parseBody(body io.ReadCloser, max int64, ctx *goproxy.ProxyCtx) (io.ReadCloser, int64, interface{}, bool) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	replay := &readCloser{io.MultiReader(bytes.NewReader(b), body), body}
+	if err != nil {
+		ctx.Warnf("Cannot read json body: %v", err)
+		return replay, 0, nil, false
+	}
+	if int64(len(b)) > max {
+		ctx.Logf("json body larger than %d bytes left alone", max)
+		return replay, 0, nil, false
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		ctx.Warnf("Cannot parse json body: %v", err)
+		return replay, 0, nil, false
+	}
+	return replay, int64(len(b)), v, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Func transforms the JSON value of a body. The value is made of the types decoded
+// by encoding/json, with numbers as json.Number, and can be modified in place.
+type Func func(v interface{}, ctx *goproxy.ProxyCtx) (interface{}, error)
+
+// Transformer rewrites JSON bodies with a list of Func. The body is left unchanged when
+// it is not JSON, larger than MaxSize, or when a Func returns an error.
+type Transformer struct {
+	MaxSize int64
+	funcs   []Func
+}
+
+// New returns a Transformer applying funcs in order.
+func New(funcs ...Func) *Transformer {
+	return &Transformer{MaxSize: DefaultMaxSize, funcs: funcs}
+}
+
+func (t *Transformer) transform(v interface{}, ctx *goproxy.ProxyCtx) ([]byte, bool) {
+	var err error
+	for _, f := range t.funcs {
+		if v, err = f(v, ctx); err != nil {
+			ctx.Warnf("Cannot transform json body: %v", err)
+			return nil, false
+		}
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		ctx.Warnf("Cannot encode json body: %v", err)
+		return nil, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+}
+
+// Request returns the handler transforming request bodies.
+func (t *Transformer) Request() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		v, ok := requestValue(req, ctx, t.MaxSize)
+		if !ok {
+			return req, nil
+		}
+		// the funcs may modify v even if they fail
+		ctx.SetValue(requestKey{}, nil)
+		b, ok := t.transform(v, ctx)
+		if !ok {
+			return req, nil
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+		req.ContentLength = int64(len(b))
+		req.TransferEncoding = nil
+		req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		return req, nil
+	})
+}
+
+// Response returns the handler transforming response bodies.
+func (t *Transformer) Response() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		v, ok := responseValue(resp, ctx, t.MaxSize)
+		if !ok {
+			return resp
+		}
+		ctx.SetValue(responseKey{}, nil)
+		b, ok := t.transform(v, ctx)
+		if !ok {
+			return resp
+		}
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		resp.ContentLength = int64(len(b))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		return resp
+	})
+}
@@ -0,0 +1,162 @@
+package proxy_json_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	proxy_json "github.com/acentior/go-httpproxy/pkg/proxy/ext/json"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func encode(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPatch(t *testing.T) {
+	// examples of RFC 6902 appendix A
+	for _, c := range []struct{ doc, patch, result string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"copy","from":"/~01","path":"/a~1b"}]`, `{"/":9,"a/b":10,"~1":10}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	} {
+		p, err := proxy_json.DecodePatch([]byte(c.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Apply(decode(t, c.doc))
+		if err != nil {
+			t.Errorf("%s %s: %v", c.doc, c.patch, err)
+		} else if encode(t, got) != c.result {
+			t.Errorf("%s %s: expected %s, got %s", c.doc, c.patch, c.result, encode(t, got))
+		}
+	}
+
+	for _, c := range []struct{ doc, patch string }{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/foo"},{"op":"remove","path":"/missing"}]`},
+	} {
+		p, err := proxy_json.DecodePatch([]byte(c.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := decode(t, c.doc)
+		if _, err := p.Apply(doc); err == nil {
+			t.Errorf("%s %s: expected an error", c.doc, c.patch)
+		}
+		if encode(t, doc) != encode(t, decode(t, c.doc)) {
+			t.Errorf("%s %s: failed patch changed the document", c.doc, c.patch)
+		}
+	}
+}
+
+func TestSetDelete(t *testing.T) {
+	v := decode(t, `{"a":{"list":[1,2]},"b":true}`)
+	var err error
+	for _, f := range []proxy_json.Func{
+		proxy_json.Set("a.list.0", "one"),
+		proxy_json.Set("a.list.-", 3),
+		proxy_json.Set("c.d", map[string]int{"e": 1}),
+		proxy_json.Delete("b"),
+		proxy_json.Delete("missing.path"),
+		proxy_json.Set("/a/x~1y", nil),
+	} {
+		if v, err = f(v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, expected := encode(t, v), `{"a":{"list":["one",2,3],"x/y":null},"c":{"d":{"e":1}}}`; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if _, err := proxy_json.Set("b.c", 1)(decode(t, `{"b":true}`), nil); err == nil {
+		t.Error("setting a member of a boolean should fail")
+	}
+}
+
+func TestTransformer(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != int64(len(b)) {
+			t.Errorf("request Content-Length %d for %d bytes", r.ContentLength, len(b))
+		}
+		w.Header().Set("Content-Type", "application/vnd.api+json; charset=utf-8")
+		w.Write([]byte(`{"request":` + string(b) + `,"secret":"s3cr3t","big":"` + r.URL.Query().Get("pad") + `"}`))
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(proxy_json.PathEquals("user.role", "guest")).Do(proxy_json.New(proxy_json.Set("user.checked", true)).Request())
+	patch, _ := proxy_json.DecodePatch([]byte(`[{"op":"remove","path":"/secret"}]`))
+	resp := proxy_json.New(patch.Func())
+	resp.MaxSize = 200
+	proxy.OnResponse(proxy_json.IsJson, proxy_json.PathExists("/secret")).Do(resp.Response())
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	post := func(body, pad string) (*http.Response, string) {
+		resp, err := client.Post(upstream.URL+"/?pad="+pad, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	r, b := post(`{"user":{"role":"guest"}}`, "")
+	if expected := `{"big":"","request":{"user":{"checked":true,"role":"guest"}}}`; b != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+	if r.Header.Get("Content-Length") != strconv.Itoa(len(b)) {
+		t.Errorf("Content-Length %q for %d bytes", r.Header.Get("Content-Length"), len(b))
+	}
+	if _, b := post(`{"user":{"role":"admin"}}`, ""); b != `{"big":"","request":{"user":{"role":"admin"}}}` {
+		t.Error("request transformed without matching condition", b)
+	}
+	pad := strings.Repeat("x", 200)
+	if _, b := post(`{}`, pad); !strings.Contains(b, "s3cr3t") {
+		t.Error("body larger than MaxSize transformed", b)
+	}
+	if _, b := post(`not json`, ""); !strings.HasPrefix(b, `{"request":not json`) {
+		t.Error("invalid json changed", b)
+	}
+}
@@ -0,0 +1,378 @@
+package proxy_json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// Paths are JSON Pointers, RFC 6901, when they start with a slash, as "/items/0/id".
+// Otherwise they are dot separated, as "items.0.id", with the same meaning. The empty
+// path is the whole document.
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return strings.Split(path, ".")
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens
+}
+
+func splitPointer(path string) ([]string, error) {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", path)
+	}
+	return splitPath(path), nil
+}
+
+// index parses an array index, "-" being the end of the array when end is true.
+func index(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || token != strconv.Itoa(i) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := length - 1
+	if end {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("cannot get %q of a %T", t, doc)
+		}
+	}
+	return doc, nil
+}
+
+// modify calls f on the object or array holding the last token, and returns the
+// document with the container returned by f. Missing objects on the way are created
+// if create is true.
+func modify(doc interface{}, tokens []string, create bool, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return f(doc, tokens[0])
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tokens[0]]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("member %q not found", tokens[0])
+			}
+			child = map[string]interface{}{}
+		}
+		child, err := modify(child, tokens[1:], create, f)
+		if err != nil {
+			return nil, err
+		}
+		c[tokens[0]] = child
+		return c, nil
+	case []interface{}:
+		i, err := index(tokens[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := modify(c[i], tokens[1:], create, f)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = child
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot get %q of a %T", tokens[0], doc)
+}
+
+func add(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modify(doc, tokens, false, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[t] = value
+			return c, nil
+		case []interface{}:
+			i, err := index(t, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a %T", t, container)
+	})
+}
+
+func remove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return modify(doc, tokens, false, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[t]; !ok {
+				return nil, fmt.Errorf("member %q not found", t)
+			}
+			delete(c, t)
+			return c, nil
+		case []interface{}:
+			i, err := index(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a %T", t, container)
+	})
+}
+
+func replace(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if _, err := get(doc, tokens); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return modify(doc, tokens, false, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[t] = value
+			return c, nil
+		case []interface{}:
+			i, _ := index(t, len(c), false)
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot replace %q of a %T", t, container)
+	})
+}
+
+// Operation is a JSON Patch operation, RFC 6902.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Patch is a JSON Patch document, RFC 6902.
+type Patch []Operation
+
+// DecodePatch parses a JSON Patch document.
+func DecodePatch(b []byte) (Patch, error) {
+	var p Patch
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Apply returns doc patched. Patches are atomic: when an operation fails, doc is left
+// unchanged and the error is returned.
+func (p Patch) Apply(doc interface{}) (interface{}, error) {
+	doc = deepCopy(doc)
+	for _, op := range p {
+		tokens, err := splitPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			doc, err = add(doc, tokens, normalize(op.Value))
+		case "remove":
+			doc, err = remove(doc, tokens)
+		case "replace":
+			doc, err = replace(doc, tokens, normalize(op.Value))
+		case "move", "copy":
+			var from []string
+			if from, err = splitPointer(op.From); err != nil {
+				break
+			}
+			if op.Op == "move" && (op.From == op.Path || strings.HasPrefix(op.Path, op.From+"/")) {
+				if op.From != op.Path {
+					err = fmt.Errorf("cannot move %q into itself", op.From)
+				}
+				break
+			}
+			var v interface{}
+			if v, err = get(doc, from); err != nil {
+				break
+			}
+			if op.Op == "move" {
+				doc, err = remove(doc, from)
+			} else {
+				v = deepCopy(v)
+			}
+			if err == nil {
+				doc, err = add(doc, tokens, v)
+			}
+		case "test":
+			var v interface{}
+			if v, err = get(doc, tokens); err == nil && !equal(v, normalize(op.Value)) {
+				err = fmt.Errorf("test of %q failed", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// Func returns p as a Func for New.
+func (p Patch) Func() Func {
+	return func(v interface{}, ctx *goproxy.ProxyCtx) (interface{}, error) {
+		return p.Apply(v)
+	}
+}
+
+// Set returns a Func setting the value at path, creating the missing objects on the
+// way. The "-" index appends to arrays.
+func Set(path string, value interface{}) Func {
+	tokens := splitPath(path)
+	value = normalize(value)
+	return func(doc interface{}, ctx *goproxy.ProxyCtx) (interface{}, error) {
+		if len(tokens) == 0 {
+			return deepCopy(value), nil
+		}
+		return modify(doc, tokens, true, func(container interface{}, t string) (interface{}, error) {
+			switch c := container.(type) {
+			case map[string]interface{}:
+				c[t] = deepCopy(value)
+				return c, nil
+			case []interface{}:
+				i, err := index(t, len(c), true)
+				if err != nil {
+					return nil, err
+				}
+				if i == len(c) {
+					return append(c, deepCopy(value)), nil
+				}
+				c[i] = deepCopy(value)
+				return c, nil
+			}
+			return nil, fmt.Errorf("cannot set %q of a %T", t, container)
+		})
+	}
+}
+
+// Delete returns a Func deleting the value at path, if any.
+func Delete(path string) Func {
+	tokens := splitPath(path)
+	return func(doc interface{}, ctx *goproxy.ProxyCtx) (interface{}, error) {
+		if _, err := get(doc, tokens); err != nil {
+			return doc, nil
+		}
+		return remove(doc, tokens)
+	}
+}
+
+// normalize converts a Go value to the types produced by decoding JSON with numbers
+// kept as json.Number.
+func normalize(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var n interface{}
+	if d.Decode(&n) != nil {
+		return v
+	}
+	return n
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(c))
+		for i, v := range c {
+			a[i] = deepCopy(v)
+		}
+		return a
+	}
+	return v
+}
+
+// equal compares decoded JSON values, numbers by value.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		x, err1 := a.Float64()
+		y, err2 := b.Float64()
+		return err1 == nil && err2 == nil && x == y
+	}
+	return a == b
+}
@@ -0,0 +1,295 @@
+// Package replay answers the requests going through the proxy with responses recorded
+// in HAR files, instead of sending them upstream. As a ReqHandler it works on plain HTTP
+// requests as well as on MITM'd HTTPS ones.
+//
+//	r, err := replay.Open("testdata/recordings")
+//	r.Register(proxy)
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/har"
+)
+
+// Matcher selects the parts of a request that must be equal for a recorded response
+// to be replayed.
+type Matcher struct {
+	Method bool
+	// URL compares the scheme, host and path, ignoring default ports
+	URL bool
+	// Query compares the query parameters regardless of their order
+	Query bool
+	// Headers are the names of the headers to compare
+	Headers []string
+	// Body compares the SHA-256 of the request bodies. Recordings must keep whole
+	// bodies, see har.Recorder.MaxBodySize
+	Body bool
+}
+
+// DefaultMatcher compares the method, the URL and the query.
+var DefaultMatcher = Matcher{Method: true, URL: true, Query: true}
+
+// Key returns the string identifying the requests that m considers equal.
+func (m Matcher) Key(method string, u *url.URL, header http.Header, body []byte) string {
+	var parts []string
+	if m.Method {
+		parts = append(parts, method)
+	}
+	if m.URL {
+		parts = append(parts, u.Scheme+"://"+normalizeHost(u.Scheme, u.Host)+u.EscapedPath())
+	}
+	if m.Query {
+		parts = append(parts, normalizeQuery(u.RawQuery))
+	}
+	for _, name := range m.Headers {
+		parts = append(parts, http.CanonicalHeaderKey(name)+": "+strings.Join(header.Values(name), ","))
+	}
+	if m.Body {
+		sum := sha256.Sum256(body)
+		parts = append(parts, hex.EncodeToString(sum[:]))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func normalizeHost(scheme, host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err == nil && (scheme == "http" && port == "80" || scheme == "https" && port == "443") {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// normalizeQuery sorts the parameters by name then value.
+func normalizeQuery(raw string) string {
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	for _, vs := range q {
+		sort.Strings(vs)
+	}
+	return q.Encode()
+}
+
+// Mode is what a Replayer does with the requests that match no recording.
+type Mode int
+
+const (
+	// Fail answers unmatched requests with a 502 Bad Gateway
+	Fail Mode = iota
+	// PassThrough sends unmatched requests upstream, recording them if the Replayer
+	// has a Recorder
+	PassThrough
+)
+
+// Replayer is a ReqHandler replaying recorded responses. When several recordings match a
+// request, they are replayed in the order they were recorded, the last one repeating.
+type Replayer struct {
+	// Matcher must not be changed once the Replayer handles requests
+	Matcher   Matcher
+	Unmatched Mode
+	// Recorder records the requests passed through, when Unmatched is PassThrough
+	Recorder *har.Recorder
+
+	mu      sync.Mutex
+	entries []*har.Entry
+	// index maps the Matcher keys to their entries, built on first use
+	index    map[string][]*har.Entry
+	replayed map[string]int
+}
+
+// New returns a Replayer serving the responses of the given entries, matched with DefaultMatcher.
+func New(entries []har.Entry) *Replayer {
+	r := &Replayer{Matcher: DefaultMatcher}
+	r.Add(entries...)
+	return r
+}
+
+// Open returns a Replayer serving the responses recorded in the HAR file at path. If path
+// is a directory, all the .har files it holds, rotated ones included, are loaded.
+func Open(path string) (*Replayer, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.har")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	var entries []har.Entry
+	for _, f := range files {
+		h, err := har.Load(f)
+		if err != nil {
+			return nil, fmt.Errorf("replay: %s: %v", f, err)
+		}
+		entries = append(entries, h.Log.Entries...)
+	}
+	return New(entries), nil
+}
+
+// Add makes the responses of entries available for replay. Entries without a response,
+// such as failed requests, are skipped.
+func (r *Replayer) Add(entries ...har.Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range entries {
+		if entries[i].Response.Status != 0 {
+			r.entries = append(r.entries, &entries[i])
+		}
+	}
+	r.index = nil
+}
+
+func (r *Replayer) buildIndex() {
+	r.index = make(map[string][]*har.Entry)
+	r.replayed = make(map[string]int)
+	for _, e := range r.entries {
+		if key, err := r.entryKey(e); err == nil {
+			r.index[key] = append(r.index[key], e)
+		}
+	}
+}
+
+func (r *Replayer) entryKey(e *har.Entry) (string, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return "", err
+	}
+	header := make(http.Header)
+	for _, h := range e.Request.Headers {
+		header.Add(h.Name, h.Value)
+	}
+	var body []byte
+	if e.Request.PostData != nil {
+		if body, err = e.Request.PostData.Body(); err != nil {
+			return "", err
+		}
+	}
+	return r.Matcher.Key(e.Request.Method, u, header, body), nil
+}
+
+// Register replays the responses of the requests matching all of conds. With PassThrough,
+// the requests without recording are recorded by the Recorder, if any.
+func (r *Replayer) Register(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).Do(r)
+	if r.Recorder != nil && r.Unmatched == PassThrough {
+		// replayed requests never reach the recorder, their response short-circuits the handlers
+		r.Recorder.Register(proxy, conds...)
+	}
+}
+
+// Handle implements goproxy.ReqHandler.
+func (r *Replayer) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	var body []byte
+	if r.Matcher.Body && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			ctx.Warnf("replay: cannot read request body: %v", err)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, err.Error())
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key := r.Matcher.Key(req.Method, req.URL, req.Header, body)
+	e := r.next(key)
+	if e == nil {
+		if r.Unmatched == PassThrough {
+			ctx.Logf("replay: no recording for %v %v, passing through", req.Method, req.URL)
+			return req, nil
+		}
+		ctx.Warnf("replay: no recording for %v %v", req.Method, req.URL)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway,
+			"replay: no recorded response for "+req.Method+" "+req.URL.String())
+	}
+	resp, err := response(req, e)
+	if err != nil {
+		ctx.Warnf("replay: invalid recording for %v %v: %v", req.Method, req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+	ctx.Logf("replay: replaying %v %v", req.Method, req.URL)
+	return req, resp
+}
+
+func (r *Replayer) next(key string) *har.Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		r.buildIndex()
+	}
+	entries := r.index[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	i := r.replayed[key]
+	if i < len(entries)-1 {
+		r.replayed[key] = i + 1
+	}
+	return entries[i]
+}
+
+// response builds the response recorded in e. Truncated bodies are not replayed, a part
+// of the body is not the response, see har.Recorder.MaxBodySize.
+func response(req *http.Request, e *har.Entry) (*http.Response, error) {
+	if e.Response.Content.Truncated {
+		return nil, fmt.Errorf("replay: recorded body of %d bytes truncated", e.Response.Content.Size)
+	}
+	body, err := e.Response.Content.Body()
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.Response.Status) + " " + e.Response.StatusText,
+		StatusCode:    e.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req,
+	}
+	for _, h := range e.Response.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Content-Length", "Transfer-Encoding", "Connection":
+			// framing headers of the recorded connection
+		case "Content-Encoding":
+			// the recorder keeps the bodies it cannot decode as received, with their
+			// header, and the others decoded
+			if !decoded(h.Value) {
+				resp.Header.Add(h.Name, h.Value)
+			}
+		default:
+			resp.Header.Add(h.Name, h.Value)
+		}
+	}
+	return resp, nil
+}
+
+// decoded reports whether the recorder decodes the bodies of the Content-Encoding value.
+func decoded(value string) bool {
+	for _, c := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(c)) {
+		case "gzip", "x-gzip", "deflate", "br", "identity", "":
+		default:
+			return false
+		}
+	}
+	return true
+}
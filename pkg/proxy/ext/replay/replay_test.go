@@ -0,0 +1,175 @@
+package replay_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/har"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/internal/proxytest"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/replay"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	var hits int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Hit", string(rune('0'+n)))
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+	})
+	plain := httptest.NewServer(handler)
+	secure := httptest.NewTLSServer(handler)
+	plainURL, secureURL := plain.URL, secure.URL
+
+	dir := t.TempDir()
+	file := har.NewFile(filepath.Join(dir, "api.har"), 0)
+	recording := goproxy.NewProxyHttpServer()
+	recording.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	har.NewRecorder(file).Register(recording)
+	client := proxytest.Client(t, recording)
+	for _, c := range []struct{ method, url, body string }{
+		{"GET", plainURL + "/items?a=1&b=2", ""},
+		{"POST", plainURL + "/items", `{"name":"x"}`},
+		{"POST", plainURL + "/items", `{"name":"y"}`},
+		{"GET", secureURL + "/secure", ""},
+	} {
+		if _, _, err := proxytest.Do(client, c.method, c.url, c.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+	plain.Close()
+	secure.Close()
+
+	r, err := replay.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Matcher.Body = true
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	r.Register(proxy)
+	client = proxytest.Client(t, proxy)
+
+	for _, c := range []struct{ method, url, body, expected string }{
+		{"GET", plainURL + "/items?b=2&a=1", "", "GET /items?a=1&b=2 "},
+		{"POST", plainURL + "/items", `{"name":"y"}`, `POST /items {"name":"y"}`},
+		{"POST", plainURL + "/items", `{"name":"x"}`, `POST /items {"name":"x"}`},
+		{"GET", secureURL + "/secure", "", "GET /secure "},
+	} {
+		resp, body, err := proxytest.Do(client, c.method, c.url, c.body)
+		if err != nil || resp.StatusCode != http.StatusOK || body != c.expected {
+			t.Errorf("%s %s: expected %q, got %q %v", c.method, c.url, c.expected, body, err)
+		}
+	}
+	if resp, _, err := proxytest.Do(client, "GET", plainURL+"/unknown", ""); err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Error("unmatched request should fail, got", resp, err)
+	}
+}
+
+func TestReplayOrderAndPassThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "live")
+	}))
+	defer upstream.Close()
+
+	entry := func(body string) har.Entry {
+		return har.Entry{
+			Request:  har.Request{Method: "GET", URL: upstream.URL + "/poll"},
+			Response: har.Response{Status: 200, StatusText: "OK", Content: har.Content{Text: body}},
+		}
+	}
+	r := replay.New([]har.Entry{entry("first"), entry("second")})
+	r.Unmatched = replay.PassThrough
+	path := filepath.Join(t.TempDir(), "new.har")
+	file := har.NewFile(path, 0)
+	r.Recorder = har.NewRecorder(file)
+	proxy := goproxy.NewProxyHttpServer()
+	r.Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	for _, expected := range []string{"first", "second", "second"} {
+		if _, body, err := proxytest.Do(client, "GET", upstream.URL+"/poll", ""); body != expected {
+			t.Errorf("expected %q, got %q %v", expected, body, err)
+		}
+	}
+	if _, body, err := proxytest.Do(client, "GET", upstream.URL+"/other", ""); body != "live" {
+		t.Error("unmatched request not passed through", body, err)
+	}
+	file.Close()
+	h, err := har.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Log.Entries) != 1 || !strings.HasSuffix(h.Log.Entries[0].Request.URL, "/other") {
+		t.Errorf("only the passed through request should be recorded: %+v", h.Log.Entries)
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	r := replay.New([]har.Entry{{
+		Request:  har.Request{Method: "GET", URL: "http://example.com/large"},
+		Response: har.Response{Status: 200, StatusText: "OK", Content: har.Content{Size: 10, Text: "01234", Truncated: true}},
+	}})
+	proxy := goproxy.NewProxyHttpServer()
+	r.Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	if resp, body, err := proxytest.Do(client, "GET", "http://example.com/large", ""); err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("truncated recording should fail, got %q %v", body, err)
+	}
+}
+
+func TestReplayContentEncoding(t *testing.T) {
+	entry := func(path, coding string) har.Entry {
+		return har.Entry{
+			Request: har.Request{Method: "GET", URL: "http://example.com" + path},
+			Response: har.Response{Status: 200, StatusText: "OK", Headers: []har.NameValue{{Name: "Content-Encoding", Value: coding}},
+				Content: har.Content{Text: "body"}},
+		}
+	}
+	r := replay.New([]har.Entry{entry("/decoded", "gzip"), entry("/received", "zstd")})
+	proxy := goproxy.NewProxyHttpServer()
+	r.Register(proxy)
+	client := proxytest.Client(t, proxy)
+
+	// the recorder decodes gzip bodies, they are replayed without their coding
+	if _, body, err := proxytest.Do(client, "GET", "http://example.com/decoded", ""); err != nil || body != "body" {
+		t.Errorf("decoded body replayed as %q %v", body, err)
+	}
+	resp, _, err := proxytest.Do(client, "GET", "http://example.com/received", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coding := resp.Header.Get("Content-Encoding"); coding != "zstd" {
+		t.Errorf("body recorded as received replayed with Content-Encoding %q, want zstd", coding)
+	}
+}
+
+func TestMatcherKey(t *testing.T) {
+	parse := func(s string) *url.URL {
+		u, _ := url.Parse(s)
+		return u
+	}
+	m := replay.Matcher{Method: true, URL: true, Query: true, Headers: []string{"x-api-version"}}
+	h1 := http.Header{"X-Api-Version": {"2"}, "User-Agent": {"a"}}
+	h2 := http.Header{"X-Api-Version": {"2"}, "User-Agent": {"b"}}
+	if m.Key("GET", parse("https://Example.com:443/p?b=2&a=1&a=0"), h1, nil) !=
+		m.Key("GET", parse("https://example.com/p?a=0&a=1&b=2"), h2, nil) {
+		t.Error("equivalent requests have different keys")
+	}
+	if m.Key("GET", parse("https://example.com/p"), h1, nil) == m.Key("GET", parse("https://example.com/p"), http.Header{}, nil) {
+		t.Error("selected header ignored")
+	}
+	m = replay.Matcher{Body: true}
+	if m.Key("POST", parse("http://a/"), nil, []byte("x")) == m.Key("POST", parse("http://a/"), nil, []byte("y")) {
+		t.Error("body ignored")
+	}
+}
@@ -0,0 +1,396 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+)
+
+const (
+	// DefaultCheckTimeout bounds the health checks of the upstreams of a Pool.
+	DefaultCheckTimeout = 10 * time.Second
+	// DefaultBackoff is the wait before checking again an upstream that failed its
+	// health check, doubled at each new failure up to DefaultMaxBackoff.
+	DefaultBackoff    = 30 * time.Second
+	DefaultMaxBackoff = 10 * time.Minute
+	// DefaultSessionTTL is how long a sticky session keeps its upstream.
+	DefaultSessionTTL = 10 * time.Minute
+)
+
+// ErrNoUpstream is returned by Pool.Select when no upstream of the pool is healthy.
+var ErrNoUpstream = errors.New("upstream: no healthy upstream proxy")
+
+var healthyUpstreams = metrics.NewGaugeVec("proxy_upstream_healthy",
+	"Whether the upstream proxies of the pool passed their last health check.", "upstream")
+
+// Strategy is the way a Pool spreads the requests over its upstreams.
+type Strategy int
+
+const (
+	// RoundRobin takes the upstreams in turn
+	RoundRobin Strategy = iota
+	// Random takes an upstream at random
+	Random
+	// LeastConnections takes the upstream with the fewest active requests and tunnels
+	LeastConnections
+	// Weighted takes the upstreams in turn, in proportion to their weights
+	Weighted
+)
+
+var strategyNames = []string{"round-robin", "random", "least-connections", "weighted"}
+
+func (s Strategy) String() string {
+	if int(s) < len(strategyNames) {
+		return strategyNames[s]
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the Strategy named s, as "round-robin" or "least-connections".
+func ParseStrategy(s string) (Strategy, error) {
+	for i, name := range strategyNames {
+		if s == name {
+			return Strategy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("upstream: unknown strategy %q", s)
+}
+
+// Upstream is an upstream proxy of a Pool.
+type Upstream struct {
+	URL *url.URL
+	// Weight is the share of the requests of the upstream with the Weighted strategy,
+	// 1 when 0
+	Weight int
+
+	active   int
+	current  int
+	failures int
+	retryAt  time.Time
+}
+
+func (u *Upstream) healthy() bool {
+	return u.failures == 0
+}
+
+// ParseUpstream returns the Upstream of the URL s, whose "weight" query parameter, if
+// any, is its Weight.
+func ParseUpstream(s string) (*Upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	up := &Upstream{URL: u}
+	if q := u.Query(); q.Get("weight") != "" {
+		if _, err := fmt.Sscan(q.Get("weight"), &up.Weight); err != nil || up.Weight < 0 {
+			return nil, fmt.Errorf("upstream: invalid weight of %s", u.Host)
+		}
+		q.Del("weight")
+		u.RawQuery = q.Encode()
+	}
+	return up, nil
+}
+
+// Pool spreads the requests over a pool of upstream proxies. Upstreams failing their
+// health checks are ejected until they pass them again, the checks of a failed
+// upstream being spaced out exponentially. Clients naming a session, by a header or by
+// a suffix of their proxy user such as "alice-session-42", keep the same upstream for
+// SessionTTL, unless it gets ejected.
+//
+//	p := &upstream.Pool{Strategy: upstream.LeastConnections, Upstreams: upstreams,
+//		CheckURL: "http://www.example.com/", SessionSeparator: "-session-"}
+//	p.Register(proxy)
+//	stop := p.Watch(30 * time.Second)
+type Pool struct {
+	Strategy  Strategy
+	Upstreams []*Upstream
+	// CheckURL is the URL fetched through the upstreams by the health checks, which
+	// succeed on a 2xx or 3xx response
+	CheckURL string
+	// CheckTimeout bounds each health check, DefaultCheckTimeout when 0
+	CheckTimeout time.Duration
+	// Backoff and MaxBackoff space out the health checks of the failed upstreams,
+	// DefaultBackoff and DefaultMaxBackoff when 0
+	Backoff, MaxBackoff time.Duration
+	// SessionHeader is the request header naming the session of a client, scoped to its
+	// proxy user
+	SessionHeader string
+	// SessionSeparator ends the name of the proxy users naming a session, the whole user
+	// naming the session
+	SessionSeparator string
+	// SessionTTL is how long a session keeps the upstream it was given, DefaultSessionTTL
+	// when 0
+	SessionTTL time.Duration
+	// OnError is called with the errors of the health checks
+	OnError func(err error)
+
+	mu       sync.Mutex
+	next     int
+	sessions map[string]*session
+	swept    time.Time
+}
+
+type session struct {
+	upstream *Upstream
+	expires  time.Time
+}
+
+// Register sends the requests and tunnels of proxy through the upstreams of the pool.
+func (p *Pool) Register(proxy *goproxy.ProxyHttpServer) {
+	c := &Chain{Select: p.Select, Done: p.Done}
+	c.Register(proxy)
+}
+
+// Select returns the upstream of req, the upstream of its session if it has one. It
+// is a Selector, each upstream it returns being active until given to Done.
+func (p *Pool) Select(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+	key := p.sessionKey(req, ctx)
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	if s, ok := p.sessions[key]; ok && now.Before(s.expires) && s.upstream.healthy() {
+		s.upstream.active++
+		return s.upstream.URL, nil
+	}
+	up := p.pick()
+	if up == nil {
+		return nil, ErrNoUpstream
+	}
+	up.active++
+	if key != "" {
+		if p.sessions == nil {
+			p.sessions = make(map[string]*session)
+		}
+		p.sessions[key] = &session{upstream: up, expires: now.Add(p.sessionTTL())}
+	}
+	return up.URL, nil
+}
+
+// Done ends a request or a tunnel sent through u.
+func (p *Pool) Done(u *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, up := range p.Upstreams {
+		if up.URL == u {
+			up.active--
+			return
+		}
+	}
+}
+
+// Active returns the number of active requests and tunnels of u.
+func (p *Pool) Active(u *url.URL) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, up := range p.Upstreams {
+		if up.URL == u {
+			return up.active
+		}
+	}
+	return 0
+}
+
+func (p *Pool) sessionKey(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	user := ""
+	if ctx != nil {
+		user = ctx.User
+	}
+	if p.SessionHeader != "" {
+		if v := req.Header.Get(p.SessionHeader); v != "" {
+			return user + "\x00" + v
+		}
+	}
+	if p.SessionSeparator != "" && strings.Contains(user, p.SessionSeparator) {
+		return user
+	}
+	return ""
+}
+
+func (p *Pool) sessionTTL() time.Duration {
+	if p.SessionTTL > 0 {
+		return p.SessionTTL
+	}
+	return DefaultSessionTTL
+}
+
+// sweep forgets the expired sessions, at most once per TTL.
+func (p *Pool) sweep(now time.Time) {
+	if now.Sub(p.swept) < p.sessionTTL() {
+		return
+	}
+	p.swept = now
+	for key, s := range p.sessions {
+		if !now.Before(s.expires) {
+			delete(p.sessions, key)
+		}
+	}
+}
+
+// pick returns the next healthy upstream of the strategy, nil if there is none.
+func (p *Pool) pick() *Upstream {
+	var healthy []*Upstream
+	for _, up := range p.Upstreams {
+		if up.healthy() {
+			healthy = append(healthy, up)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	switch p.Strategy {
+	case Random:
+		return healthy[rand.Intn(len(healthy))]
+	case LeastConnections:
+		// the ties are broken in turn
+		p.next++
+		var best *Upstream
+		for i := range healthy {
+			up := healthy[(p.next+i)%len(healthy)]
+			if best == nil || up.active < best.active {
+				best = up
+			}
+		}
+		return best
+	case Weighted:
+		// smooth weighted round-robin, spreading the turns of each upstream
+		total := 0
+		var best *Upstream
+		for _, up := range healthy {
+			w := up.Weight
+			if w <= 0 {
+				w = 1
+			}
+			up.current += w
+			total += w
+			if best == nil || up.current > best.current {
+				best = up
+			}
+		}
+		best.current -= total
+		return best
+	default:
+		p.next++
+		return healthy[p.next%len(healthy)]
+	}
+}
+
+// Check runs the health checks of the upstreams that are not waiting for their
+// backoff to expire, in parallel.
+func (p *Pool) Check() {
+	if p.CheckURL == "" {
+		return
+	}
+	now := time.Now()
+	var wg sync.WaitGroup
+	p.mu.Lock()
+	for _, up := range p.Upstreams {
+		if now.Before(up.retryAt) {
+			continue
+		}
+		wg.Add(1)
+		go func(up *Upstream) {
+			defer wg.Done()
+			p.report(up, p.check(up.URL))
+		}(up)
+	}
+	p.mu.Unlock()
+	wg.Wait()
+}
+
+func (p *Pool) check(u *url.URL) error {
+	timeout := p.CheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true},
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(p.CheckURL)
+	if err != nil {
+		return fmt.Errorf("upstream: health check of %s: %w", label(u), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("upstream: health check of %s: %s", label(u), resp.Status)
+	}
+	return nil
+}
+
+// report records the result of the health check of up.
+func (p *Pool) report(up *Upstream, err error) {
+	p.mu.Lock()
+	if err == nil {
+		up.failures, up.retryAt = 0, time.Time{}
+	} else {
+		up.failures++
+		backoff, max := p.Backoff, p.MaxBackoff
+		if backoff <= 0 {
+			backoff = DefaultBackoff
+		}
+		if max <= 0 {
+			max = DefaultMaxBackoff
+		}
+		for i := 1; i < up.failures && backoff < max; i++ {
+			backoff *= 2
+		}
+		if backoff > max {
+			backoff = max
+		}
+		up.retryAt = time.Now().Add(backoff)
+	}
+	healthy := up.healthy()
+	p.mu.Unlock()
+	if healthy {
+		healthyUpstreams.With(label(up.URL)).Set(1)
+	} else {
+		healthyUpstreams.With(label(up.URL)).Set(0)
+	}
+	if err != nil && p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+// Watch runs the health checks every interval, until stop is called.
+func (p *Pool) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		p.Check()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				p.Check()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// BaseUser returns user without the session suffix starting at separator, the user to
+// authenticate.
+func BaseUser(user, separator string) string {
+	if separator == "" {
+		return user
+	}
+	if i := strings.Index(user, separator); i >= 0 {
+		return user[:i]
+	}
+	return user
+}
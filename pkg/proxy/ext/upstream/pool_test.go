@@ -0,0 +1,146 @@
+package upstream_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/upstream"
+)
+
+func newPool(strategy upstream.Strategy, weights ...int) *upstream.Pool {
+	p := &upstream.Pool{Strategy: strategy}
+	for i, w := range weights {
+		u := &url.URL{Scheme: "http", Host: string(rune('a'+i)) + ".proxy.example:3128"}
+		p.Upstreams = append(p.Upstreams, &upstream.Upstream{URL: u, Weight: w})
+	}
+	return p
+}
+
+// picks returns the first letter of the hosts of the next n upstreams selected.
+func picks(p *upstream.Pool, n int, req *http.Request, ctx *goproxy.ProxyCtx, t *testing.T) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		u, err := p.Select(req, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s += u.Host[:1]
+	}
+	return s
+}
+
+func TestPoolStrategies(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if s := picks(newPool(upstream.RoundRobin, 0, 0, 0), 6, req, nil, t); s != "bcabca" {
+		t.Errorf("round-robin picked %s", s)
+	}
+	if s := picks(newPool(upstream.Weighted, 3, 1), 8, req, nil, t); s != "aabaaaba" {
+		t.Errorf("weighted picked %s", s)
+	}
+
+	p := newPool(upstream.LeastConnections, 0, 0)
+	a, _ := p.Select(req, nil)
+	for i := 0; i < 3; i++ {
+		u, _ := p.Select(req, nil)
+		if u == a {
+			t.Fatalf("least-connections picked the busier upstream %s", u.Host)
+		}
+		p.Done(u)
+	}
+	p.Done(a)
+	if n := p.Active(a); n != 0 {
+		t.Errorf("active connections of %s = %d, want 0", a.Host, n)
+	}
+
+	for _, name := range []string{"round-robin", "random", "least-connections", "weighted"} {
+		if s, err := upstream.ParseStrategy(name); err != nil || s.String() != name {
+			t.Errorf("ParseStrategy(%q) = %v %v", name, s, err)
+		}
+	}
+	up, err := upstream.ParseUpstream("socks5://u:p@proxy.example:1080?weight=5")
+	if err != nil || up.Weight != 5 || up.URL.String() != "socks5://u:p@proxy.example:1080" {
+		t.Errorf("ParseUpstream = %+v %v", up, err)
+	}
+}
+
+func TestPoolSessions(t *testing.T) {
+	p := newPool(upstream.RoundRobin, 0, 0, 0)
+	p.SessionHeader = "X-Session"
+	p.SessionSeparator = "-session-"
+	p.SessionTTL = 50 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Session", "42")
+	alice := &goproxy.ProxyCtx{User: "alice"}
+	if s := picks(p, 3, req, alice, t); s != "bbb" {
+		t.Errorf("session of the header picked %s", s)
+	}
+	if s := picks(p, 2, req, &goproxy.ProxyCtx{User: "bob"}, t); s != "cc" {
+		t.Errorf("session of another user picked %s", s)
+	}
+	req.Header.Del("X-Session")
+	if s := picks(p, 2, req, alice, t); s != "ab" {
+		t.Errorf("no session picked %s", s)
+	}
+	if s := picks(p, 2, req, &goproxy.ProxyCtx{User: "alice-session-7"}, t); s != "cc" {
+		t.Errorf("session of the user picked %s", s)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if s := picks(p, 2, req, &goproxy.ProxyCtx{User: "alice-session-7"}, t); s != "aa" {
+		t.Errorf("expired session picked %s", s)
+	}
+	if u := upstream.BaseUser("alice-session-7", "-session-"); u != "alice" {
+		t.Errorf("BaseUser = %q, want alice", u)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer site.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var rec recorder
+	alive := &upstream.Upstream{URL: httpUpstream(t, &rec)}
+	var errs []error
+	p := &upstream.Pool{
+		Upstreams: []*upstream.Upstream{{URL: &url.URL{Scheme: "http", Host: dead.Listener.Addr().String()}}, alive},
+		CheckURL:  site.URL,
+		OnError:   func(err error) { errs = append(errs, err) },
+	}
+	p.Check()
+	p.Check()
+	if len(errs) != 1 {
+		t.Errorf("health check errors %v, want one for the dead upstream, checked again after its backoff", errs)
+	}
+	rec.take()
+
+	proxy := goproxy.NewProxyHttpServer()
+	p.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+	for i := 0; i < 3; i++ {
+		if body, err := get(client, site.URL, nil); err != nil || body != "ok" {
+			t.Fatalf("request through the pool: %q %v", body, err)
+		}
+	}
+	if hosts := rec.take(); len(hosts) != 3 {
+		t.Errorf("alive upstream saw %v, want the 3 requests", hosts)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Active(alive.URL) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := p.Active(alive.URL); n != 0 {
+		t.Errorf("active requests of the alive upstream = %d after the requests ended", n)
+	}
+}
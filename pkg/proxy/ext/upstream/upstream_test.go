@@ -0,0 +1,256 @@
+package upstream_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/auth"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/upstream"
+)
+
+// recorder records the hosts of the requests and tunnels seen by an upstream proxy, and
+// the addresses of their clients.
+type recorder struct {
+	mu      sync.Mutex
+	hosts   []string
+	clients []string
+}
+
+func (r *recorder) add(host string, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	r.clients = append(r.clients, ip)
+}
+
+func (r *recorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := r.hosts
+	r.hosts, r.clients = nil, nil
+	return hosts
+}
+
+func (r *recorder) takeClients() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := r.clients
+	r.hosts, r.clients = nil, nil
+	return clients
+}
+
+func checkCredentials(req *http.Request, user, passwd string) bool {
+	return user == "up" && passwd == "secret"
+}
+
+// httpUpstream returns the URL of an http upstream proxy requiring credentials.
+func httpUpstream(t *testing.T, rec *recorder) *url.URL {
+	proxy := goproxy.NewProxyHttpServer()
+	auth.ProxyBasic(proxy, "upstream", checkCredentials)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		rec.add(req.URL.Host, req)
+		return req, nil
+	})
+	// BasicConnect accepts the tunnels, the next handlers not being called
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		rec.add(addr, req)
+		return net.Dial(network, addr)
+	}
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	u.User = url.UserPassword("up", "secret")
+	return u
+}
+
+// socksUpstream returns the URL of a SOCKS5 upstream proxy requiring credentials.
+func socksUpstream(t *testing.T, rec *recorder) *url.URL {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		rec.add(addr, req)
+		return net.Dial(network, addr)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go (&goproxy.SocksServer{Proxy: proxy, Authenticate: checkCredentials}).Serve(l)
+	return &url.URL{Scheme: "socks5", Host: l.Addr().String(), User: url.UserPassword("up", "secret")}
+}
+
+func get(client *http.Client, u string, header http.Header) (string, error) {
+	req, _ := http.NewRequest("GET", u, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestChain(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	mitm := httptest.NewTLSServer(handler)
+	defer mitm.Close()
+
+	var httpRec, socksRec recorder
+	httpUp, socksUp := httpUpstream(t, &httpRec), socksUpstream(t, &socksRec)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.User == "" {
+			ctx.User = req.Header.Get("X-User")
+		}
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.User = ctx.Req.Header.Get("X-User")
+		return nil, ""
+	})
+	proxy.OnRequest(goproxy.ReqHostIs(mitm.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	c := &upstream.Chain{Select: upstream.Rules(
+		upstream.Rule{Header: "X-Upstream", Value: "socks", Upstream: socksUp},
+		upstream.Rule{Users: []string{"alice"}, Upstream: httpUp},
+	)}
+	c.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(u),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	tests := []struct {
+		name, url string
+		// header is sent both in the CONNECT requests and in the requests
+		header http.Header
+		rec    *recorder
+		host   string
+	}{
+		{"plain by user", plain.URL, http.Header{"X-User": {"alice"}}, &httpRec, plain.Listener.Addr().String()},
+		{"tunnel by user", secure.URL, http.Header{"X-User": {"alice"}}, &httpRec, secure.Listener.Addr().String()},
+		{"mitm by user", mitm.URL, http.Header{"X-User": {"alice"}}, &httpRec, mitm.Listener.Addr().String()},
+		{"plain by header", plain.URL, http.Header{"X-Upstream": {"socks"}}, &socksRec, plain.Listener.Addr().String()},
+		{"tunnel by header", secure.URL, http.Header{"X-Upstream": {"socks"}}, &socksRec, secure.Listener.Addr().String()},
+		{"direct", secure.URL, http.Header{"X-User": {"bob"}}, nil, ""},
+	}
+	for _, tt := range tests {
+		client.Transport.(*http.Transport).ProxyConnectHeader = tt.header
+		if body, err := get(client, tt.url, tt.header); err != nil || body != "ok" {
+			t.Errorf("%s: got %q %v", tt.name, body, err)
+		}
+		httpHosts, socksHosts := httpRec.take(), socksRec.take()
+		switch {
+		case tt.rec == nil && len(httpHosts)+len(socksHosts) > 0:
+			t.Errorf("%s: upstreams saw %v %v, want a direct connection", tt.name, httpHosts, socksHosts)
+		case tt.rec == &httpRec && (len(httpHosts) != 1 || httpHosts[0] != tt.host || len(socksHosts) > 0):
+			t.Errorf("%s: http upstream saw %v, socks upstream %v, want %s", tt.name, httpHosts, socksHosts, tt.host)
+		case tt.rec == &socksRec && (len(socksHosts) != 1 || socksHosts[0] != tt.host || len(httpHosts) > 0):
+			t.Errorf("%s: socks upstream saw %v, http upstream %v, want %s", tt.name, socksHosts, httpHosts, tt.host)
+		}
+	}
+}
+
+func TestChainBinding(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	var httpRec, socksRec recorder
+	httpUp, socksUp := httpUpstream(t, &httpRec), socksUpstream(t, &socksRec)
+
+	// the connections to the upstreams are made from the LocalAddr of the transactions
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.LocalAddr = net.ParseIP("127.0.0.2")
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.LocalAddr = net.ParseIP("127.0.0.2")
+		return nil, ""
+	})
+	c := &upstream.Chain{Select: upstream.Rules(
+		upstream.Rule{Header: "X-Upstream", Value: "socks", Upstream: socksUp},
+		upstream.Rule{Upstream: httpUp},
+	)}
+	c.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(u),
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	tests := []struct {
+		name, url string
+		header    http.Header
+		rec       *recorder
+	}{
+		{"plain", plain.URL, nil, &httpRec},
+		{"tunnel", secure.URL, nil, &httpRec},
+		{"plain through socks", plain.URL, http.Header{"X-Upstream": {"socks"}}, &socksRec},
+		{"tunnel through socks", secure.URL, http.Header{"X-Upstream": {"socks"}}, &socksRec},
+	}
+	for _, tt := range tests {
+		client.Transport.(*http.Transport).ProxyConnectHeader = tt.header
+		if body, err := get(client, tt.url, tt.header); err != nil || body != "ok" {
+			t.Errorf("%s: got %q %v", tt.name, body, err)
+		}
+		if clients := tt.rec.takeClients(); len(clients) != 1 || clients[0] != "127.0.0.2" {
+			t.Errorf("%s: upstream connected from %v, want 127.0.0.2", tt.name, clients)
+		}
+		httpRec.take()
+		socksRec.take()
+	}
+}
+
+func TestConnectDialToProxy(t *testing.T) {
+	var rec recorder
+	up := httpUpstream(t, &rec)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	c, err := proxy.NewConnectDialToProxy(up.String())("tcp", plain.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("CONNECT with the credentials of the URL: %v", err)
+	}
+	c.Close()
+
+	up.User = url.UserPassword("up", "wrong")
+	if _, err := proxy.NewConnectDialToProxy(up.String())("tcp", plain.Listener.Addr().String()); err == nil {
+		t.Error("CONNECT with wrong credentials should fail")
+	}
+	for _, u := range []string{"ftp://proxy.example", "http://[::1"} {
+		if _, err := proxy.NewConnectDialToProxy(u)("tcp", plain.Listener.Addr().String()); err == nil {
+			t.Errorf("dialing through %s should fail", u)
+		}
+	}
+}
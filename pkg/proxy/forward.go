@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLoop is the error of the requests the proxy would send to itself.
+var ErrLoop = errors.New("request loops back to the proxy")
+
+// ForwardMode is the way the proxy sets a forwarding header of the requests it sends.
+type ForwardMode int
+
+const (
+	// ForwardKeep sends the header as received from the client
+	ForwardKeep ForwardMode = iota
+	// ForwardAppend adds the client, or the proxy for Via, to the header received
+	ForwardAppend
+	// ForwardReplace sets the header to the client, or the proxy for Via, alone
+	ForwardReplace
+	// ForwardStrip removes the header
+	ForwardStrip
+)
+
+var forwardModeNames = []string{"keep", "append", "replace", "strip"}
+
+func (m ForwardMode) String() string {
+	if int(m) < len(forwardModeNames) {
+		return forwardModeNames[m]
+	}
+	return fmt.Sprintf("ForwardMode(%d)", int(m))
+}
+
+// ParseForwardMode returns the ForwardMode named s, as "append" or "strip".
+func ParseForwardMode(s string) (ForwardMode, error) {
+	for i, name := range forwardModeNames {
+		if s == name {
+			return ForwardMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown forwarding header mode %q", s)
+}
+
+// Forwarding is the policy of the forwarding headers of the requests the proxy sends,
+// the zero Forwarding sending them as received.
+type Forwarding struct {
+	// Via sets the Via header. The requests already carrying the Via entry of the proxy
+	// are rejected as loops when it is set
+	Via ForwardMode
+	// XForwarded sets the X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	// headers, the proto and host received being kept when appending
+	XForwarded ForwardMode
+	// Forwarded sets the Forwarded header of RFC 7239
+	Forwarded ForwardMode
+	// Pseudonym names the proxy in the Via headers, the host name when empty. The
+	// proxies chained must have distinct pseudonyms
+	Pseudonym string
+}
+
+var hostname, _ = os.Hostname()
+
+func (f *Forwarding) pseudonym() string {
+	if f.Pseudonym != "" {
+		return f.Pseudonym
+	}
+	if hostname != "" {
+		return hostname
+	}
+	return "go-httpproxy"
+}
+
+// forwardHeaders sets the forwarding headers of r, sent for the client of r.
+func (proxy *ProxyHttpServer) forwardHeaders(r *http.Request) {
+	f := &proxy.Forwarding
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	proto := r.URL.Scheme
+	if proto == "" {
+		proto = "http"
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	setForwardHeader(r.Header, "Via", f.Via, viaProtocol(r)+" "+f.pseudonym())
+	setForwardHeader(r.Header, "X-Forwarded-For", f.XForwarded, clientIP)
+	switch f.XForwarded {
+	case ForwardAppend:
+		if r.Header.Get("X-Forwarded-Proto") == "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if r.Header.Get("X-Forwarded-Host") == "" {
+			r.Header.Set("X-Forwarded-Host", host)
+		}
+	case ForwardReplace:
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Host", host)
+	case ForwardStrip:
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+	forwarded := "for=" + forwardedNode(clientIP) + ";host=" + quoteForwarded(host) + ";proto=" + proto
+	setForwardHeader(r.Header, "Forwarded", f.Forwarded, forwarded)
+}
+
+// setForwardHeader sets the header key of h to value the way of mode.
+func setForwardHeader(h http.Header, key string, mode ForwardMode, value string) {
+	switch mode {
+	case ForwardAppend:
+		if prior := h.Values(key); len(prior) > 0 {
+			value = strings.Join(prior, ", ") + ", " + value
+		}
+		h.Set(key, value)
+	case ForwardReplace:
+		h.Set(key, value)
+	case ForwardStrip:
+		h.Del(key)
+	}
+}
+
+// viaProtocol returns the protocol of r in the format of the Via header, as "1.1".
+func viaProtocol(r *http.Request) string {
+	if r.ProtoMajor >= 2 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	if r.ProtoMajor == 0 {
+		return "1.1"
+	}
+	return fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+}
+
+// forwardedNode returns the node of the Forwarded header of the client ip.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	if net.ParseIP(ip) == nil {
+		return "unknown"
+	}
+	return ip
+}
+
+func quoteForwarded(s string) string {
+	if strings.ContainsAny(s, `:[]";,= `) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// isLoop reports whether r, received by the proxy, would be sent back to it: it carries
+// the Via entry of the proxy, or its target is the local address of its connection or
+// one of the ListenAddrs of the proxy.
+func (proxy *ProxyHttpServer) isLoop(r *http.Request) bool {
+	if mode := proxy.Forwarding.Via; mode == ForwardAppend || mode == ForwardReplace {
+		pseudonym := proxy.Forwarding.pseudonym()
+		for _, v := range r.Header.Values("Via") {
+			for _, entry := range strings.Split(v, ",") {
+				fields := strings.Fields(entry)
+				if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+					return true
+				}
+			}
+		}
+	}
+	host, port := r.URL.Hostname(), r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ip := net.ParseIP(host)
+	if strings.EqualFold(host, "localhost") {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip == nil {
+		// names are checked once resolved, see DialContext
+		return false
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && sameAddr(local.String(), ip, port) {
+		return true
+	}
+	return proxy.isListenAddr(ip, port)
+}
+
+// isListenAddr reports whether ip and port are one of the ListenAddrs of the proxy.
+func (proxy *ProxyHttpServer) isListenAddr(ip net.IP, port string) bool {
+	for _, addr := range proxy.ListenAddrs {
+		if sameAddr(addr, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddr reports whether ip and port are the address addr listened on, whose host is
+// an IP address, or empty or unspecified for all the local addresses.
+func sameAddr(addr string, ip net.IP, port string) bool {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil || p != port {
+		return false
+	}
+	listenIP := net.ParseIP(host)
+	if host != "" && listenIP == nil {
+		return false
+	}
+	if listenIP != nil && !listenIP.IsUnspecified() {
+		return listenIP.Equal(ip)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// headerEcho answers the forwarding headers of the requests.
+var headerEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	for _, key := range []string{"Via", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+		w.Write([]byte(key + ": " + strings.Join(r.Header.Values(key), " | ") + "\n"))
+	}
+})
+
+func TestForwarding(t *testing.T) {
+	site := httptest.NewServer(headerEcho)
+	defer site.Close()
+	secure := httptest.NewTLSServer(headerEcho)
+	defer secure.Close()
+	siteHost := site.Listener.Addr().String()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	tests := []struct {
+		name       string
+		forwarding goproxy.Forwarding
+		url        string
+		want       string
+	}{
+		{"keep", goproxy.Forwarding{}, site.URL,
+			"Via: 1.0 client\nX-Forwarded-For: 192.0.2.1\nX-Forwarded-Proto: \nX-Forwarded-Host: \nForwarded: for=192.0.2.1\n"},
+		{"append", goproxy.Forwarding{Via: goproxy.ForwardAppend, XForwarded: goproxy.ForwardAppend, Forwarded: goproxy.ForwardAppend, Pseudonym: "px"}, site.URL,
+			"Via: 1.0 client, 1.1 px\nX-Forwarded-For: 192.0.2.1, 127.0.0.1\nX-Forwarded-Proto: http\nX-Forwarded-Host: " + siteHost +
+				"\nForwarded: for=192.0.2.1, for=127.0.0.1;host=\"" + siteHost + "\";proto=http\n"},
+		{"replace", goproxy.Forwarding{Via: goproxy.ForwardReplace, XForwarded: goproxy.ForwardReplace, Forwarded: goproxy.ForwardReplace, Pseudonym: "px"}, secure.URL,
+			"Via: 1.1 px\nX-Forwarded-For: 127.0.0.1\nX-Forwarded-Proto: https\nX-Forwarded-Host: " + secure.Listener.Addr().String() +
+				"\nForwarded: for=127.0.0.1;host=\"" + secure.Listener.Addr().String() + "\";proto=https\n"},
+		{"strip", goproxy.Forwarding{Via: goproxy.ForwardStrip, XForwarded: goproxy.ForwardStrip, Forwarded: goproxy.ForwardStrip}, site.URL,
+			"Via: \nX-Forwarded-For: \nX-Forwarded-Proto: \nX-Forwarded-Host: \nForwarded: \n"},
+	}
+	for _, tt := range tests {
+		proxy.Forwarding = tt.forwarding
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Via", "1.0 client")
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("Forwarded", "for=192.0.2.1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body := string(readAll(resp.Body, t))
+		resp.Body.Close()
+		if body != tt.want {
+			t.Errorf("%s: server saw\n%s\nwant\n%s", tt.name, body, tt.want)
+		}
+	}
+
+	for _, s := range []string{"keep", "append", "replace", "strip"} {
+		if m, err := goproxy.ParseForwardMode(s); err != nil || m.String() != s {
+			t.Errorf("ParseForwardMode(%q) = %v %v", s, m, err)
+		}
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Forwarding = goproxy.Forwarding{Via: goproxy.ForwardAppend, Pseudonym: "px"}
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+	site := httptest.NewServer(headerEcho)
+	defer site.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+
+	status := func(url string, header http.Header) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := status(site.URL, http.Header{"Via": {"1.1 other, 1.1 PX"}}); code != http.StatusLoopDetected {
+		t.Errorf("request with the Via entry of the proxy: status %d, want 508", code)
+	}
+	if code := status(site.URL, http.Header{"Via": {"1.1 other"}}); code != http.StatusOK {
+		t.Errorf("request through another proxy: status %d, want 200", code)
+	}
+	if code := status(s.URL+"/", nil); code != http.StatusLoopDetected {
+		t.Errorf("request to the proxy: status %d, want 508", code)
+	}
+
+	// names resolving to the proxy are caught when dialing its listen addresses
+	proxy.ListenAddrs = []string{":" + port}
+	proxy.Resolver = staticResolver("127.0.0.1")
+	if code := status("http://self.example:"+port+"/", nil); code != http.StatusLoopDetected {
+		t.Errorf("request to a name of the proxy: status %d, want 508", code)
+	}
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("CONNECT 127.0.0.1:" + port + " HTTP/1.1\r\nHost: 127.0.0.1:" + port + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("CONNECT to the proxy: status %d, want 508", resp.StatusCode)
+	}
+}
+
+func TestLoopDetectionHopByHopVia(t *testing.T) {
+	// a and b are the upstream proxies of each other, the requests going round
+	a := goproxy.NewProxyHttpServer()
+	a.Forwarding = goproxy.Forwarding{Via: goproxy.ForwardAppend, Pseudonym: "px"}
+	var rounds int32
+	a.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		atomic.AddInt32(&rounds, 1)
+		return req, nil
+	})
+	b := goproxy.NewProxyHttpServer()
+	client, sa := oneShotProxy(a, t)
+	defer sa.Close()
+	sb := httptest.NewServer(b)
+	defer sb.Close()
+	ua, _ := url.Parse(sa.URL)
+	ub, _ := url.Parse(sb.URL)
+	a.Tr.Proxy = http.ProxyURL(ub)
+	b.Tr.Proxy = http.ProxyURL(ua)
+
+	// the client names Via hop-by-hop, which must not remove the entry of the proxy:
+	// the request is rejected the first time it comes back
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set("Connection", "Via")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("request going round: status %d, want 508", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&rounds); n != 1 {
+		t.Errorf("request handled %d times before being rejected, want once", n)
+	}
+}
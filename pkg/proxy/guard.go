@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultDeniedNets are the networks denied by DefaultAddrPolicy: the loopback, private,
+// shared, link-local (with the cloud metadata services), multicast and reserved
+// networks of IPv4 and IPv6, and NAT64 addresses embedding IPv4 ones.
+var DefaultDeniedNets = mustParseNets("0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8," +
+	"169.254.0.0/16,172.16.0.0/12,192.0.0.0/24,192.0.2.0/24,192.168.0.0/16,198.18.0.0/15," +
+	"198.51.100.0/24,203.0.113.0/24,224.0.0.0/4,240.0.0.0/4," +
+	"::/128,::1/128,64:ff9b::/96,64:ff9b:1::/48,100::/64,fc00::/7,fe80::/10,fec0::/10,ff00::/8")
+
+// AddrPolicy restricts the IP addresses the proxy connects to for its clients, so that
+// they cannot reach the services of its own host and network. It is checked on the
+// resolved addresses, however the host resolves at the time of the connection.
+type AddrPolicy struct {
+	// Deny are the networks the proxy does not connect to
+	Deny []*net.IPNet
+	// Allow are the networks of Deny the proxy connects to anyway
+	Allow []*net.IPNet
+}
+
+// DefaultAddrPolicy returns the AddrPolicy denying DefaultDeniedNets.
+func DefaultAddrPolicy() *AddrPolicy {
+	return &AddrPolicy{Deny: DefaultDeniedNets}
+}
+
+// Allowed reports whether the proxy may connect to ip. IPv4-mapped IPv6 addresses are
+// checked as the IPv4 addresses they map.
+func (p *AddrPolicy) Allowed(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range p.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range p.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseNets returns the networks of the comma separated CIDR blocks or IP addresses of s.
+func ParseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", f)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseNets(s string) []*net.IPNet {
+	nets, err := ParseNets(s)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// ForbiddenAddrError is the error of the connections denied by the AddrPolicy of the
+// proxy.
+type ForbiddenAddrError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *ForbiddenAddrError) Error() string {
+	if e.Host == e.IP.String() {
+		return fmt.Sprintf("connection to %s is forbidden", e.Host)
+	}
+	return fmt.Sprintf("connection to %s (%s) is forbidden", e.Host, e.IP)
+}
+
+func isForbidden(err error) bool {
+	var forbidden *ForbiddenAddrError
+	return errors.As(err, &forbidden)
+}
+
+// dialErrorStatus returns the status of the responses to the transactions whose
+// connection to the server failed with err.
+func dialErrorStatus(err error) int {
+	switch {
+	case isForbidden(err):
+		return http.StatusForbidden
+	case errors.Is(err, ErrLoop):
+		return http.StatusLoopDetected
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// staticResolver resolves every host to its address.
+type staticResolver string
+
+func (r staticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return []net.IP{net.ParseIP(string(r))}, nil
+}
+
+func TestAddrPolicy(t *testing.T) {
+	allow, err := goproxy.ParseNets("10.1.2.3, 192.168.7.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &goproxy.AddrPolicy{Deny: goproxy.DefaultDeniedNets, Allow: allow}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+		{"172.31.255.255", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"::1", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"10.1.2.3", true},
+		{"::ffff:192.168.7.9", true},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+	if _, err := goproxy.ParseNets("10.0.0.1/33"); err == nil {
+		t.Error("ParseNets should fail on an invalid CIDR block")
+	}
+}
+
+func TestAddrPolicyDial(t *testing.T) {
+	site := httptest.NewServer(ConstantHanlder("ok"))
+	defer site.Close()
+	secure := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer secure.Close()
+	mitm := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer mitm.Close()
+	_, port, _ := net.SplitHostPort(site.Listener.Addr().String())
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.AddrPolicy = goproxy.DefaultAddrPolicy()
+	// every host resolves to the loopback address, as after a DNS rebinding
+	proxy.Resolver = staticResolver("127.0.0.1")
+	proxy.OnRequest(goproxy.ReqHostIs(mitm.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	// the IP literals of the loopback address in all their forms
+	literals := []string{"http://[::1]/", "http://[::1]:" + port + "/", "http://[::ffff:127.0.0.1]:" + port + "/",
+		"http://[0:0:0:0:0:ffff:7f00:1]/", "https://[::1]:" + port + "/"}
+	for _, u := range append([]string{site.URL, "http://rebind.example:" + port + "/", secure.URL, mitm.URL}, literals...) {
+		resp, err := client.Get(u)
+		if err != nil {
+			// the CONNECT response is an error to the client
+			if !strings.Contains(err.Error(), "Forbidden") {
+				t.Errorf("%s: %v, want 403 Forbidden", u, err)
+			}
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "forbidden") {
+			t.Errorf("%s: %d %q, want 403 Forbidden", u, resp.StatusCode, body)
+		}
+	}
+
+	proxy.AddrPolicy.Allow, _ = goproxy.ParseNets("127.0.0.1")
+	for _, u := range []string{site.URL, secure.URL, mitm.URL} {
+		if body, err := get(u, client); err != nil || string(body) != "ok" {
+			t.Errorf("%s allowed: %q %v", u, body, err)
+		}
+	}
+}
+
+func TestAddrPolicyUpstream(t *testing.T) {
+	// the connections to an upstream proxy are not the ones of the clients
+	upstream := httptest.NewServer(ConstantHanlder("upstream"))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.AddrPolicy = goproxy.DefaultAddrPolicy()
+	proxy.Tr.Proxy = http.ProxyURL(upstreamURL)
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+	if body, err := get("http://www.example.com/", client); err != nil || string(body) != "upstream" {
+		t.Errorf("request through the upstream proxy: %q %v", body, err)
+	}
+}
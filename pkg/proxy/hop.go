@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 9110 section 7.6.1 and RFC 9112, with
+// the Proxy-Connection and Keep-Alive headers of the older clients. They apply to a
+// single connection, and are never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// connectionTokens returns the lower case options of the Connection headers of h.
+func connectionTokens(h http.Header) []string {
+	var tokens []string
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				tokens = append(tokens, strings.ToLower(f))
+			}
+		}
+	}
+	return tokens
+}
+
+// removeHopHeaders removes from h the hop-by-hop headers and the headers named by its
+// Connection headers. When upgrade is not empty, the upgrade of the connection to the
+// protocol upgrade is kept, as needed by websockets.
+func removeHopHeaders(h http.Header, upgrade string) {
+	for _, token := range connectionTokens(h) {
+		h.Del(token)
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+// removeProxyHeaders prepares r, received from the client, to be sent to the server:
+// its hop-by-hop headers are removed, but the Proxy-Authorization header when
+// KeepHeader is set, and a "TE: trailers" header, which only tells that the client
+// accepts trailers.
+func (proxy *ProxyHttpServer) removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
+	r.RequestURI = "" // this must be reset when serving a request with the client
+	ctx.Logf("Sending request %v %v", r.Method, r.URL.String())
+	// Accept-Encoding is kept: encoded bodies go through untouched unless a handler
+	// decodes them with DecodeBody, see encoding.go
+	trailers := false
+	for _, v := range r.Header["Te"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(f), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	auth := r.Header["Proxy-Authorization"]
+	// When server reads http request it sets req.Close to true if
+	// "Connection" header contains "close".
+	// https://github.com/golang/go/blob/master/src/net/http/request.go#L1080
+	// Later, transfer.go adds "Connection: close" back when req.Close is true
+	// https://github.com/golang/go/blob/master/src/net/http/transfer.go#L275
+	// The connection of the client is not the one to the server, whose reuse is left
+	// to Tr
+	for _, token := range connectionTokens(r.Header) {
+		if token == "close" {
+			r.Close = false
+		}
+	}
+	removeHopHeaders(r.Header, "")
+	if trailers {
+		r.Header.Set("Te", "trailers")
+	}
+	if proxy.KeepHeader && auth != nil {
+		r.Header["Proxy-Authorization"] = auth
+	}
+}
+
+// announceTrailers sets the Trailer header of h to the trailers of resp, to be sent
+// after its body.
+func announceTrailers(h http.Header, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.Set("Trailer", strings.Join(keys, ", "))
+}
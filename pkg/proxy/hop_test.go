@@ -0,0 +1,239 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+// hopServer answers the headers it received in its body, with hop-by-hop headers, an
+// end-to-end header and a trailer.
+var hopServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "X-Checksum")
+	w.Header().Set("Connection", "X-Resp-Hop")
+	w.Header().Set("X-Resp-Hop", "1")
+	w.Header().Set("Keep-Alive", "timeout=5")
+	w.Header().Set("Proxy-Authenticate", `Basic realm="upstream"`)
+	w.Header().Set("X-End", "1")
+	r.Header.Write(w)
+	w.Header().Set("X-Checksum", "abc")
+})
+
+// hopClient sends requests through the proxy in one of its modes.
+type hopClient struct {
+	name  string
+	proxy string
+	url   string
+	mitm  bool
+}
+
+func (c *hopClient) do(header http.Header, t *testing.T) *http.Response {
+	target, _ := url.Parse(c.url)
+	req, _ := http.NewRequest("GET", c.url+"/hop", nil)
+	req.Header = header
+	if !c.mitm || target.Scheme == "https" {
+		proxyURL, _ := url.Parse(c.proxy)
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: acceptAllCerts, DisableKeepAlives: true}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		return resp
+	}
+	// HTTP MITM: the request is sent in cleartext in a CONNECT tunnel
+	conn, err := net.Dial("tcp", strings.TrimPrefix(c.proxy, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+target.Host+" HTTP/1.1\r\nHost: "+target.Host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: CONNECT failed: %v %v", c.name, resp, err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("%s: %v", c.name, err)
+	}
+	return resp
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	plain := httptest.NewServer(hopServer)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(hopServer)
+	defer secure.Close()
+	httpMitm := httptest.NewServer(hopServer)
+	defer httpMitm.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(httpMitm.Listener.Addr().String())).HandleConnect(goproxy.FuncHttpsHandler(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			return goproxy.HTTPMitmConnect, host
+		}))
+	proxy.OnRequest(goproxy.ReqHostIs(secure.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	clients := []*hopClient{
+		{name: "plain", proxy: s.URL, url: plain.URL},
+		{name: "HTTP MITM", proxy: s.URL, url: httpMitm.URL, mitm: true},
+		{name: "TLS MITM", proxy: s.URL, url: secure.URL, mitm: true},
+	}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		keepHeader bool
+		// want are the headers the server must receive, a nil value meaning absent
+		want http.Header
+	}{
+		{"end-to-end", http.Header{"X-End": {"1"}, "Accept": {"text/plain"}},
+			false, http.Header{"X-End": {"1"}, "Accept": {"text/plain"}}},
+		{"connection options", http.Header{"Connection": {"close, X-Hop", "x-other-hop"}, "X-Hop": {"1"}, "X-Other-Hop": {"1"}, "X-End": {"1"}},
+			false, http.Header{"Connection": nil, "X-Hop": nil, "X-Other-Hop": nil, "X-End": {"1"}}},
+		{"keep-alive", http.Header{"Connection": {"keep-alive"}, "Keep-Alive": {"timeout=5, max=100"}, "Proxy-Connection": {"keep-alive"}},
+			false, http.Header{"Connection": nil, "Keep-Alive": nil, "Proxy-Connection": nil}},
+		{"proxy authentication", http.Header{"Proxy-Authorization": {"Basic dXNlcjpwYXNz"}, "Proxy-Authenticate": {"Basic"}},
+			false, http.Header{"Proxy-Authorization": nil, "Proxy-Authenticate": nil}},
+		{"proxy authorization kept", http.Header{"Proxy-Authorization": {"Basic dXNlcjpwYXNz"}},
+			true, http.Header{"Proxy-Authorization": {"Basic dXNlcjpwYXNz"}}},
+		{"TE trailers", http.Header{"Connection": {"TE"}, "Te": {"deflate;q=0.5, trailers"}},
+			false, http.Header{"Te": {"trailers"}}},
+		{"TE codings", http.Header{"Connection": {"TE"}, "Te": {"deflate"}},
+			false, http.Header{"Te": nil}},
+		{"upgrade", http.Header{"Connection": {"Upgrade, HTTP2-Settings"}, "Upgrade": {"h2c"}, "Http2-Settings": {"AAMAAABkAAQAAP__"}},
+			false, http.Header{"Upgrade": nil, "Http2-Settings": nil, "Connection": nil}},
+	}
+	for _, c := range clients {
+		for _, tt := range tests {
+			proxy.KeepHeader = tt.keepHeader
+			resp := c.do(tt.header.Clone(), t)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			got, err := readHeader(string(body))
+			if err != nil {
+				t.Fatalf("%s %s: %v", c.name, tt.name, err)
+			}
+			for key, want := range tt.want {
+				if v := got.Values(key); strings.Join(v, ", ") != strings.Join(want, ", ") {
+					t.Errorf("%s %s: server got %s %q, want %q", c.name, tt.name, key, v, want)
+				}
+			}
+
+			for _, key := range []string{"X-Resp-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+				if v := resp.Header.Get(key); v != "" {
+					t.Errorf("%s %s: client got hop-by-hop response header %s: %s", c.name, tt.name, key, v)
+				}
+			}
+			if resp.Header.Get("X-End") != "1" {
+				t.Errorf("%s %s: client did not get the end-to-end response header", c.name, tt.name)
+			}
+			if v := resp.Trailer.Get("X-Checksum"); v != "abc" {
+				t.Errorf("%s %s: client got trailer %q, want abc", c.name, tt.name, v)
+			}
+		}
+	}
+}
+
+func TestForwardingHeadersNotHopByHop(t *testing.T) {
+	plain := httptest.NewServer(hopServer)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(hopServer)
+	defer secure.Close()
+	httpMitm := httptest.NewServer(hopServer)
+	defer httpMitm.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Forwarding = goproxy.Forwarding{Via: goproxy.ForwardAppend, XForwarded: goproxy.ForwardAppend,
+		Forwarded: goproxy.ForwardAppend, Pseudonym: "px"}
+	proxy.OnRequest(goproxy.ReqHostIs(httpMitm.Listener.Addr().String())).HandleConnect(goproxy.FuncHttpsHandler(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			return goproxy.HTTPMitmConnect, host
+		}))
+	proxy.OnRequest(goproxy.ReqHostIs(secure.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	clients := []*hopClient{
+		{name: "plain", proxy: s.URL, url: plain.URL},
+		{name: "HTTP MITM", proxy: s.URL, url: httpMitm.URL, mitm: true},
+		{name: "TLS MITM", proxy: s.URL, url: secure.URL, mitm: true},
+	}
+	// the client cannot remove the forwarding headers of the proxy by naming them
+	// hop-by-hop
+	header := http.Header{"Connection": {"Via, X-Forwarded-For, Forwarded"}}
+	for _, c := range clients {
+		resp := c.do(header.Clone(), t)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got, err := readHeader(string(body))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if v := got.Get("Via"); !strings.HasSuffix(v, " px") {
+			t.Errorf("%s: server got Via %q, want the entry of the proxy", c.name, v)
+		}
+		if v := got.Get("X-Forwarded-For"); v != "127.0.0.1" {
+			t.Errorf("%s: server got X-Forwarded-For %q, want 127.0.0.1", c.name, v)
+		}
+		if v := got.Get("Forwarded"); !strings.HasPrefix(v, "for=127.0.0.1;") {
+			t.Errorf("%s: server got Forwarded %q, want the client", c.name, v)
+		}
+	}
+}
+
+// readHeader parses the header written by hopServer.
+func readHeader(s string) (http.Header, error) {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n" + s + "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	return req.Header, nil
+}
+
+func TestWebsocketHopByHopHeaders(t *testing.T) {
+	var got http.Header
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		c, _, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade, X-Hop\r\nX-Hop: 1\r\n\r\n")
+		c.Close()
+	}))
+	defer site.Close()
+	_, s := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET "+site.URL+"/ws HTTP/1.1\r\nHost: "+site.Listener.Addr().String()+
+		"\r\nConnection: Upgrade, X-Hop\r\nUpgrade: websocket\r\nX-Hop: 1\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" || resp.Header.Get("X-Hop") != "" {
+		t.Errorf("client got %d %v, want the upgrade alone", resp.StatusCode, resp.Header)
+	}
+	if got.Get("Upgrade") != "websocket" || got.Get("Connection") != "Upgrade" || got.Get("X-Hop") != "" || got.Get("Proxy-Authorization") != "" {
+		t.Errorf("server got %v, want the upgrade alone", got)
+	}
+}
@@ -2,8 +2,11 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -15,6 +18,10 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+	xproxy "golang.org/x/net/proxy"
 )
 
 type ConnectActionLiteral int
@@ -70,25 +77,39 @@ func stripPort(s string) string {
 	return s[:ix]
 }
 
-func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
-	if proxy.Tr.Dial != nil {
-		return proxy.Tr.Dial(network, addr)
-	}
-	return net.Dial(network, addr)
-}
-
 func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	span := ctx.StartSpan("proxy.connectDial")
+	span.SetAttribute("net.peer.addr", addr)
+	defer func() {
+		if err != nil {
+			observeDialError(err, true)
+		} else {
+			ctx.RoundTripDetails = connDetails(addr, c)
+		}
+		span.RecordError(err)
+		span.End()
+	}()
 	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
-		return proxy.dial(network, addr)
+		return proxy.dial(proxyContext(context.Background(), ctx, addr), network, addr)
 	}
 
 	if proxy.ConnectDialWithReq != nil {
-		return proxy.ConnectDialWithReq(ctx.Req, network, addr)
+		req := ctx.Req
+		if req != nil {
+			req = withProxyCtx(req, ctx)
+		}
+		return proxy.ConnectDialWithReq(req, network, addr)
 	}
 
 	return proxy.ConnectDial(network, addr)
 }
 
+// Dial connects to addr the way the proxy connects CONNECT tunnels, through the
+// ConnectDial of the proxy if set. It is meant for Hijack functions.
+func (ctx *ProxyCtx) Dial(network, addr string) (net.Conn, error) {
+	return ctx.Proxy.connectDial(ctx, network, addr)
+}
+
 type halfClosable interface {
 	net.Conn
 	CloseWrite() error
@@ -98,8 +119,6 @@ type halfClosable interface {
 var _ halfClosable = (*net.TCPConn)(nil)
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
-
 	hij, ok := w.(http.Hijacker)
 	if !ok {
 		panic("httpserver does not support hijacking")
@@ -109,59 +128,126 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	if e != nil {
 		panic("Cannot hijack connection " + e.Error())
 	}
+	proxy.ServeTunnel(proxyClient, r)
+}
 
+// connectAction returns the action of the first CONNECT handler deciding about host,
+// OkConnect if none does.
+func (proxy *ProxyHttpServer) connectAction(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
-	todo, host := OkConnect, r.URL.Host
 	for i, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleConnect(host, ctx)
-
 		// If found a result, break the loop immediately
-		if newtodo != nil {
-			todo, host = newtodo, newhost
-			ctx.Logf("on %dth handler: %v %s", i, todo, host)
-			break
+		if todo, newhost := h.HandleConnect(host, ctx); todo != nil {
+			ctx.Logf("on %dth handler: %v %s", i, todo, newhost)
+			return todo, newhost
 		}
 	}
+	return OkConnect, host
+}
+
+// ServeTunnel serves the CONNECT request r of proxyClient through the CONNECT handlers,
+// proxyClient being the connection hijacked from the HTTP server, or the connection of
+// another front-end such as SOCKS. The responses to the CONNECT request are written to
+// proxyClient in HTTP.
+func (proxy *ProxyHttpServer) ServeTunnel(proxyClient net.Conn, r *http.Request) {
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx.startTransaction("proxy.connect", r, tracing.SpanContext{})
+	defer ctx.span.End()
+	rec := newAccessRecord(ctx, r, modeConnect)
+
+	if proxy.isLoop(r) {
+		ctx.Warnf("Rejected CONNECT to %s: %v", r.URL.Host, ErrLoop)
+		observeRequest(r.Method, http.StatusLoopDetected, modeConnect)
+		ctx.logAccess(rec, http.StatusLoopDetected, ErrLoop)
+		httpError(proxyClient, ctx, ErrLoop)
+		return
+	}
+
+	todo, host := proxy.connectAction(r.URL.Host, ctx)
+	ctx.span.SetAttribute("proxy.connect.action", int(todo.Action))
+	ctx.span.SetAttribute("proxy.connect.host", host)
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
+		start := time.Now()
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
+		observeUpstream(modeConnect, start)
 		if err != nil {
+			observeRequest(r.Method, dialErrorStatus(err), modeConnect)
+			ctx.logAccess(rec, dialErrorStatus(err), err)
 			httpError(proxyClient, ctx, err)
 			return
 		}
 		ctx.Logf("Accepting CONNECT to %s", host)
+		observeRequest(r.Method, http.StatusOK, modeConnect)
 		proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
 
+		tunnels := activeTunnels.With(modeConnect)
+		tunnels.Inc()
+		var sent, received int64
+		done := func() {
+			tunnels.Dec()
+			if rec != nil {
+				rec.BytesSent, rec.BytesReceived = sent, received
+			}
+			ctx.logAccess(rec, http.StatusOK, nil)
+		}
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				received = copyAndClose(ctx, targetTCP, proxyClientTCP)
+				wg.Done()
+			}()
+			go func() {
+				sent = copyAndClose(ctx, proxyClientTCP, targetTCP)
+				wg.Done()
+			}()
+			go func() {
+				wg.Wait()
+				done()
+			}()
 		} else {
 			go func() {
 				var wg sync.WaitGroup
 				wg.Add(2)
-				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
-				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg)
+				go copyOrWarn(ctx, targetSiteCon, proxyClient, &received, &wg)
+				go copyOrWarn(ctx, proxyClient, targetSiteCon, &sent, &wg)
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
+				done()
 			}()
 		}
 
 	case ConnectHijack:
+		observeRequest(r.Method, 0, modeHijack)
+		if rec != nil {
+			rec.Mode = modeHijack
+		}
 		todo.Hijack(r, proxyClient, ctx)
+		ctx.logAccess(rec, 0, nil)
 	case ConnectHTTPMitm:
+		observeRequest(r.Method, http.StatusOK, modeConnect)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
+		if rec != nil {
+			rec.Mitm = true
+		}
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+			ctx.logAccess(rec, http.StatusOK, err)
 			return
 		}
+		tunnels := activeTunnels.With(modeHTTPMitm)
+		tunnels.Inc()
+		defer tunnels.Dec()
+		defer ctx.logAccess(rec, http.StatusOK, nil)
 		for {
 			client := bufio.NewReader(proxyClient)
 			remote := bufio.NewReader(targetSiteCon)
@@ -172,26 +258,54 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			if err != nil {
 				return
 			}
+			req.RemoteAddr = r.RemoteAddr // the client of the tunnel, as in the TLS MITM
+			method := req.Method
+			innerRec := newAccessRecord(ctx, req, modeHTTPMitm)
 			req, resp := proxy.filterRequest(req, ctx)
+			if innerRec != nil {
+				innerRec.Cached = resp != nil
+			}
 			if resp == nil {
+				proxy.removeProxyHeaders(ctx, req)
+				proxy.forwardHeaders(req)
+				start := time.Now()
 				if err := req.Write(targetSiteCon); err != nil {
+					observeRequest(method, http.StatusBadGateway, modeHTTPMitm)
+					ctx.logAccess(innerRec, http.StatusBadGateway, err)
 					httpError(proxyClient, ctx, err)
 					return
 				}
 				resp, err = http.ReadResponse(remote, req)
+				observeUpstream(modeHTTPMitm, start)
 				if err != nil {
+					observeRequest(method, http.StatusBadGateway, modeHTTPMitm)
+					ctx.logAccess(innerRec, http.StatusBadGateway, err)
 					httpError(proxyClient, ctx, err)
 					return
 				}
+				removeHopHeaders(resp.Header, "")
 				defer resp.Body.Close()
 			}
 			resp = proxy.filterResponse(resp, ctx)
-			if err := resp.Write(proxyClient); err != nil {
+			observeRequest(method, resp.StatusCode, modeHTTPMitm)
+			if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && req.ProtoAtLeast(1, 1) {
+				// the length of the bodies decoded or encoded again is unknown, and the
+				// connection of the client is kept for its next requests
+				resp.TransferEncoding = []string{"chunked"}
+			}
+			cw := &countingWriter{w: proxyClient}
+			err = resp.Write(cw)
+			if innerRec != nil {
+				innerRec.BytesSent = cw.n
+			}
+			ctx.logAccess(innerRec, resp.StatusCode, err)
+			if err != nil {
 				httpError(proxyClient, ctx, err)
 				return
 			}
 		}
 	case ConnectMitm:
+		observeRequest(r.Method, http.StatusOK, modeConnect)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
@@ -207,18 +321,30 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				return
 			}
 		}
+		if rec != nil {
+			rec.Mitm = true
+		}
 		go func() {
+			defer ctx.logAccess(rec, http.StatusOK, nil)
 			// TODO: cache connections to the remote website
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
-			if err := rawClientTls.Handshake(); err != nil {
+			handshake := ctx.StartSpan("proxy.tls.client")
+			err := rawClientTls.Handshake()
+			handshake.RecordError(err)
+			handshake.End()
+			if err != nil {
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
 			defer rawClientTls.Close()
+			tunnels := activeTunnels.With(modeMitm)
+			tunnels.Inc()
+			defer tunnels.Dec()
 			clientTlsReader := bufio.NewReader(rawClientTls)
 			for !isEof(clientTlsReader) {
 				req, err := http.ReadRequest(clientTlsReader)
-				ctx := &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				connectSpan := ctx.SpanContext()
+				ctx := &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData, User: ctx.User, LocalAddr: ctx.LocalAddr}
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -226,6 +352,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
 					return
 				}
+				ctx.startTransaction("proxy.mitm.request", req, connectSpan)
 				req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
 				ctx.Logf("req %v", r.Host)
 
@@ -237,27 +364,46 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				// information URL in the context when does HTTPS MITM
 				ctx.Req = req
 
+				method := req.Method
+				innerRec := newAccessRecord(ctx, req, modeMitm)
 				req, resp := proxy.filterRequest(req, ctx)
+				if innerRec != nil {
+					innerRec.Cached = resp != nil
+				}
 				if resp == nil {
 					if isWebSocketRequest(req) {
 						ctx.Logf("Request looks like websocket upgrade.")
-						proxy.serveWebsocketTLS(ctx, w, req, tlsConfig, rawClientTls)
+						proxy.serveWebsocketTLS(ctx, req, tlsConfig, rawClientTls)
+						ctx.span.End()
+						ctx.logAccess(innerRec, http.StatusSwitchingProtocols, nil)
 						return
 					}
 					if err != nil {
 						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
 						return
 					}
-					removeProxyHeaders(ctx, req)
+					proxy.removeProxyHeaders(ctx, req)
+					proxy.forwardHeaders(req)
+					start := time.Now()
 					resp, err = ctx.RoundTrip(req)
+					observeUpstream(modeMitm, start)
 					if err != nil {
+						observeDialError(err, false)
+						observeRequest(method, 0, modeMitm)
+						ctx.span.RecordError(err)
+						ctx.span.End()
+						ctx.logAccess(innerRec, 0, err)
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
 						return
 					}
+					removeHopHeaders(resp.Header, "")
 					ctx.Logf("resp %v", resp.Status)
 				}
 				resp = proxy.filterResponse(resp, ctx)
 				defer resp.Body.Close()
+				observeRequest(method, resp.StatusCode, modeMitm)
+				ctx.span.SetAttribute("http.status_code", resp.StatusCode)
+				ctx.span.End()
 
 				text := resp.Status
 				statusCode := strconv.Itoa(resp.StatusCode) + " "
@@ -278,6 +424,9 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					resp.Header.Del("Content-Length")
 					resp.Header.Set("Transfer-Encoding", "chunked")
 				}
+				if resp.Request.Method != "HEAD" {
+					announceTrailers(resp.Header, resp)
+				}
 				// Force connection close otherwise chrome will keep CONNECT tunnel open forever
 				resp.Header.Set("Connection", "close")
 				if err := resp.Header.Write(rawClientTls); err != nil {
@@ -291,9 +440,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 
 				if resp.Request.Method == "HEAD" {
 					// Don't write out a response body for HEAD request
+					ctx.logAccess(innerRec, resp.StatusCode, nil)
 				} else {
 					chunked := newChunkedWriter(rawClientTls)
-					if _, err := io.Copy(chunked, resp.Body); err != nil {
+					nr, err := io.Copy(chunked, resp.Body)
+					if innerRec != nil {
+						innerRec.BytesSent = nr
+					}
+					ctx.logAccess(innerRec, resp.StatusCode, err)
+					if err != nil {
 						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 						return
 					}
@@ -301,6 +456,10 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
 						return
 					}
+					if err := resp.Trailer.Write(rawClientTls); err != nil {
+						ctx.Warnf("Cannot write TLS response trailers from mitm'd client: %v", err)
+						return
+					}
 					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
 						ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
 						return
@@ -310,9 +469,17 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			ctx.Logf("Exiting on EOF")
 		}()
 	case ConnectProxyAuthHijack:
+		observeRequest(r.Method, http.StatusProxyAuthRequired, modeConnect)
+		ctx.logAccess(rec, http.StatusProxyAuthRequired, nil)
 		proxyClient.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
 		todo.Hijack(r, proxyClient, ctx)
 	case ConnectReject:
+		status := 0
+		if ctx.Resp != nil {
+			status = ctx.Resp.StatusCode
+		}
+		observeRequest(r.Method, status, modeConnect)
+		ctx.logAccess(rec, status, nil)
 		if ctx.Resp != nil {
 			if err := ctx.Resp.Write(proxyClient); err != nil {
 				ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
@@ -323,7 +490,13 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 }
 
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
+	response := "HTTP/1.1 502 Bad Gateway\r\n\r\n"
+	if status := dialErrorStatus(err); status != http.StatusBadGateway {
+		body := err.Error() + "\n"
+		response = "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) +
+			"\r\nContent-Type: text/plain\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+	if _, err := io.WriteString(w, response); err != nil {
 		ctx.Warnf("Error responding to client: %s", err)
 	}
 	if err := w.Close(); err != nil {
@@ -331,20 +504,34 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	}
 }
 
-func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, written *int64, wg *sync.WaitGroup) {
+	var err error
+	if *written, err = io.Copy(dst, src); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 	wg.Done()
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) int64 {
+	written, err := io.Copy(dst, src)
+	if err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 
 	dst.CloseWrite()
 	src.CloseRead()
+	return written
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
 
 func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn, error) {
@@ -358,97 +545,138 @@ func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn,
 	return proxy.NewConnectDialToProxy(https_proxy)
 }
 
+// NewConnectDialToProxy returns a dialer connecting through the upstream proxy of the
+// URL https_proxy, as NewConnectDialToProxyWithHandler.
 func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(network, addr string) (net.Conn, error) {
 	return proxy.NewConnectDialToProxyWithHandler(https_proxy, nil)
 }
 
+// NewConnectDialToProxyWithHandler returns a dialer connecting through the upstream
+// proxy of the URL https_proxy. The http and https schemes send it CONNECT requests,
+// which connectReqHandler may modify, and the socks5 and socks5h schemes a SOCKS5
+// CONNECT command. The user info of the URL is sent as the credentials of the upstream
+// proxy. When the URL is invalid, the dialer returns the error instead of connecting
+// directly.
 func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy string, connectReqHandler func(req *http.Request)) func(network, addr string) (net.Conn, error) {
+	dial := proxy.NewConnectDialContextToProxy(https_proxy, connectReqHandler)
+	return func(network, addr string) (net.Conn, error) {
+		return dial(context.Background(), network, addr)
+	}
+}
+
+// NewConnectDialContextToProxy is NewConnectDialToProxyWithHandler connecting to the
+// upstream proxy with the context of the dials, from the LocalAddr of their transaction
+// for instance.
+func (proxy *ProxyHttpServer) NewConnectDialContextToProxy(https_proxy string, connectReqHandler func(req *http.Request)) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	u, err := url.Parse(https_proxy)
 	if err != nil {
-		return nil
+		return failedDial(fmt.Errorf("invalid upstream proxy: %w", err))
 	}
-	if u.Scheme == "" || u.Scheme == "http" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":80"
-		}
-		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				resp, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
-			}
-			return c, nil
+	var tlsConfig *tls.Config
+	switch u.Scheme {
+	case "", "http":
+		u.Host = hostWithPort(u, "80")
+	case "https", "wss":
+		u.Host = hostWithPort(u, "443")
+		tlsConfig = proxy.Tr.TLSClientConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if u.User != nil {
+			auth = &xproxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		dialer, err := xproxy.SOCKS5("tcp", hostWithPort(u, "1080"), auth, dialerFunc(proxy.dial))
+		if err != nil {
+			return failedDial(err)
 		}
+		return dialer.(xproxy.ContextDialer).DialContext
+	default:
+		return failedDial(fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme))
 	}
-	if u.Scheme == "https" || u.Scheme == "wss" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":443"
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
 		}
-		return func(network, addr string) (net.Conn, error) {
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			c = tls.Client(c, proxy.Tr.TLSClientConfig)
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
-			}
-			return c, nil
+		if u.User != nil {
+			passwd, _ := u.User.Password()
+			connectReq.Header.Set("Proxy-Authorization", "Basic "+
+				base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+passwd)))
+		}
+		if connectReqHandler != nil {
+			connectReqHandler(connectReq)
+		}
+		c, err := proxy.dial(ctx, network, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			c = tls.Client(c, tlsConfig)
+		}
+		if err := connectReq.Write(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			c.Close()
+			return nil, err
 		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+			c.Close()
+			return nil, errors.New("proxy refused connection: " + resp.Status + " " + string(body))
+		}
+		if br.Buffered() > 0 {
+			// the server spoke first, as SMTP or SSH servers do
+			return &bufferedConn{Conn: c, r: br}, nil
+		}
+		return c, nil
+	}
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func failedDial(err error) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, err
 	}
-	return nil
+}
+
+// dialerFunc is a xproxy.ContextDialer.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// bufferedConn is a connection whose first bytes were read in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
 }
 
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
@@ -460,11 +688,20 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		config := defaultTLSConfig.Clone()
 		ctx.Logf("signing for %s", stripPort(host))
 
+		generated := false
 		genCert := func() (*tls.Certificate, error) {
+			generated = true
+			start := time.Now()
+			defer func() { certSignDuration.With().Observe(time.Since(start).Seconds()) }()
 			return signHost(*ca, []string{hostname})
 		}
 		if ctx.certStore != nil {
 			cert, err = ctx.certStore.Fetch(hostname, genCert)
+			if generated {
+				certCacheTotal.With("miss").Inc()
+			} else if err == nil {
+				certCacheTotal.With("hit").Inc()
+			}
 		} else {
 			cert, err = genCert()
 		}
@@ -0,0 +1,149 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/bandwidth"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/auth"
+)
+
+// newCert returns a certificate of name signed by parent, self-signed when nil, and its key.
+func newCert(name string, parent *tls.Certificate, t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeKeyPair(cert *tls.Certificate, certFile, keyFile string, t *testing.T) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newCert("ca", nil, t)
+	writeKeyPair(newCert("proxy.test", ca, t), certFile, keyFile, t)
+
+	keyPair, err := bandwidth.LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair.CheckInterval = time.Nanosecond
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	l, _, err := bandwidth.InterceptListenTLSConfig("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: keyPair.GetCertificate,
+		ClientCAs:      clientCAs,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var users []string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(auth.ClientCert(nil))
+	proxy.OnRequest().HandleConnect(auth.ClientCertConnect(nil))
+	auth.ProxyBasic(proxy, "test", func(req *http.Request, user, passwd string) bool {
+		return user == "user" && passwd == "secret"
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		users = append(users, ctx.User)
+		return req, nil
+	})
+	go http.Serve(l, proxy)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	proxyURL := &url.URL{Scheme: "https", Host: l.Addr().String()}
+	newClient := func(cert *tls.Certificate) *http.Client {
+		tr := &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "proxy.test"},
+		}
+		if cert != nil {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: tr}
+	}
+
+	resp, err := newClient(newCert("alice", ca, t)).Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("client certificate of alice: status %d, users %v", resp.StatusCode, users)
+	}
+
+	resp, err = newClient(nil).Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("no client certificate: status %d, want 407", resp.StatusCode)
+	}
+
+	// the certificate is renewed without restart
+	renewed := newCert("proxy.test", ca, t)
+	time.Sleep(10 * time.Millisecond)
+	writeKeyPair(renewed, certFile, keyFile, t)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "proxy.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Cmp(renewed.Leaf.SerialNumber) != 0 {
+		t.Error("certificate not reloaded")
+	}
+}
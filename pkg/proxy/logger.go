@@ -1,5 +1,129 @@
 package proxy
 
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is the classic printf style logger, as implemented by *log.Logger.
+// Use NewPrintfLogger to log the proxy events through it.
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
+
+// LogLevel is the severity of a log event. The values match the zap levels.
+type LogLevel int8
+
+const (
+	LevelDebug LogLevel = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int8(l))
+}
+
+// StructuredLogger receives the log events of the proxy. keysAndValues alternate
+// between string keys and arbitrary values, as with zap's SugaredLogger.Infow.
+type StructuredLogger interface {
+	// Enabled reports whether events of the given level are logged at all, so that
+	// callers can skip building expensive messages.
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// defaultLog is the Log of NewProxyHttpServer, logging through verbose when the
+// deprecated Verbose field of the proxy is set.
+type defaultLog struct {
+	StructuredLogger
+	verbose StructuredLogger
+}
+
+// logger returns the logger of the events of the proxy, according to the deprecated
+// Logger and Verbose fields.
+func (proxy *ProxyHttpServer) logger() StructuredLogger {
+	if proxy.Logger != nil {
+		if proxy.Verbose {
+			return printfLogger{proxy.Logger, LevelDebug}
+		}
+		return printfLogger{proxy.Logger, LevelWarn}
+	}
+	if d, ok := proxy.Log.(defaultLog); ok && proxy.Verbose {
+		return d.verbose
+	}
+	return proxy.Log
+}
+
+type zapLogger struct {
+	l *zap.SugaredLogger
+}
+
+// NewZapLogger returns a StructuredLogger logging through l, filtered by the level of l.
+func NewZapLogger(l *zap.SugaredLogger) StructuredLogger {
+	return zapLogger{l}
+}
+
+func (z zapLogger) Enabled(level LogLevel) bool {
+	return z.l.Desugar().Core().Enabled(zapcore.Level(level))
+}
+
+func (z zapLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	switch level {
+	case LevelDebug:
+		z.l.Debugw(msg, keysAndValues...)
+	case LevelInfo:
+		z.l.Infow(msg, keysAndValues...)
+	case LevelWarn:
+		z.l.Warnw(msg, keysAndValues...)
+	default:
+		z.l.Errorw(msg, keysAndValues...)
+	}
+}
+
+type printfLogger struct {
+	l   Logger
+	min LogLevel
+}
+
+// NewPrintfLogger returns a StructuredLogger writing events of at least level min to l,
+// one line per event with the key-value pairs appended as key=value.
+func NewPrintfLogger(l Logger, min LogLevel) StructuredLogger {
+	return printfLogger{l, min}
+}
+
+func (p printfLogger) Enabled(level LogLevel) bool {
+	return level >= p.min
+}
+
+func (p printfLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	if !p.Enabled(level) {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteString(": ")
+	sb.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&sb, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&sb, " %v", keysAndValues[i])
+		}
+	}
+	p.l.Printf("%s\n", sb.String())
+}
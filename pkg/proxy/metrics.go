@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+)
+
+// Modes used as the "mode" label of the proxy metrics.
+const (
+	modeHTTP     = "http"
+	modeConnect  = "connect"
+	modeMitm     = "mitm"
+	modeHTTPMitm = "http_mitm"
+	modeHijack   = "hijack"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("proxy_requests_total",
+		"Requests handled by the proxy, by method, status sent to the client and proxy mode.",
+		"method", "status", "mode")
+	upstreamDuration = metrics.NewHistogramVec("proxy_upstream_duration_seconds",
+		"Time spent waiting for the upstream server, up to the response headers or the established tunnel.",
+		nil, "mode")
+	activeTunnels = metrics.NewGaugeVec("proxy_active_tunnels",
+		"Currently open CONNECT tunnels, by proxy mode.",
+		"mode")
+	certCacheTotal = metrics.NewCounterVec("proxy_mitm_cert_cache_total",
+		"Lookups of MITM certificates in the certificate store, by result (hit or miss).",
+		"result")
+	certSignDuration = metrics.NewHistogramVec("proxy_mitm_cert_sign_duration_seconds",
+		"Time spent generating MITM certificates.",
+		nil)
+	dnsLookupDuration = metrics.NewHistogramVec("proxy_dns_lookup_duration_seconds",
+		"Time spent resolving the hosts of the upstream connections, by result (ok or error).",
+		nil, "result")
+	dialErrorsTotal = metrics.NewCounterVec("proxy_dial_errors_total",
+		"Failed dials to upstream servers, by error type.",
+		"type")
+)
+
+func observeRequest(method string, status int, mode string) {
+	requestsTotal.With(method, statusLabel(status), mode).Inc()
+}
+
+func observeUpstream(mode string, start time.Time) {
+	upstreamDuration.With(mode).Observe(time.Since(start).Seconds())
+}
+
+func observeLookup(err error, elapsed time.Duration) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	dnsLookupDuration.With(result).Observe(elapsed.Seconds())
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "none"
+	}
+	return strconv.Itoa(status)
+}
+
+// observeDialError counts err if it was caused by dialing an upstream server.
+// When dialing is true, err is known to come from a dial, and is counted even
+// if its type could not be determined.
+func observeDialError(err error, dialing bool) {
+	t := dialErrorType(err)
+	if t == "" && dialing {
+		t = "other"
+	}
+	if t != "" {
+		dialErrorsTotal.With(t).Inc()
+	}
+}
+
+// dialErrorType classifies a dial error, it returns the empty string if err
+// is not a dial error.
+func dialErrorType(err error) string {
+	if isForbidden(err) {
+		return "forbidden"
+	}
+	if errors.Is(err, ErrLoop) {
+		return "loop"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		return ""
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || opErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	}
+	return "other"
+}
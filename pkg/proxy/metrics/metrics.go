@@ -0,0 +1,419 @@
+// Package metrics implements a small set of Prometheus-compatible metric types
+// (counters, gauges and histograms, optionally partitioned by labels) and
+// serves them in the Prometheus text exposition format.
+//
+//	requests := metrics.NewCounterVec("app_requests_total", "Requests served.", "method")
+//	requests.With("GET").Inc()
+//	http.Handle("/metrics", metrics.Handler())
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets, tailored to measure latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the registry used by the package level constructors and by Handler.
+var DefaultRegistry = NewRegistry()
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type collector interface {
+	metricName() string
+	write(w io.Writer) error
+}
+
+// Registry holds a set of metric families, and writes them in the text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]collector{}}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := c.metricName()
+	if _, ok := r.collectors[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.collectors[name] = c
+}
+
+// WriteTo writes every registered metric to w, sorted by metric name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cs := make([]collector, len(names))
+	for i, name := range names {
+		cs[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	for _, c := range cs {
+		if err := c.write(cw); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ServeHTTP serves the registry in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Handler returns an http.Handler serving DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// NewCounterVec registers a new CounterVec in the registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec: newVec(name, help, counterType, labels)}
+	r.register(v)
+	return v
+}
+
+// NewGaugeVec registers a new GaugeVec in the registry.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec: newVec(name, help, gaugeType, labels)}
+	r.register(v)
+	return v
+}
+
+// NewHistogramVec registers a new HistogramVec in the registry. A nil buckets uses DefBuckets.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{vec: newVec(name, help, histogramType, labels), buckets: buckets}
+	r.register(v)
+	return v
+}
+
+// NewCounterVec registers a new CounterVec in DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+// NewGaugeVec registers a new GaugeVec in DefaultRegistry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+// NewHistogramVec registers a new HistogramVec in DefaultRegistry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    metricType
+	labels []string
+}
+
+func (d *desc) metricName() string { return d.name }
+
+func (d *desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+	return err
+}
+
+// vec keeps the children of a metric family, one per distinct label value tuple.
+type vec struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newVec(name, help string, typ metricType, labels []string) vec {
+	return vec{
+		desc:     desc{name: name, help: help, typ: typ, labels: labels},
+		children: map[string]interface{}{},
+		values:   map[string][]string{},
+	}
+}
+
+func (v *vec) child(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	c = create()
+	v.children[key] = c
+	v.values[key] = append([]string(nil), labelValues...)
+	return c
+}
+
+// each calls f for every child, in a stable order.
+func (v *vec) each(f func(labelValues []string, c interface{}) error) error {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.mu.RLock()
+		c, values := v.children[k], v.values[k]
+		v.mu.RUnlock()
+		if err := f(values, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *vec) labelString(values []string, extraName, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, l := range v.labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l + `="` + escapeLabel(values[i]) + `"`)
+	}
+	if extraName != "" {
+		if len(values) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extraName + `="` + escapeLabel(extraValue) + `"`)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits uint64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by v, which must not be negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	vec
+}
+
+// With returns the counter for the given label values, creating it if needed.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.child(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	return v.each(func(values []string, c interface{}) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(values, "", ""), formatFloat(c.(*Counter).Value()))
+		return err
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() { g.Add(1) }
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() { g.Add(-1) }
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64) { addFloat(&g.bits, v) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	vec
+}
+
+// With returns the gauge for the given label values, creating it if needed.
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.child(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	return v.each(func(values []string, c interface{}) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(values, "", ""), formatFloat(c.(*Gauge).Value()))
+		return err
+	})
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	addFloat(&h.sumBits, v)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// With returns the histogram for the given label values, creating it if needed.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.child(labelValues, func() interface{} {
+		return &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	return v.each(func(values []string, c interface{}) error {
+		h := c.(*Histogram)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, "le", formatFloat(upper)), cumulative); err != nil {
+				return err
+			}
+		}
+		count := h.Count()
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, "le", "+Inf"), count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelString(values, "", ""), formatFloat(h.Sum())); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelString(values, "", ""), count)
+		return err
+	})
+}
+
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(bits, old, n) {
+			return
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
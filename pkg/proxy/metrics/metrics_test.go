@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests\nserved.", "method", "code")
+	requests.With("GET", "200").Inc()
+	requests.With("GET", "200").Add(2)
+	requests.With("POST", `5"0\0`).Inc()
+	tunnels := r.NewGaugeVec("test_tunnels", "Open tunnels.")
+	tunnels.With().Inc()
+	tunnels.With().Inc()
+	tunnels.With().Dec()
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.1}, "mode")
+	latency.With("http").Observe(0.05)
+	latency.With("http").Observe(0.1)
+	latency.With("http").Observe(3)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{mode="http",le="0.1"} 2
+test_latency_seconds_bucket{mode="http",le="1"} 2
+test_latency_seconds_bucket{mode="http",le="+Inf"} 3
+test_latency_seconds_sum{mode="http"} 3.15
+test_latency_seconds_count{mode="http"} 3
+# HELP test_requests_total Requests\nserved.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 3
+test_requests_total{method="POST",code="5\"0\\0"} 1
+# HELP test_tunnels Open tunnels.
+# TYPE test_tunnels gauge
+test_tunnels 1
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").With().Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("unexpected content type", ct)
+	}
+	if !strings.Contains(w.Body.String(), "test_total 1\n") {
+		t.Error("counter missing from output", w.Body.String())
+	}
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("dup_total", "Dup.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on duplicate registration")
+		}
+	}()
+	r.NewGaugeVec("dup_total", "Dup.")
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("labels_total", "Labels.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on wrong label count")
+		}
+	}()
+	v.With("x")
+}
@@ -3,12 +3,17 @@ package proxy
 import (
 	"bufio"
 	"io"
-	"log"
 	"net"
 	"net/http"
-	"os"
 	"regexp"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/acentior/go-httpproxy/pkg/logging"
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -18,9 +23,15 @@ type ProxyHttpServer struct {
 	sess int64
 	// KeepDestinationHeaders indicates the proxy should retain any headers present in the http.Response before proxying
 	KeepDestinationHeaders bool
-	// setting Verbose to true will log information on each request sent to the proxy
+	// Log receives the log events of the proxy, filtered by their level. Debug events
+	// describe every step of every request. A nil Log disables logging
+	Log StructuredLogger
+	// Deprecated: set Log, to NewPrintfLogger(Logger, LevelWarn) for instance. A non-nil
+	// Logger receives the warnings and errors of the proxy instead of Log
+	Logger Logger
+	// Deprecated: set the level of Log. Verbose logs the debug events too, through
+	// Logger or the default Log of NewProxyHttpServer
 	Verbose         bool
-	Logger          Logger
 	NonproxyHandler http.Handler
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
@@ -31,7 +42,29 @@ type ProxyHttpServer struct {
 	ConnectDial        func(network string, addr string) (net.Conn, error)
 	ConnectDialWithReq func(req *http.Request, network string, addr string) (net.Conn, error)
 	CertStore          CertStorage
-	KeepHeader         bool
+	// Resolver resolves the hosts of the connections made by DialContext, the system
+	// resolver when nil
+	Resolver Resolver
+	// AddrPolicy restricts the addresses DialContext connects to for the clients, the
+	// connections to upstream proxies being allowed. The denied requests and tunnels are
+	// answered with 403 Forbidden. A nil AddrPolicy allows all the addresses
+	AddrPolicy *AddrPolicy
+	// Forwarding sets the Via, X-Forwarded-* and Forwarded headers of the requests
+	Forwarding Forwarding
+	// ListenAddrs are the addresses the proxy listens on, as ":8080". The requests to
+	// them, or to the local address of their connection, are rejected as loops
+	ListenAddrs []string
+	// KeepHeader forwards the Proxy-Authorization header of the clients, for an upstream
+	// proxy authenticating them. The other hop-by-hop headers are always removed
+	KeepHeader bool
+	// AccessLog, when set, receives a record of every transaction
+	AccessLog AccessLogger
+	// Tracer, when set, records spans for every transaction and propagates the
+	// trace context to upstream servers with the traceparent header
+	Tracer *tracing.Tracer
+
+	// clones of Tr by local address, see transport
+	boundTransports sync.Map
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -57,13 +90,21 @@ func isEof(r *bufio.Reader) bool {
 	return false
 }
 
+// filterRequest runs the request handlers until one returns a response, each one getting
+// the request returned by the previous one.
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
+	span := ctx.StartSpan("proxy.filterRequest")
+	defer span.End()
 	req = r
-	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(r, ctx)
+	for i, h := range proxy.reqHandlers {
+		hspan := span.Child("proxy.reqHandler", tracing.SpanKindInternal)
+		hspan.SetAttribute("proxy.handler.index", i)
+		req, resp = h.Handle(req, ctx)
+		hspan.End()
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
 		if resp != nil {
+			span.SetAttribute("proxy.short_circuit", i)
 			break
 		}
 	}
@@ -71,44 +112,20 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 }
 
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
+	span := ctx.StartSpan("proxy.filterResponse")
+	defer span.End()
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	for i, h := range proxy.respHandlers {
+		hspan := span.Child("proxy.respHandler", tracing.SpanKindInternal)
+		hspan.SetAttribute("proxy.handler.index", i)
 		ctx.Resp = resp
 		resp = h.Handle(resp, ctx)
+		hspan.End()
 	}
+	encodeBody(resp, ctx)
 	return
 }
 
-func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
-	r.RequestURI = "" // this must be reset when serving a request with the client
-	ctx.Logf("Sending request %v %v", r.Method, r.URL.String())
-	// If no Accept-Encoding header exists, Transport will add the headers it can accept
-	// and would wrap the response body with the relevant reader.
-	r.Header.Del("Accept-Encoding")
-	// curl can add that, see
-	// https://jdebp.eu./FGA/web-proxy-connection-header.html
-	r.Header.Del("Proxy-Connection")
-	r.Header.Del("Proxy-Authenticate")
-	r.Header.Del("Proxy-Authorization")
-	// Connection, Authenticate and Authorization are single hop Header:
-	// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
-	// 14.10 Connection
-	//   The Connection general-header field allows the sender to specify
-	//   options that are desired for that particular connection and MUST NOT
-	//   be communicated by proxies over further connections.
-
-	// When server reads http request it sets req.Close to true if
-	// "Connection" header contains "close".
-	// https://github.com/golang/go/blob/master/src/net/http/request.go#L1080
-	// Later, transfer.go adds "Connection: close" back when req.Close is true
-	// https://github.com/golang/go/blob/master/src/net/http/transfer.go#L275
-	// That's why tests that checks "Connection: close" removal fail
-	if r.Header.Get("Connection") == "close" {
-		r.Close = false
-	}
-	r.Header.Del("Connection")
-}
-
 type flushWriter struct {
 	w io.Writer
 }
@@ -125,7 +142,6 @@ func (fw flushWriter) Write(p []byte) (int, error) {
 
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// r.Header["X-Forwarded-For"] = w.RemoteAddr()
 	if r.Method == "CONNECT" {
 		proxy.handleHttps(w, r)
 	} else {
@@ -137,22 +153,52 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
+		status := 0
+		var written int64
+		rec := newAccessRecord(ctx, r, modeHTTP)
+		ctx.startTransaction("proxy.request", r, tracing.SpanContext{})
+		defer func() {
+			if rec != nil {
+				rec.BytesSent = written
+			}
+			ctx.logAccess(rec, status, nil)
+			observeRequest(r.Method, status, modeHTTP)
+			ctx.span.SetAttribute("http.status_code", status)
+			ctx.span.End()
+		}()
+		if proxy.isLoop(r) {
+			ctx.Warnf("Rejected request to %v: %v", r.URL, ErrLoop)
+			status = http.StatusLoopDetected
+			http.Error(w, ErrLoop.Error(), status)
+			return
+		}
 		r, resp := proxy.filterRequest(r, ctx)
+		if rec != nil {
+			rec.Cached = resp != nil
+		}
 
 		if resp == nil {
 			if isWebSocketRequest(r) {
 				ctx.Logf("Request looks like websocket upgrade.")
 				proxy.serveWebsocket(ctx, w, r)
+				status = http.StatusSwitchingProtocols
+				return
 			}
 
-			if !proxy.KeepHeader {
-				removeProxyHeaders(ctx, r)
-			}
+			// the forwarding headers are set once the headers the client listed as
+			// hop-by-hop are removed, so that it cannot remove them
+			proxy.removeProxyHeaders(ctx, r)
+			proxy.forwardHeaders(r)
+			start := time.Now()
 			resp, err = ctx.RoundTrip(r)
+			observeUpstream(modeHTTP, start)
 			if err != nil {
+				observeDialError(err, false)
 				ctx.Error = err
 				resp = proxy.filterResponse(nil, ctx)
 
+			} else {
+				removeHopHeaders(resp.Header, "")
 			}
 			if resp != nil {
 				ctx.Logf("Received response %v", resp.Status)
@@ -160,15 +206,18 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 
 		var origBody io.ReadCloser
+		var origLength string
 
 		if resp != nil {
 			origBody = resp.Body
+			origLength = resp.Header.Get("Content-Length")
 			defer origBody.Close()
 		}
 
 		resp = proxy.filterResponse(resp, ctx)
 
 		if resp == nil {
+			status = 500
 			var errorString string
 			if ctx.Error != nil {
 				errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
@@ -187,11 +236,14 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		// body the user returned.
 		// We keep the original body to remove the header only if things changed.
 		// This will prevent problems with HEAD requests where there's no body, yet,
-		// the Content-Length header should be set.
-		if origBody != resp.Body {
+		// the Content-Length header should be set. Handlers replacing the body with one
+		// of known length may set the header to the new length, which is then kept.
+		if origBody != resp.Body && resp.Header.Get("Content-Length") == origLength {
 			resp.Header.Del("Content-Length")
 		}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+		announceTrailers(w.Header(), resp)
+		status = resp.StatusCode
 		w.WriteHeader(resp.StatusCode)
 		var copyWriter io.Writer = w
 		if w.Header().Get("content-type") == "text/event-stream" {
@@ -200,17 +252,33 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 
 		nr, err := io.Copy(copyWriter, resp.Body)
+		written = nr
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
 		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+		if err != nil {
+			// the status may already be sent, abort the connection as
+			// httputil.ReverseProxy does, so that the client does not mistake the
+			// partial body for a complete one: returning would end a chunked body
+			// with its last chunk
+			panic(http.ErrAbortHandler)
+		}
+		for k, vs := range resp.Trailer {
+			w.Header()[http.TrailerPrefix+k] = vs
+		}
 	}
 }
 
-// NewProxyHttpServer creates and returns a proxy server, logging to stderr by default
+// NewProxyHttpServer creates and returns a proxy server, logging its warnings and errors
+// to stderr by default
 func NewProxyHttpServer() *ProxyHttpServer {
+	verbose := logging.NewStderrLogger(zapcore.DebugLevel)
 	proxy := ProxyHttpServer{
-		Logger:        log.New(os.Stderr, "", log.LstdFlags),
+		Log: defaultLog{
+			StructuredLogger: NewZapLogger(verbose.Desugar().WithOptions(zap.IncreaseLevel(zapcore.WarnLevel)).Sugar()),
+			verbose:          NewZapLogger(verbose),
+		},
 		reqHandlers:   []ReqHandler{},
 		respHandlers:  []RespHandler{},
 		httpsHandlers: []HttpsHandler{},
@@ -220,7 +288,23 @@ func NewProxyHttpServer() *ProxyHttpServer {
 		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
 	}
 
+	proxy.Tr.DialContext = proxy.DialContext
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 
 	return &proxy
 }
+
+// transport returns the Transport of the requests from the local address ip: Tr when
+// nil, else a clone of Tr, so that the idle connections from an address are not reused
+// by the requests to bind to another. The clones are made at the first request from
+// each address, the later changes of Tr not applying to them.
+func (proxy *ProxyHttpServer) transport(ip net.IP) *http.Transport {
+	if ip == nil {
+		return proxy.Tr
+	}
+	if tr, ok := proxy.boundTransports.Load(ip.String()); ok {
+		return tr.(*http.Transport)
+	}
+	tr, _ := proxy.boundTransports.LoadOrStore(ip.String(), proxy.Tr.Clone())
+	return tr.(*http.Transport)
+}
@@ -3,12 +3,19 @@ package proxy_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"net"
@@ -18,12 +25,18 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
+
 	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
 	goproxy_image "github.com/acentior/go-httpproxy/pkg/proxy/ext/image"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
 	// goproxy_image "github.com/acentior/go-httpproxy/internal/proxy/ext/image"
 )
 
@@ -391,6 +404,163 @@ func TestReplaceImage(t *testing.T) {
 	compareImage(panda, imgByFootballReq, t)
 }
 
+func TestAnimatedImage(t *testing.T) {
+	anim := &gif.GIF{LoopCount: 0}
+	for _, c := range []color.Color{color.White, color.Black, color.White} {
+		p := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.White, color.Black})
+		draw.Draw(p, p.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var animated bytes.Buffer
+	fatalOnErr(gif.EncodeAll(&animated, anim), "encode gif", t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.URL.Path == "/anim" {
+			w.Write(animated.Bytes())
+		} else {
+			io.WriteString(w, "not an image")
+		}
+	}))
+	defer upstream.Close()
+
+	frames := 0
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(goproxy_image.HandleImage(func(img image.Image, ctx *goproxy.ProxyCtx) image.Image {
+		frames++
+		return img
+	}))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(upstream.URL + "/anim")
+	fatalOnErr(err, "get anim", t)
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "image/gif" {
+		t.Errorf("Content-Type = %q, want image/gif", ct)
+	}
+	got, err := gif.DecodeAll(resp.Body)
+	fatalOnErr(err, "decode gif", t)
+	if frames != 3 || len(got.Image) != 3 || got.Delay[1] != 10 {
+		t.Errorf("handled %d frames, got %d frames with delays %v", frames, len(got.Image), got.Delay)
+	}
+	if r, _, _, _ := got.Image[1].At(4, 4).RGBA(); r != 0 {
+		t.Error("second frame is not black")
+	}
+
+	if body := string(getOrFail(upstream.URL+"/other", client, t)); body != "not an image" {
+		t.Errorf("non image body = %q", body)
+	}
+	if frames != 3 {
+		t.Error("handler called for a non image")
+	}
+
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(goproxy_image.HandleImageWith(goproxy_image.Options{MaxPixels: 8 * 8 * 2},
+		func(img image.Image, ctx *goproxy.ProxyCtx) image.Image {
+			t.Error("handler called for an image above the limit")
+			return img
+		}))
+	client, l2 := oneShotProxy(proxy, t)
+	defer l2.Close()
+	if body := getOrFail(upstream.URL+"/anim", client, t); !bytes.Equal(body, animated.Bytes()) {
+		t.Error("image above the limit was changed")
+	}
+}
+
+func TestAnimatedImageBomb(t *testing.T) {
+	// many large frames, small once compressed
+	frame := image.NewPaletted(image.Rect(0, 0, 500, 500), color.Palette{color.White, color.Black})
+	anim := &gif.GIF{}
+	for i := 0; i < 100; i++ {
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var bomb bytes.Buffer
+	fatalOnErr(gif.EncodeAll(&bomb, anim), "encode gif", t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(bomb.Bytes())
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(goproxy_image.HandleImageWith(goproxy_image.Options{MaxPixels: 500 * 500 * 10},
+		func(img image.Image, ctx *goproxy.ProxyCtx) image.Image {
+			t.Error("handler called for an image above the limit")
+			return img
+		}))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if body := getOrFail(upstream.URL+"/bomb", client, t); !bytes.Equal(body, bomb.Bytes()) {
+		t.Error("image above the limit was changed")
+	}
+	runtime.ReadMemStats(&after)
+	// decoding the frames would allocate their 25M pixels
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 10<<20 {
+		t.Errorf("%d bytes allocated for an image above the limit, its frames were decoded", allocated)
+	}
+}
+
+func TestRecompressImage(t *testing.T) {
+	large := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			large.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var original bytes.Buffer
+	fatalOnErr(jpeg.Encode(&original, large, &jpeg.Options{Quality: 95}), "encode jpeg", t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if r.URL.Path == "/no-transform" {
+			w.Header().Set("Cache-Control", "public, no-transform")
+		}
+		w.Write(original.Bytes())
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.User = "mobile"
+		return req, nil
+	})
+	(&goproxy_image.Recompressor{MaxDimension: 100}).Register(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(upstream.URL + "/image")
+	fatalOnErr(err, "get image", t)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	fatalOnErr(err, "read image", t)
+	if len(body) >= original.Len() {
+		t.Errorf("recompressed image of %d bytes, original of %d bytes", len(body), original.Len())
+	}
+	if h := resp.Header.Get(goproxy_image.OriginalLengthHeader); h != fmt.Sprint(original.Len()) {
+		t.Errorf("%s = %q, want %d", goproxy_image.OriginalLengthHeader, h, original.Len())
+	}
+	img, format, err := image.Decode(bytes.NewReader(body))
+	fatalOnErr(err, "decode image", t)
+	if format != "jpeg" || img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+		t.Errorf("got %s image of %v, want jpeg of 100x50", format, img.Bounds())
+	}
+
+	if body := getOrFail(upstream.URL+"/no-transform", client, t); !bytes.Equal(body, original.Bytes()) {
+		t.Error("image with Cache-Control: no-transform was changed")
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := fmt.Sprintf(`proxy_saved_bytes_total{user="mobile"} %d`, original.Len()-len(body))
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("metrics do not contain %s", expected)
+	}
+}
+
 func getCert(c *tls.Conn, t *testing.T) []byte {
 	if err := c.Handshake(); err != nil {
 		t.Fatal("cannot handshake", err)
@@ -462,7 +632,6 @@ func TestConnectHandler(t *testing.T) {
 
 func TestMitmIsFiltered(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
-	// proxy.Verbose = true
 	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
 	proxy.OnRequest(goproxy.UrlIs("/momo")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		return nil, goproxy.TextResponse(req, "koko")
@@ -497,6 +666,37 @@ func TestFirstHandlerMatches(t *testing.T) {
 	}
 }
 
+func TestHandlersChainRequests(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream "+r.Header.Get("X-Step"))
+	}))
+	defer site.Close()
+
+	// each handler gets the request returned by the previous one, a replaced request
+	// must neither be lost by the next handlers nor by their short-circuit response
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Step", "replaced")
+		return req, nil
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Path == "/short" {
+			return req, goproxy.TextResponse(req, "short "+req.Header.Get("X-Step"))
+		}
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if resp := string(getOrFail(site.URL+"/", client, t)); resp != "upstream replaced" {
+		t.Errorf("upstream got the request %q, want the replaced one", resp)
+	}
+	if resp := string(getOrFail(site.URL+"/short", client, t)); resp != "short replaced" {
+		t.Errorf("short-circuiting handler got the request %q, want the replaced one", resp)
+	}
+}
+
 func constantHttpServer(content []byte) (addr string) {
 	l, err := net.Listen("tcp", "localhost:0")
 	panicOnErr(err, "listen")
@@ -517,7 +717,7 @@ func TestIcyResponse(t *testing.T) {
 	// TODO: fix this test
 	/*s := constantHttpServer([]byte("ICY 200 OK\r\n\r\nblablabla"))
 	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = true
+	proxy.Log = goproxy.NewPrintfLogger(log.Default(), goproxy.LevelDebug)
 	_, l := oneShotProxy(proxy, t)
 	defer l.Close()
 	req, err := http.NewRequest("GET", "http://"+s, nil)
@@ -647,6 +847,33 @@ func TestChunkedResponse(t *testing.T) {
 	}
 }
 
+func TestTruncatedResponse(t *testing.T) {
+	// the upstream closes the connection in the middle of a chunked body
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, buf, err := w.(http.Hijacker).Hijack()
+		panicOnErr(err, "hijack")
+		defer c.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nparti\r\n")
+		buf.Flush()
+	}))
+	defer site.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	// the status may be sent before the body fails, the client must then see the
+	// body fail too and not take the part received for the whole body
+	resp, err := client.Get(site.URL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("truncated body %q received as complete", b)
+	}
+}
+
 func TestGoproxyThroughProxy(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy2 := goproxy.NewProxyHttpServer()
@@ -1012,3 +1239,297 @@ func TestResponseContentLength(t *testing.T) {
 		t.Fatalf("Wrong response Content-Length.")
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs("blocked.example:443")).HandleConnect(goproxy.AlwaysReject)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	getOrFail(https.URL+"/bobo", client, t)
+	if _, err := client.Get("https://blocked.example/"); err == nil {
+		t.Error("CONNECT to blocked.example should fail")
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		`proxy_requests_total{method="GET",status="200",mode="http"}`,
+		`proxy_requests_total{method="CONNECT",status="200",mode="connect"}`,
+		`proxy_requests_total{method="CONNECT",status="none",mode="connect"}`,
+		`proxy_upstream_duration_seconds_count{mode="http"}`,
+		`proxy_active_tunnels{mode="connect"}`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("metrics do not contain %s:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var spans bytes.Buffer
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tracer = tracing.NewTracer("proxy", tracing.NewStdoutExporter(&spans))
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, nil
+	})
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+	}))
+	defer upstream.Close()
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set("Traceparent", incoming)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	getOrFail(https.URL+"/bobo", client, t)
+	proxy.Tracer.Shutdown()
+
+	sc, ok := tracing.ParseTraceparent(upstreamTraceparent)
+	if !ok || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Error("trace context not propagated upstream:", upstreamTraceparent)
+	}
+	names := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		var span struct{ Name string }
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatal(err, line)
+		}
+		names[span.Name] = true
+	}
+	for _, name := range []string{"proxy.request", "proxy.filterRequest", "proxy.reqHandler", "proxy.roundTrip",
+		"proxy.dial", "proxy.filterResponse", "proxy.connect", "proxy.tls.client", "proxy.mitm.request"} {
+		if !names[name] {
+			t.Errorf("span %s was not recorded, got %v", name, names)
+		}
+	}
+}
+
+type logEvent struct {
+	level  goproxy.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	mu     sync.Mutex
+	min    goproxy.LogLevel
+	events []logEvent
+}
+
+func (l *recordingLogger) Enabled(level goproxy.LogLevel) bool { return level >= l.min }
+
+func (l *recordingLogger) Log(level goproxy.LogLevel, msg string, keysAndValues ...interface{}) {
+	fields := map[string]interface{}{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, logEvent{level, msg, fields})
+}
+
+func TestStructuredLog(t *testing.T) {
+	rec := &recordingLogger{min: goproxy.LevelInfo}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Log = rec
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.User = "alice"
+		ctx.Logf("filtered out %d", 1)
+		ctx.Warnf("warning %d", 2)
+		ctx.Infow("structured", "key", "value")
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	getOrFail(srv.URL+"/bobo", client, t)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var warn, info *logEvent
+	for i, e := range rec.events {
+		if e.level < goproxy.LevelInfo {
+			t.Error("debug event not filtered", e.msg)
+		}
+		switch e.msg {
+		case "warning 2":
+			warn = &rec.events[i]
+		case "structured":
+			info = &rec.events[i]
+		}
+	}
+	if warn == nil || warn.level != goproxy.LevelWarn || info == nil || info.level != goproxy.LevelInfo {
+		t.Fatalf("expected events not logged: %+v", rec.events)
+	}
+	if _, ok := warn.fields["session"].(int64); !ok || warn.fields["user"] != "alice" ||
+		warn.fields["host"] != srv.Listener.Addr().String() {
+		t.Error("unexpected fields", warn.fields)
+	}
+	if info.fields["key"] != "value" {
+		t.Error("key-value pairs not passed", info.fields)
+	}
+}
+
+// printfRecorder is a Logger recording the messages it prints.
+type printfRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *printfRecorder) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *printfRecorder) printed(msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeprecatedLogger(t *testing.T) {
+	rec := &printfRecorder{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = rec
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Logf("step of %s", req.URL.Path)
+		ctx.Warnf("warning of %s", req.URL.Path)
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/quiet", client, t)
+	if !rec.printed("warning of /quiet") || rec.printed("step of /quiet") {
+		t.Errorf("Logger without Verbose printed %q, want only the warning", rec.lines)
+	}
+	proxy.Verbose = true
+	getOrFail(srv.URL+"/verbose", client, t)
+	if !rec.printed("warning of /verbose") || !rec.printed("step of /verbose") {
+		t.Errorf("Logger with Verbose printed %q, want the step and the warning", rec.lines)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	const content = "hello encoded world"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.URL.Query().Get("enc")
+		var buf bytes.Buffer
+		var wc io.WriteCloser
+		switch enc {
+		case "gzip":
+			wc = gzip.NewWriter(&buf)
+		case "deflate":
+			wc = zlib.NewWriter(&buf)
+		case "br":
+			wc = brotli.NewWriter(&buf)
+		}
+		io.WriteString(wc, content)
+		wc.Close()
+		w.Header().Set("Content-Encoding", enc)
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.UrlMatches(regexp.MustCompile("/upper"))).Do(goproxy.HandleBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return bytes.ToUpper(b)
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyUrl, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableCompression: true}}
+
+	fetch := func(path, accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp, readAll(resp.Body, t)
+	}
+	decode := func(enc string, b []byte) string {
+		var r io.Reader = bytes.NewReader(b)
+		switch enc {
+		case "gzip":
+			gr, err := gzip.NewReader(r)
+			fatalOnErr(err, "gzip.NewReader", t)
+			r = gr
+		case "deflate":
+			zr, err := zlib.NewReader(r)
+			fatalOnErr(err, "zlib.NewReader", t)
+			r = zr
+		case "br":
+			r = brotli.NewReader(r)
+		}
+		return string(readAll(r, t))
+	}
+
+	resp, b := fetch("/plain?enc=gzip", "gzip")
+	if resp.Header.Get("X-Accept-Encoding") != "gzip" {
+		t.Error("Accept-Encoding not forwarded", resp.Header.Get("X-Accept-Encoding"))
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.ContentLength < 0 || decode("gzip", b) != content {
+		t.Error("untouched body not passed through compressed", resp.Header, resp.ContentLength)
+	}
+	for _, enc := range []string{"gzip", "deflate", "br"} {
+		resp, b := fetch("/upper?enc="+enc, "gzip, deflate, br")
+		if resp.Header.Get("Content-Encoding") != enc || decode(enc, b) != strings.ToUpper(content) {
+			t.Errorf("%s: body not re-encoded, got %v %q", enc, resp.Header, b)
+		}
+	}
+	resp, b = fetch("/upper?enc=br", "gzip;q=1, br;q=0")
+	if resp.Header.Get("Content-Encoding") != "" || string(b) != strings.ToUpper(content) {
+		t.Errorf("body should be decoded for a client not accepting br, got %v %q", resp.Header, b)
+	}
+
+	// requests MITM'd in cleartext: the Accept-Encoding of the request applies, not the
+	// one of the CONNECT request
+	mitm := goproxy.NewProxyHttpServer()
+	mitm.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	}))
+	mitm.OnResponse().Do(goproxy.HandleBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return bytes.ToUpper(b)
+	}))
+	_, ml := oneShotProxy(mitm, t)
+	defer ml.Close()
+	c, err := net.Dial("tcp", ml.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer c.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	io.WriteString(c, "GET /upper?enc=gzip HTTP/1.1\r\nHost: "+host+"\r\nAccept-Encoding: gzip\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	fatalOnErr(err, "read MITM response", t)
+	b = readAll(resp.Body, t)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || decode("gzip", b) != strings.ToUpper(content) {
+		t.Errorf("MITM'd body not re-encoded, got %v %q", resp.Header, b)
+	}
+}
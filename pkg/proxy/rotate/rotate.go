@@ -0,0 +1,219 @@
+// Package rotate provides an io.WriteCloser writing to a file that is rotated once it
+// grows too large or gets too old. Rotated files are renamed with a timestamp suffix,
+// access.log becomes access-20060102T150405.000000000.log.
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000000000"
+
+// File is a rotating log file. Every Write is treated as one record; records are never
+// split across files. The zero value is not usable, Path must be set.
+type File struct {
+	// Path of the current file
+	Path string
+	// MaxSize rotates the file before it grows beyond MaxSize bytes, 0 disables size rotation
+	MaxSize int64
+	// Interval rotates the file when the current time crosses a multiple of Interval,
+	// for example every hour or every day. 0 disables time rotation
+	Interval time.Duration
+	// MaxBackups is the number of rotated files to keep, 0 keeps all of them
+	MaxBackups int
+	// Header and Footer are written at the beginning and at the end of every file
+	Header, Footer []byte
+	// Separator is written between two records of the same file
+	Separator []byte
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	records int
+	period  time.Time
+	// now is replaced by tests
+	now func() time.Time
+}
+
+// New returns a File rotating path when it grows over maxSize bytes.
+func New(path string, maxSize int64) *File {
+	return &File{Path: path, MaxSize: maxSize}
+}
+
+func (f *File) timeNow() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+func (f *File) currentPeriod(t time.Time) time.Time {
+	if f.Interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.Interval)
+}
+
+// Write writes p as a single record, rotating the file first if needed.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	extra := int64(len(p) + len(f.Footer))
+	if f.records > 0 {
+		extra += int64(len(f.Separator))
+	}
+	if f.records > 0 && (f.MaxSize > 0 && f.size+extra > f.MaxSize ||
+		!f.currentPeriod(f.timeNow()).Equal(f.period)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if f.records > 0 && len(f.Separator) > 0 {
+		if err := f.write(f.Separator); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.write(p); err != nil {
+		return 0, err
+	}
+	f.records++
+	return len(p), nil
+}
+
+func (f *File) write(p []byte) error {
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+// open opens the current file for appending. Files with a header cannot be appended
+// to, so an existing non-empty one is rotated away first.
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(f.Path); err == nil && info.Size() > 0 && len(f.Header) > 0 {
+		if err := f.backup(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f = file
+	f.size = info.Size()
+	f.records = 0
+	if f.size > 0 {
+		// appending to a previous file, whose records need separating
+		f.records = 1
+	}
+	f.period = f.currentPeriod(f.timeNow())
+	if f.size == 0 && len(f.Header) > 0 {
+		return f.write(f.Header)
+	}
+	return nil
+}
+
+func (f *File) closeFile() error {
+	if f.f == nil {
+		return nil
+	}
+	var err error
+	if len(f.Footer) > 0 {
+		err = f.write(f.Footer)
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	f.f = nil
+	return err
+}
+
+func (f *File) backupPattern() (prefix, ext string) {
+	ext = filepath.Ext(f.Path)
+	return strings.TrimSuffix(f.Path, ext) + "-", ext
+}
+
+// backup renames the current file, and removes the backups beyond MaxBackups.
+func (f *File) backup() error {
+	prefix, ext := f.backupPattern()
+	name := prefix + f.timeNow().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.Path, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the rotated files, oldest first.
+func (f *File) Backups() ([]string, error) {
+	prefix, ext := f.backupPattern()
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	backups := matches[:0]
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *File) rotate() error {
+	if err := f.closeFile(); err != nil {
+		return err
+	}
+	if err := f.backup(); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Rotate closes the current file, renames it, and starts a new one.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	return f.rotate()
+}
+
+// Close writes the footer and closes the current file. A later Write reopens it.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closeFile()
+}
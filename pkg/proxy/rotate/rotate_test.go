@@ -0,0 +1,86 @@
+package rotate
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSizeRotation(t *testing.T) {
+	dir := t.TempDir()
+	f := New(filepath.Join(dir, "access.log"), 10)
+	f.MaxBackups = 2
+	for _, rec := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		if _, err := f.Write([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	if b, _ := ioutil.ReadFile(backups[1]); string(b) != "eeee\nffff\n" {
+		t.Errorf("unexpected last backup %q", b)
+	}
+	if b, _ := ioutil.ReadFile(f.Path); string(b) != "gggg\n" {
+		t.Errorf("unexpected current file %q", b)
+	}
+}
+
+func TestIntervalRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 1, 10, 59, 0, 0, time.UTC)
+	f := &File{Path: filepath.Join(dir, "access.log"), Interval: time.Hour, now: func() time.Time { return now }}
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	now = now.Add(2 * time.Minute)
+	f.Write([]byte("third\n"))
+	f.Close()
+	backups, _ := f.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v", backups)
+	}
+	if b, _ := ioutil.ReadFile(backups[0]); string(b) != "first\nsecond\n" {
+		t.Errorf("unexpected backup %q", b)
+	}
+	if b, _ := ioutil.ReadFile(f.Path); string(b) != "third\n" {
+		t.Errorf("unexpected current file %q", b)
+	}
+}
+
+func TestHeaderFooterSeparator(t *testing.T) {
+	dir := t.TempDir()
+	f := &File{Path: filepath.Join(dir, "out.json"), MaxSize: 20,
+		Header: []byte("["), Footer: []byte("]"), Separator: []byte(",")}
+	for _, rec := range []string{"1111", "2222", "3333", "4444", "5555"} {
+		f.Write([]byte(rec))
+	}
+	f.Close()
+	// reopening a complete file starts a new one
+	f.Write([]byte("6666"))
+	f.Close()
+	backups, _ := f.Backups()
+	var contents []string
+	for _, b := range backups {
+		c, _ := ioutil.ReadFile(b)
+		contents = append(contents, string(c))
+	}
+	c, _ := ioutil.ReadFile(f.Path)
+	contents = append(contents, string(c))
+	expected := []string{"[1111,2222,3333]", "[4444,5555]", "[6666]"}
+	if len(contents) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, contents)
+	}
+	for i := range expected {
+		if contents[i] != expected[i] {
+			t.Errorf("file %d: expected %q, got %q", i, expected[i], contents[i])
+		}
+	}
+}
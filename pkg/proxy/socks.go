@@ -0,0 +1,521 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS protocol constants, RFC 1928, RFC 1929 and SOCKS4(a).
+const (
+	socks4Version = 4
+	socks5Version = 5
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NotAllowed          = 2
+	socks5HostUnreachable     = 4
+	socks5CommandNotSupported = 7
+	socks5AddressNotSupported = 8
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// socksHandshakeTimeout bounds the negotiation of SOCKS clients, up to their command.
+const socksHandshakeTimeout = 30 * time.Second
+
+var errSocksAddress = errors.New("socks: unsupported address type")
+
+// SocksServer serves SOCKS5, SOCKS4 and SOCKS4a clients through the handlers of Proxy.
+// Their CONNECT commands are turned into CONNECT requests, served by ServeTunnel, so
+// that the CONNECT handlers accept, reject, MITM or hijack them as other tunnels.
+// The credentials of the clients are passed to the handlers in a Proxy-Authorization
+// header, so that the same authentication handlers apply.
+type SocksServer struct {
+	Proxy *ProxyHttpServer
+	// Authenticate checks the username and password of SOCKS5 clients, or the user ID
+	// of SOCKS4 clients with an empty password, req being the CONNECT request of the
+	// client without host. SOCKS5 clients must then authenticate. When nil, clients
+	// may connect without credentials, which are left to the CONNECT handlers.
+	Authenticate func(req *http.Request, user, passwd string) bool
+	// UDP enables the UDP ASSOCIATE command of SOCKS5. The datagrams are relayed to
+	// the destinations accepted by the CONNECT handlers.
+	UDP bool
+}
+
+// Serve serves the SOCKS clients connecting to l, until l fails.
+func (s *SocksServer) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn serves the SOCKS client of c, and closes c.
+func (s *SocksServer) ServeConn(c net.Conn) {
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	r := bufio.NewReader(c)
+	version, err := r.ReadByte()
+	if err != nil {
+		c.Close()
+		return
+	}
+	switch version {
+	case socks5Version:
+		err = s.serve5(c, r)
+	case socks4Version:
+		err = s.serve4(c, r)
+	default:
+		err = fmt.Errorf("socks: unknown version %d", version)
+	}
+	if err != nil {
+		ctx := &ProxyCtx{Proxy: s.Proxy}
+		ctx.Warnf("SOCKS client %s: %v", c.RemoteAddr(), err)
+		c.Close()
+	}
+}
+
+func newSocksRequest(c net.Conn, user, passwd string, credentials bool) *http.Request {
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	if credentials {
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+passwd)))
+	}
+	return req
+}
+
+func setSocksTarget(req *http.Request, host string) {
+	req.URL.Host, req.Host, req.RequestURI = host, host, host
+}
+
+// tunnel serves the CONNECT request of c through the CONNECT handlers, reply writing
+// the SOCKS reply for the status of the CONNECT response.
+func (s *SocksServer) tunnel(c net.Conn, r *bufio.Reader, req *http.Request, reply func(status int) error) error {
+	c.SetDeadline(time.Time{})
+	s.Proxy.ServeTunnel(&socksConn{Conn: c, r: r, reply: reply}, req)
+	return nil
+}
+
+func (s *SocksServer) serve5(c net.Conn, r *bufio.Reader) error {
+	// VER NMETHODS METHODS, the version being read
+	n, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	method := byte(socksAuthNoAcceptable)
+	switch {
+	// credentials are preferred, so that they reach the handlers
+	case bytes.IndexByte(methods, socksAuthPassword) >= 0:
+		method = socksAuthPassword
+	case bytes.IndexByte(methods, socksAuthNone) >= 0 && s.Authenticate == nil:
+		method = socksAuthNone
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	var user, passwd string
+	switch method {
+	case socksAuthNoAcceptable:
+		return errors.New("socks: no acceptable authentication method")
+	case socksAuthPassword:
+		// VER ULEN UNAME PLEN PASSWD
+		if v, err := r.ReadByte(); err != nil || v != 1 {
+			return fmt.Errorf("socks: invalid authentication version %d: %v", v, err)
+		}
+		if user, err = readSocks5String(r); err != nil {
+			return err
+		}
+		if passwd, err = readSocks5String(r); err != nil {
+			return err
+		}
+	}
+	req := newSocksRequest(c, user, passwd, method == socksAuthPassword)
+	if method == socksAuthPassword {
+		status := byte(0)
+		if s.Authenticate != nil && !s.Authenticate(req, user, passwd) {
+			status = 1
+		}
+		if _, err := c.Write([]byte{1, status}); err != nil {
+			return err
+		}
+		if status != 0 {
+			return fmt.Errorf("socks: authentication of %q failed", user)
+		}
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("socks: invalid request version %d", hdr[0])
+	}
+	host, err := readSocks5Addr(r)
+	if err == errSocksAddress {
+		writeSocks5Reply(c, socks5AddressNotSupported, nil)
+		return err
+	} else if err != nil {
+		return err
+	}
+	setSocksTarget(req, host)
+	switch {
+	case hdr[1] == socksCmdConnect:
+		return s.tunnel(c, r, req, func(status int) error {
+			return writeSocks5Reply(c, socks5Code(status), nil)
+		})
+	case hdr[1] == socksCmdUDPAssociate && s.UDP:
+		return s.associate(c, r, req)
+	default:
+		writeSocks5Reply(c, socks5CommandNotSupported, nil)
+		return fmt.Errorf("socks: unsupported command %d", hdr[1])
+	}
+}
+
+func (s *SocksServer) serve4(c net.Conn, r *bufio.Reader) error {
+	// VN CD DSTPORT DSTIP USERID NULL [DOMAIN NULL], the version being read
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	userID, err := readSocks4String(r)
+	if err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(hdr[1:3])
+	ip := net.IP(hdr[3:7])
+	host := ip.String()
+	// SOCKS4a: 0.0.0.x, x not 0, is followed by the domain name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readSocks4String(r); err != nil {
+			return err
+		}
+	}
+	reply := func(status int) error {
+		code := byte(socks4Rejected)
+		if status/100 == 2 {
+			code = socks4Granted
+		}
+		_, err := c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	req := newSocksRequest(c, userID, "", userID != "")
+	if s.Authenticate != nil && !s.Authenticate(req, userID, "") {
+		reply(http.StatusProxyAuthRequired)
+		return fmt.Errorf("socks: authentication of %q failed", userID)
+	}
+	if hdr[0] != socksCmdConnect {
+		reply(http.StatusNotImplemented)
+		return fmt.Errorf("socks: unsupported command %d", hdr[0])
+	}
+	setSocksTarget(req, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	return s.tunnel(c, r, req, reply)
+}
+
+func readSocks5String(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func readSocks4String(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == 255 {
+			return "", errors.New("socks: string too long")
+		}
+		b = append(b, c)
+	}
+}
+
+// readSocks5Addr reads ATYP DST.ADDR DST.PORT, and returns them as host:port.
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", errSocksAddress
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSocks5Addr appends ATYP BND.ADDR BND.PORT of addr, 0.0.0.0:0 when nil.
+func appendSocks5Addr(b []byte, addr *net.UDPAddr) []byte {
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(append(b, socksAtypIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAtypIPv6), addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+func writeSocks5Reply(c net.Conn, code byte, bound *net.UDPAddr) error {
+	_, err := c.Write(appendSocks5Addr([]byte{socks5Version, code, 0}, bound))
+	return err
+}
+
+// socks5Code returns the SOCKS5 reply for the status of a CONNECT response.
+func socks5Code(status int) byte {
+	switch {
+	case status/100 == 2:
+		return socks5Succeeded
+	case status == http.StatusForbidden || status == http.StatusProxyAuthRequired:
+		return socks5NotAllowed
+	case status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
+
+// socksConn is the connection of a SOCKS client, translating the HTTP response to its
+// CONNECT request into a SOCKS reply. The body of a failure response is dropped.
+type socksConn struct {
+	net.Conn
+	r     *bufio.Reader
+	reply func(status int) error
+
+	mu      sync.Mutex
+	header  []byte
+	replied bool
+	failed  bool
+}
+
+func (c *socksConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *socksConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed {
+		return len(p), nil
+	}
+	if c.replied {
+		return c.Conn.Write(p)
+	}
+	c.header = append(c.header, p...)
+	end := bytes.Index(c.header, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(c.header) > 64<<10 {
+			return 0, errors.New("socks: CONNECT response header too large")
+		}
+		return len(p), nil
+	}
+	status := 0
+	if fields := strings.Fields(string(c.header[:bytes.IndexByte(c.header, '\n')])); len(fields) > 1 {
+		status, _ = strconv.Atoi(fields[1])
+	}
+	rest := c.header[end+4:]
+	c.header, c.replied = nil, true
+	if err := c.reply(status); err != nil {
+		return 0, err
+	}
+	if status/100 != 2 {
+		c.failed = true
+		return len(p), nil
+	}
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close replies to the client if the CONNECT request was not answered, as when it is
+// rejected without response.
+func (c *socksConn) Close() error {
+	c.mu.Lock()
+	if !c.replied {
+		c.replied = true
+		c.reply(http.StatusForbidden)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// associate serves the UDP ASSOCIATE command of the SOCKS5 client of c, relaying its
+// datagrams until c is closed.
+func (s *SocksServer) associate(c net.Conn, r *bufio.Reader, req *http.Request) error {
+	// the relay listens on the address the client connected to
+	host, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		writeSocks5Reply(c, socks5GeneralFailure, nil)
+		return err
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSocks5Reply(c, socks5GeneralFailure, nil)
+		return err
+	}
+	defer pc.Close()
+	if err := writeSocks5Reply(c, socks5Succeeded, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	clientIP := net.ParseIP(stripPort(c.RemoteAddr().String()))
+	go s.relay(pc, clientIP, req)
+	// the association lasts as long as the connection
+	io.Copy(ioutil.Discard, r)
+	c.Close()
+	return nil
+}
+
+// relay relays the datagrams of the client at clientIP, and their replies.
+func (s *SocksServer) relay(pc net.PacketConn, clientIP net.IP, req *http.Request) {
+	var client net.Addr
+	// allowed are the destinations accepted by the CONNECT handlers
+	allowed := map[string]*net.UDPAddr{}
+	sources := map[string]bool{}
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		fromUDP, _ := from.(*net.UDPAddr)
+		if fromUDP != nil && fromUDP.IP.Equal(clientIP) && (client == nil || client.String() == from.String()) {
+			client = from
+			// RSV FRAG ATYP DST.ADDR DST.PORT DATA, fragments are not supported
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			rd := bytes.NewReader(buf[3:n])
+			dst, err := readSocks5Addr(rd)
+			if err != nil {
+				continue
+			}
+			addr, ok := allowed[dst]
+			if !ok {
+				addr = s.allowUDP(req, dst)
+				allowed[dst] = addr
+			}
+			if addr == nil {
+				continue
+			}
+			sources[addr.String()] = true
+			pc.WriteTo(buf[n-rd.Len():n], addr)
+		} else if client != nil && sources[from.String()] {
+			b := appendSocks5Addr([]byte{0, 0, 0}, fromUDP)
+			pc.WriteTo(append(b, buf[:n]...), client)
+		}
+	}
+}
+
+// allowUDP returns the address of dst if the CONNECT handlers accept it, nil otherwise.
+func (s *SocksServer) allowUDP(req *http.Request, dst string) *net.UDPAddr {
+	r := *req
+	r.URL = &url.URL{}
+	setSocksTarget(&r, dst)
+	proxy := s.Proxy
+	ctx := &ProxyCtx{Req: &r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	todo, host := proxy.connectAction(dst, ctx)
+	switch todo.Action {
+	case ConnectReject, ConnectHijack, ConnectProxyAuthHijack:
+		ctx.Logf("UDP datagrams to %s rejected", dst)
+		return nil
+	}
+	h, port, err := net.SplitHostPort(host)
+	var ips []net.IP
+	if err == nil {
+		ips, err = proxy.lookupIP(proxyContext(context.Background(), ctx, host), "ip", h)
+	}
+	var p int
+	if err == nil {
+		p, err = net.LookupPort("udp", port)
+	}
+	if err != nil {
+		ctx.Warnf("Cannot resolve UDP destination %s: %v", host, err)
+		return nil
+	}
+	for _, ip := range ips {
+		if proxy.AddrPolicy.Allowed(ip) {
+			addr := &net.UDPAddr{IP: ip, Port: p}
+			ctx.Logf("Relaying UDP datagrams to %s", addr)
+			return addr
+		}
+	}
+	ctx.Warnf("Denied %v", &ForbiddenAddrError{Host: h, IP: ips[0]})
+	return nil
+}
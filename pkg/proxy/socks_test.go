@@ -0,0 +1,243 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/bandwidth"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/auth"
+	xproxy "golang.org/x/net/proxy"
+)
+
+func socksServer(s *goproxy.SocksServer, t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l
+}
+
+func socksClient(addr string, auth *xproxy.Auth, t *testing.T) *http.Client {
+	dialer, err := xproxy.SOCKS5("tcp", addr, auth, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Dial:            dialer.Dial,
+		TLSClientConfig: acceptAllCerts,
+	}}
+}
+
+func TestSocks5(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs(srv.Listener.Addr().String())).HandleConnect(goproxy.AlwaysReject)
+	var users []string
+	proxy.OnRequest().HandleConnect(auth.BasicConnect("socks", func(req *http.Request, user, passwd string) bool {
+		users = append(users, user)
+		return passwd == "secret"
+	}))
+	l := socksServer(&goproxy.SocksServer{Proxy: proxy}, t)
+	defer l.Close()
+
+	client := socksClient(l.Addr().String(), &xproxy.Auth{User: "alice", Password: "secret"}, t)
+	if body := string(getOrFail(https.URL+"/bobo", client, t)); body != "bobo" {
+		t.Errorf("body = %q, want bobo", body)
+	}
+	if len(users) == 0 || users[0] != "alice" {
+		t.Errorf("CONNECT handlers saw users %v, want alice", users)
+	}
+	if _, err := client.Get(srv.URL + "/bobo"); err == nil {
+		t.Error("rejected CONNECT should fail")
+	}
+
+	client = socksClient(l.Addr().String(), &xproxy.Auth{User: "alice", Password: "wrong"}, t)
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("CONNECT with wrong password should fail")
+	}
+}
+
+func TestSocks5Authenticate(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	l := socksServer(&goproxy.SocksServer{Proxy: proxy, Authenticate: func(req *http.Request, user, passwd string) bool {
+		return user == "bob" && passwd == "secret"
+	}}, t)
+	defer l.Close()
+
+	client := socksClient(l.Addr().String(), &xproxy.Auth{User: "bob", Password: "secret"}, t)
+	if body := string(getOrFail(https.URL+"/bobo", client, t)); body != "bobo" {
+		t.Errorf("body = %q, want bobo", body)
+	}
+	for _, a := range []*xproxy.Auth{nil, {User: "bob", Password: "wrong"}} {
+		client = socksClient(l.Addr().String(), a, t)
+		if _, err := client.Get(https.URL + "/bobo"); err == nil {
+			t.Errorf("SOCKS client with credentials %v should fail", a)
+		}
+	}
+}
+
+func TestSocks4a(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	l := socksServer(&goproxy.SocksServer{Proxy: proxy}, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	req := []byte{4, 1, 0, 0, 0, 0, 0, 1}
+	var p uint16
+	for _, d := range port {
+		p = p*10 + uint16(d-'0')
+	}
+	binary.BigEndian.PutUint16(req[2:4], p)
+	req = append(req, "user\x00localhost\x00"...)
+	// the request follows the command without waiting for the reply
+	req = append(req, "GET /bobo HTTP/1.0\r\nHost: localhost\r\n\r\n"...)
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x5a {
+		t.Fatalf("SOCKS4 reply %x, want granted", reply[1])
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "bobo" {
+		t.Errorf("body = %q, want bobo", body)
+	}
+}
+
+func TestSocks5UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs("blocked.example:53")).HandleConnect(goproxy.AlwaysReject)
+	l := socksServer(&goproxy.SocksServer{Proxy: proxy, UDP: true}, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	c.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(r, method); err != nil || method[1] != 0 {
+		t.Fatalf("method %v %v", method, err)
+	}
+	c.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(r, reply); err != nil || reply[1] != 0 || reply[3] != 1 {
+		t.Fatalf("UDP ASSOCIATE reply %v %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+
+	uc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+	dst := echo.LocalAddr().(*net.UDPAddr)
+	blocked := append([]byte{0, 0, 0, 3, byte(len("blocked.example"))}, "blocked.example"...)
+	uc.Write(append(blocked, 0, 53, 'n', 'o'))
+	datagram := append([]byte{0, 0, 0, 1}, dst.IP.To4()...)
+	datagram = append(datagram, byte(dst.Port>>8), byte(dst.Port))
+	uc.Write(append(datagram, "hello"...))
+
+	buf := make([]byte, 1024)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:len(datagram)], datagram) || !strings.HasSuffix(string(buf[:n]), "HELLO") {
+		t.Errorf("got datagram %q", buf[:n])
+	}
+}
+
+func TestMuxListener(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	mux, conns, err := bandwidth.InterceptListenMux("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	go http.Serve(mux.HTTP(), proxy)
+	go (&goproxy.SocksServer{Proxy: proxy}).Serve(mux.SOCKS())
+	addr := mux.Addr().String()
+
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: acceptAllCerts}}
+	if body := string(getOrFail(srv.URL+"/bobo", client, t)); body != "bobo" {
+		t.Errorf("HTTP proxy body = %q, want bobo", body)
+	}
+	client = socksClient(addr, nil, t)
+	if body := string(getOrFail(https.URL+"/bobo", client, t)); body != "bobo" {
+		t.Errorf("SOCKS body = %q, want bobo", body)
+	}
+
+	// no TLS listener was asked for
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte{0x16, 3, 1, 0, 0})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("TLS connection read error %v, want EOF", err)
+	}
+	c.Close()
+
+	// the bytes peeked are counted once
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5, 1, 0})
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	counted, ok := conns.Find(c.LocalAddr().String())
+	if !ok {
+		t.Fatal("connection not in the ConnMap")
+	}
+	if n := counted.(*bandwidth.InterceptConn).BytesRead(); n != 3 {
+		t.Errorf("BytesRead = %d, want 3", n)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+)
+
+// StartSpan starts a span as a child of the span of the current transaction, so that
+// handlers can time their own work. The returned span must be ended by the caller.
+// It returns nil, on which all span methods are no-ops, when the proxy has no Tracer.
+func (ctx *ProxyCtx) StartSpan(name string) *tracing.Span {
+	return ctx.span.Child(name, tracing.SpanKindInternal)
+}
+
+// SpanContext returns the span context of the current transaction, the zero value
+// if the transaction is not traced.
+func (ctx *ProxyCtx) SpanContext() tracing.SpanContext {
+	return ctx.span.Context()
+}
+
+// startTransaction starts the root span of the transaction handled by ctx. The span joins
+// the trace of the traceparent header of r if present, and fallback otherwise.
+func (ctx *ProxyCtx) startTransaction(name string, r *http.Request, fallback tracing.SpanContext) {
+	if ctx.Proxy.Tracer == nil {
+		return
+	}
+	parent, ok := tracing.Extract(r.Header)
+	if !ok {
+		parent = fallback
+	}
+	ctx.span = ctx.Proxy.Tracer.Start(parent, name, tracing.SpanKindServer)
+	ctx.span.SetAttribute("http.method", r.Method)
+	ctx.span.SetAttribute("http.url", r.URL.String())
+	ctx.span.SetAttribute("net.peer.addr", r.RemoteAddr)
+	ctx.span.SetAttribute("proxy.session", ctx.Session)
+}
+
+// clientTrace reports the DNS lookups, dials and TLS handshakes of a round trip as
+// children of span.
+func clientTrace(span *tracing.Span) *httptrace.ClientTrace {
+	var (
+		mu       sync.Mutex
+		dns      *tracing.Span
+		connects = map[string]*tracing.Span{}
+		tlsSpan  *tracing.Span
+	)
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dns = span.Child("proxy.dns", tracing.SpanKindClient)
+			dns.SetAttribute("net.host.name", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			dns.RecordError(info.Err)
+			dns.End()
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			s := span.Child("proxy.dial", tracing.SpanKindClient)
+			s.SetAttribute("net.peer.addr", addr)
+			connects[network+"/"+addr] = s
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			s := connects[network+"/"+addr]
+			delete(connects, network+"/"+addr)
+			s.RecordError(err)
+			s.End()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsSpan = span.Child("proxy.tls.upstream", tracing.SpanKindClient)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsSpan.SetAttribute("tls.server_name", state.ServerName)
+			tlsSpan.RecordError(err)
+			tlsSpan.End()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.SetAttribute("net.reused", info.Reused)
+			if info.Conn != nil {
+				span.SetAttribute("net.peer.addr", info.Conn.RemoteAddr().String())
+			}
+		},
+	}
+}
@@ -0,0 +1,281 @@
+// Package tracing records spans describing the work done by the proxy, and
+// ships them to an Exporter. Trace context is propagated with the W3C
+// traceparent header (https://www.w3.org/TR/trace-context/).
+//
+// All the methods of Tracer and Span can be called on nil values, in which case
+// they do nothing. This lets instrumented code run unchanged when tracing is
+// disabled.
+package tracing
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeros.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeros.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// FlagSampled is the sampled bit of the trace flags.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// Remote is true when the context was extracted from an incoming request.
+	Remote bool
+}
+
+// IsValid reports whether sc has both a trace and a span id.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind describes the relationship of a span to its remote peers.
+type SpanKind int
+
+// The span kinds, numbered as in OTLP.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Attribute is a key-value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is the immutable record of a finished span, handed to exporters.
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Err is set when the span recorded a failure.
+	Err string
+}
+
+// Exporter ships finished spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(service string, spans []SpanData) error
+}
+
+// Tracer creates spans and exports them in batches.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	// OnError is called when exporting fails; errors are dropped when nil.
+	OnError func(err error)
+
+	mu      sync.Mutex
+	pending []SpanData
+	kick    chan struct{}
+	done    chan struct{}
+	closed  bool
+	wg      sync.WaitGroup
+	rnd     *rand.Rand
+}
+
+// BatchSize is the number of finished spans that triggers an export.
+var BatchSize = 128
+
+// BatchTimeout is the longest time a finished span waits before being exported.
+var BatchTimeout = 5 * time.Second
+
+// NewTracer returns a Tracer exporting the spans of the named service to exp.
+// Call Shutdown to export the remaining spans when done.
+func NewTracer(service string, exp Exporter) *Tracer {
+	var seed [8]byte
+	crand.Read(seed[:])
+	t := &Tracer{
+		service:  service,
+		exporter: exp,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		rnd:      rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t
+}
+
+func (t *Tracer) loop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(BatchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.kick:
+		case <-ticker.C:
+		case <-t.done:
+			t.Flush()
+			return
+		}
+		t.Flush()
+	}
+}
+
+// Flush synchronously exports all finished spans.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exporter.ExportSpans(t.service, batch); err != nil && t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+// Shutdown exports the remaining spans and stops the background exporter.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.mu.Unlock()
+	close(t.done)
+	t.wg.Wait()
+}
+
+func (t *Tracer) finish(d SpanData) {
+	t.mu.Lock()
+	t.pending = append(t.pending, d)
+	full := len(t.pending) >= BatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) ids() (tid TraceID, sid SpanID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rnd.Read(tid[:])
+	t.rnd.Read(sid[:])
+	return
+}
+
+// Start begins a new span. When parent is valid, the span joins its trace,
+// otherwise a new trace is started.
+func (t *Tracer) Start(parent SpanContext, name string, kind SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	tid, sid := t.ids()
+	s := &Span{tracer: t}
+	s.data = SpanData{
+		Name:    name,
+		Kind:    kind,
+		Context: SpanContext{TraceID: tid, SpanID: sid, Flags: FlagSampled},
+		Start:   time.Now(),
+	}
+	if parent.IsValid() {
+		s.data.Context.TraceID = parent.TraceID
+		s.data.Context.Flags = parent.Flags
+		s.data.Parent = parent.SpanID
+	}
+	return s
+}
+
+// Span is an operation being timed. A Span is safe for concurrent use.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Context returns the span context of s, or the zero SpanContext for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// Child starts a span as a child of s. It returns nil when s is nil.
+func (s *Span) Child(name string, kind SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.Start(s.data.Context, name, kind)
+}
+
+// SetAttribute records a key-value pair on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Attributes = append(s.data.Attributes, Attribute{key, value})
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed. It does nothing when err is nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	d := s.data
+	d.Attributes = append([]Attribute(nil), s.data.Attributes...)
+	s.mu.Unlock()
+	s.tracer.finish(d)
+}
+
+func (a Attribute) String() string {
+	return fmt.Sprintf("%s=%v", a.Key, a.Value)
+}
@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("valid traceparent rejected")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" ||
+		sc.Flags != FlagSampled || !sc.Remote {
+		t.Errorf("unexpected span context %+v", sc)
+	}
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Error("traceparent does not round trip", got)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("invalid traceparent %q accepted", invalid)
+		}
+	}
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("future version with extra fields should be accepted")
+	}
+}
+
+func TestNilSafety(t *testing.T) {
+	var tr *Tracer
+	s := tr.Start(SpanContext{}, "x", SpanKindInternal)
+	s.SetAttribute("k", "v")
+	s.RecordError(errors.New("e"))
+	s.Child("y", SpanKindInternal).End()
+	s.End()
+	tr.Flush()
+	tr.Shutdown()
+	h := http.Header{}
+	Inject(h, s)
+	if len(h) != 0 {
+		t.Error("nil span should not inject headers")
+	}
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) ExportSpans(service string, spans []SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	rec := &recorder{}
+	tr := NewTracer("test", rec)
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := tr.Start(parent, "root", SpanKindServer)
+	child := root.Child("child", SpanKindInternal)
+	child.RecordError(errors.New("boom"))
+	child.End()
+	child.End()
+	root.End()
+	tr.Shutdown()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(rec.spans))
+	}
+	c, r := rec.spans[0], rec.spans[1]
+	if r.Context.TraceID != parent.TraceID || r.Parent != parent.SpanID {
+		t.Error("root span did not join the remote trace")
+	}
+	if c.Context.TraceID != parent.TraceID || c.Parent != r.Context.SpanID {
+		t.Error("child span is not a child of root")
+	}
+	if c.Err != "boom" {
+		t.Error("error not recorded", c.Err)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer("test", NewStdoutExporter(&buf))
+	s := tr.Start(SpanContext{}, "op", SpanKindInternal)
+	s.SetAttribute("http.status_code", 200)
+	s.End()
+	tr.Shutdown()
+	var out map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if out["name"] != "op" || out["service"] != "test" {
+		t.Error("unexpected output", buf.String())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var received otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	exp := NewOTLPExporter(collector.URL + "/v1/traces")
+	tr := NewTracer("proxy", exp)
+	var exportErr error
+	tr.OnError = func(err error) { exportErr = err }
+	s := tr.Start(SpanContext{}, "op", SpanKindClient)
+	s.SetAttribute("net.peer.addr", "1.2.3.4:80")
+	s.RecordError(errors.New("refused"))
+	s.End()
+	tr.Shutdown()
+	if exportErr != nil {
+		t.Fatal(exportErr)
+	}
+
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request %+v", received)
+	}
+	if *received.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != "proxy" {
+		t.Error("service name not exported")
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "op" || spans[0].Kind != SpanKindClient {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	if spans[0].Status == nil || spans[0].Status.Code != otlpStatusError || !strings.Contains(spans[0].Status.Message, "refused") {
+		t.Error("error status not exported", spans[0].Status)
+	}
+	if len(spans[0].TraceID) != 32 || len(spans[0].SpanID) != 16 {
+		t.Error("ids are not hex encoded", spans[0].TraceID, spans[0].SpanID)
+	}
+}
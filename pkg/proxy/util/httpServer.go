@@ -1,15 +1,35 @@
 package util
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/acentior/go-httpproxy/pkg/logging"
 	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+	"github.com/acentior/go-httpproxy/pkg/proxy/accesslog"
 	"github.com/acentior/go-httpproxy/pkg/proxy/bandwidth"
+	"github.com/acentior/go-httpproxy/pkg/proxy/dns"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/adblock"
 	"github.com/acentior/go-httpproxy/pkg/proxy/ext/auth"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/bind"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/blocklist"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/har"
+	proxy_image "github.com/acentior/go-httpproxy/pkg/proxy/ext/image"
+	"github.com/acentior/go-httpproxy/pkg/proxy/ext/upstream"
+	"github.com/acentior/go-httpproxy/pkg/proxy/metrics"
+	"github.com/acentior/go-httpproxy/pkg/proxy/rotate"
+	"github.com/acentior/go-httpproxy/pkg/proxy/tracing"
+	"go.uber.org/zap/zapcore"
 )
 
 type ProxyConfig struct {
@@ -19,26 +39,380 @@ type ProxyConfig struct {
 	Password   string
 	CACertPath string `mapstructure:"PROXY_CA_CERT_PATH"`
 	CAKeyPath  string `mapstructure:"PROXY_CA_KEY_PATH"`
+	// SocksAddr is the address of the SOCKS4/SOCKS5 front-end, disabled when empty
+	SocksAddr string `mapstructure:"PROXY_SOCKS_ADDR"`
+	// TLSCertPath and TLSKeyPath are the certificate and key serving the proxy over TLS,
+	// reloaded when they change. The proxy is served in cleartext when empty
+	TLSCertPath string `mapstructure:"PROXY_TLS_CERT"`
+	TLSKeyPath  string `mapstructure:"PROXY_TLS_KEY"`
+	// TLSClientCAPath is the file of the CA certificates of the client certificates
+	// authenticating proxy users, the common name being the user
+	TLSClientCAPath string `mapstructure:"PROXY_TLS_CLIENT_CA"`
+	// TLSRequireClientCert rejects the TLS clients without a valid client certificate
+	TLSRequireClientCert bool `mapstructure:"PROXY_TLS_REQUIRE_CLIENT_CERT"`
+	// SinglePort serves SOCKS on the proxy address too, the protocol of each connection
+	// being detected from its first bytes
+	SinglePort bool `mapstructure:"PROXY_SINGLE_PORT"`
+	// Upstream are the comma separated URLs of the upstream proxies of all the traffic,
+	// http, https or socks5 with optional user:password credentials and "weight" query
+	// parameter, direct connections when empty
+	Upstream string `mapstructure:"PROXY_UPSTREAM"`
+	// UpstreamCheckURL is the URL fetched through the upstream proxies by their health
+	// checks, disabled when empty
+	UpstreamCheckURL string `mapstructure:"PROXY_UPSTREAM_CHECK_URL"`
+	// UpstreamBypass are the comma separated domains connected to directly
+	UpstreamBypass string `mapstructure:"PROXY_UPSTREAM_BYPASS"`
+	// BindAddrs are the comma separated local addresses of the connections to the
+	// servers, taken in turn, chosen by the system when empty
+	BindAddrs string `mapstructure:"PROXY_BIND"`
+	// BindUsers are the local addresses of the proxy users, as
+	// "alice=192.0.2.1,192.0.2.2;bob=192.0.2.3"
+	BindUsers string `mapstructure:"PROXY_BIND_USERS"`
+	// DNS is the DNS server resolving the hosts, an IP address, "udp://host:port" or the
+	// https URL of a DNS over HTTPS server, the system resolver when empty
+	DNS string `mapstructure:"PROXY_DNS"`
+	// DNSDomains are the DNS servers of domains, as
+	// "corp.example=10.0.0.53;lab.example=https://dns.lab.example/dns-query"
+	DNSDomains string `mapstructure:"PROXY_DNS_DOMAINS"`
+	// DNSHosts is the hosts file of the addresses of hosts overriding the DNS
+	DNSHosts string `mapstructure:"PROXY_DNS_HOSTS"`
+	// AllowPrivateNets lets the clients reach the loopback, private and link-local
+	// networks, denied by default
+	AllowPrivateNets bool `mapstructure:"PROXY_ALLOW_PRIVATE_NETS"`
+	// DenyNets are the comma separated CIDR blocks the clients cannot reach, in addition
+	// to the private networks
+	DenyNets string `mapstructure:"PROXY_DENY_NETS"`
+	// AllowNets are the comma separated CIDR blocks of the denied networks the clients
+	// can reach anyway
+	AllowNets string `mapstructure:"PROXY_ALLOW_NETS"`
+	// MetricsAddr is the address serving the Prometheus metrics, disabled when empty
+	MetricsAddr string `mapstructure:"PROXY_METRICS_ADDR"`
+	// TraceExporter is either "stdout" or the URL of an OTLP/HTTP traces endpoint,
+	// tracing is disabled when empty
+	TraceExporter string `mapstructure:"PROXY_TRACE_EXPORTER"`
+	// AccessLogPath is the file receiving the access log, "-" for stdout, disabled when empty
+	AccessLogPath string `mapstructure:"PROXY_ACCESS_LOG"`
+	// AccessLogFormat is "common", "combined", "json" or a text/template
+	AccessLogFormat string `mapstructure:"PROXY_ACCESS_LOG_FORMAT"`
+	// HARPath is the file recording the proxied traffic as HTTP Archive, disabled when empty
+	HARPath string `mapstructure:"PROXY_HAR"`
+	// FilterLists are the comma separated Adblock Plus filter list files blocking ads and
+	// trackers, disabled when empty
+	FilterLists string `mapstructure:"PROXY_FILTER_LISTS"`
+	// Blocklists are the comma separated hosts files, domain lists or RPZ zones of the
+	// domains to block, disabled when empty
+	Blocklists string `mapstructure:"PROXY_BLOCKLISTS"`
+	// Allowlists are the comma separated lists of the domains never blocked
+	Allowlists string `mapstructure:"PROXY_ALLOWLISTS"`
+	// ImageMaxDimension is the largest width or height of the images sent to clients,
+	// larger images being downscaled
+	ImageMaxDimension int `mapstructure:"PROXY_IMAGE_MAX_DIMENSION"`
+	// ImageQuality is the quality at which JPEG images are recompressed
+	ImageQuality int `mapstructure:"PROXY_IMAGE_QUALITY"`
 }
 
 func HttpServer(proxy *goproxy.ProxyHttpServer, cfg *ProxyConfig) (server *http.Server, listener net.Listener) {
 	logger := logging.DefaultLogger()
-	verbose := flag.Bool("v", true, "should every proxy request be logged to stdout")
+	verbose := flag.Bool("v", true, "log every step of every proxy request to stderr, otherwise only the warnings and errors")
 	addr := flag.String("addr", fmt.Sprintf("%s:%d", cfg.Addr, cfg.Port), "proxy listen address")
+	socksAddr := flag.String("socks-addr", cfg.SocksAddr, "SOCKS4/SOCKS5 listen address, disabled when empty")
+	singlePort := flag.Bool("single-port", cfg.SinglePort, "also serve SOCKS, and cleartext HTTP with -tls-cert, on the proxy listen address, detecting the protocol of each connection")
+	tlsCert := flag.String("tls-cert", cfg.TLSCertPath, "certificate file serving the proxy over TLS, reloaded when it changes, cleartext when empty")
+	tlsKey := flag.String("tls-key", cfg.TLSKeyPath, "key file of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", cfg.TLSClientCAPath, "CA certificates file of the client certificates authenticating users by their common name")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", cfg.TLSRequireClientCert, "reject the TLS clients without a valid client certificate")
+	socksUDP := flag.Bool("socks-udp", false, "enable the UDP ASSOCIATE command of SOCKS5")
+	upstreamURLs := flag.String("upstream", cfg.Upstream, `comma separated upstream proxy URLs of all the traffic, http, https or socks5 with optional user:password credentials and "weight" query parameter, direct connections when empty`)
+	upstreamStrategy := flag.String("upstream-strategy", "round-robin", `spreading of the requests over the upstream proxies: "round-robin", "random", "least-connections" or "weighted"`)
+	upstreamCheckURL := flag.String("upstream-check-url", cfg.UpstreamCheckURL, "URL fetched through the upstream proxies by their health checks, disabled when empty")
+	upstreamCheckInterval := flag.Duration("upstream-check-interval", 30*time.Second, "interval between the health checks of the upstream proxies")
+	upstreamSessionHeader := flag.String("upstream-session-header", "", "request header naming the sticky session of a client, keeping its upstream proxy")
+	upstreamSessionSeparator := flag.String("upstream-session-separator", "", `separator of the session suffix of the proxy users, as "-session-" in alice-session-42, keeping its upstream proxy`)
+	upstreamSessionTTL := flag.Duration("upstream-session-ttl", upstream.DefaultSessionTTL, "duration for which a sticky session keeps its upstream proxy")
+	upstreamBypass := flag.String("upstream-bypass", cfg.UpstreamBypass, "comma separated domains, with their subdomains, connected to directly instead of through -upstream")
+	bindAddrs := flag.String("bind", cfg.BindAddrs, "comma separated local addresses of the connections to the servers, taken in turn, chosen by the system when empty")
+	bindUsers := flag.String("bind-users", cfg.BindUsers, `local addresses of the proxy users, as "alice=192.0.2.1,192.0.2.2;bob=192.0.2.3"`)
+	bindHeader := flag.String("bind-header", "", "request header naming the pool of -bind-pools of the local addresses of the request, for trusted clients")
+	bindPools := flag.String("bind-pools", "", `local addresses named by -bind-header, as "eu=192.0.2.1;us=192.0.2.2,192.0.2.3"`)
+	dnsServer := flag.String("dns", cfg.DNS, `DNS server resolving the hosts: an IP address, "udp://host:port" or a DNS over HTTPS URL, the system resolver when empty`)
+	dnsDomains := flag.String("dns-domains", cfg.DNSDomains, `DNS servers of domains and their subdomains, as "corp.example=10.0.0.53;lab.example=https://dns.lab.example/dns-query"`)
+	dnsHosts := flag.String("dns-hosts", cfg.DNSHosts, "hosts file of the addresses of hosts overriding the DNS")
+	dnsUserHosts := flag.String("dns-user-hosts", "", `hosts files of the proxy users, as "alice=/etc/hosts.alice;bob=/etc/hosts.bob"`)
+	allowPrivateNets := flag.Bool("allow-private-nets", cfg.AllowPrivateNets, "let the clients reach the loopback, private, link-local and cloud metadata addresses")
+	denyNets := flag.String("deny-nets", cfg.DenyNets, "comma separated CIDR blocks the clients cannot reach, in addition to the private networks")
+	allowNets := flag.String("allow-nets", cfg.AllowNets, "comma separated CIDR blocks of the denied networks the clients can reach anyway")
+	viaMode := flag.String("via", "append", `Via header of the requests: "keep", "append", "replace" or "strip", the requests carrying the Via entry of the proxy being rejected as loops unless kept or stripped`)
+	viaPseudonym := flag.String("via-pseudonym", "", "name of the proxy in the Via headers, the host name when empty")
+	xForwardedMode := flag.String("x-forwarded", "keep", `X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers of the requests: "keep", "append", "replace" or "strip"`)
+	forwardedMode := flag.String("forwarded", "keep", `Forwarded header of the requests: "keep", "append", "replace" or "strip"`)
+	metricsAddr := flag.String("metrics-addr", cfg.MetricsAddr, "address serving the Prometheus metrics at /metrics, disabled when empty")
+	traceExporter := flag.String("trace", cfg.TraceExporter, `"stdout" or an OTLP/HTTP traces endpoint such as http://localhost:4318/v1/traces, tracing is disabled when empty`)
+	accessLogPath := flag.String("access-log", cfg.AccessLogPath, `access log file, "-" for stdout, disabled when empty`)
+	accessLogFormat := flag.String("access-log-format", cfg.AccessLogFormat, `access log format: "common", "combined", "json" or a Go template`)
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100, "size in MB at which the access log is rotated")
+	accessLogInterval := flag.Duration("access-log-rotate", 24*time.Hour, "interval at which the access log is rotated, 0 to disable")
+	harPath := flag.String("har", cfg.HARPath, "file recording the proxied traffic in HAR format, disabled when empty")
+	harMaxSize := flag.Int64("har-max-size", 100, "size in MB at which the HAR file is rotated")
+	blocklists := flag.String("blocklists", cfg.Blocklists, "comma separated hosts files, domain lists or RPZ zones of blocked domains, disabled when empty")
+	allowlists := flag.String("allowlists", cfg.Allowlists, "comma separated lists of domains never blocked by the blocklists")
+	blocklistReload := flag.Duration("blocklist-reload", time.Minute, "interval at which the blocklists are checked for changes, 0 to disable")
+	filterLists := flag.String("filter-lists", cfg.FilterLists, "comma separated Adblock Plus filter list files, disabled when empty")
+	filterReload := flag.Duration("filter-reload", time.Minute, "interval at which the filter lists are checked for changes, 0 to disable")
+	imageMaxDimension := flag.Int("image-max-dimension", cfg.ImageMaxDimension, "largest width or height of the images, larger images are downscaled, 0 to disable")
+	imageQuality := flag.Int("image-quality", cfg.ImageQuality, "quality from 1 to 100 at which JPEG images are recompressed, image recompression is disabled when both this and -image-max-dimension are 0")
 	flag.Parse()
 
 	// Bandwidth counter
-	httpListener, httpsConns, err := bandwidth.InterceptListen("tcp", *addr)
+	var httpListener net.Listener
+	var httpsConns *bandwidth.ConnMap
+	var mux *bandwidth.MuxListener
+	var tlsConfig *tls.Config
+	var err error
+	if *tlsCert != "" {
+		tlsConfig, err = proxyTLSConfig(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer failed to load TLS configuration", "err", err)
+			return nil, nil
+		}
+	}
+	switch {
+	case *singlePort:
+		mux, httpsConns, err = bandwidth.InterceptListenMux("tcp", *addr)
+		if err == nil {
+			httpListener = mux.HTTP()
+		}
+	case tlsConfig != nil:
+		httpListener, httpsConns, err = bandwidth.InterceptListenTLSConfig("tcp", *addr, tlsConfig)
+	default:
+		httpListener, httpsConns, err = bandwidth.InterceptListen("tcp", *addr)
+	}
 	if err != nil {
 		logger.Errorw("proxy.util.HttpsServer failed to create httpListener", "err", err)
 		return nil, nil
 	}
+	if mux != nil && tlsConfig != nil {
+		tlsServer := &http.Server{Handler: proxy}
+		go func() {
+			logger.Infof("Start to TLS proxy server %s", *addr)
+			if err := tlsServer.Serve(tls.NewListener(mux.TLS(), bandwidth.TLSConfig(tlsConfig))); err != nil {
+				logger.Errorw("proxy.util.HttpServer TLS proxy server stopped", "err", err)
+			}
+		}()
+	}
+
+	level := zapcore.WarnLevel
+	if *verbose {
+		level = zapcore.DebugLevel
+	}
+	proxy.Log = goproxy.NewZapLogger(logging.NewStderrLogger(level))
+
+	switch *traceExporter {
+	case "":
+	case "stdout":
+		proxy.Tracer = tracing.NewTracer("go-httpproxy", tracing.NewStdoutExporter(os.Stdout))
+	default:
+		proxy.Tracer = tracing.NewTracer("go-httpproxy", tracing.NewOTLPExporter(*traceExporter))
+	}
+	if proxy.Tracer != nil {
+		proxy.Tracer.OnError = func(err error) {
+			logger.Warnw("proxy.util.HttpServer failed to export spans", "err", err)
+		}
+	}
+
+	if *accessLogPath != "" {
+		format, err := accesslog.ParseFormat(*accessLogFormat)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid access log format", "err", err)
+			return nil, nil
+		}
+		var out io.Writer = os.Stdout
+		if *accessLogPath != "-" {
+			out = &rotate.File{
+				Path:     *accessLogPath,
+				MaxSize:  *accessLogMaxSize << 20,
+				Interval: *accessLogInterval,
+			}
+		}
+		accessLog := accesslog.New(out, format)
+		accessLog.OnError = func(err error) {
+			logger.Warnw("proxy.util.HttpServer failed to write access log", "err", err)
+		}
+		proxy.AccessLog = accessLog
+	}
+
+	if *metricsAddr != "" {
+		metricsServer := MetricsServer(*metricsAddr)
+		go func() {
+			logger.Infof("Start to metrics server %s", *metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil {
+				logger.Errorw("proxy.util.HttpServer metrics server stopped", "err", err)
+			}
+		}()
+	}
 
-	proxy.Verbose = *verbose
+	if *upstreamURLs != "" {
+		pool := &upstream.Pool{
+			CheckURL:         *upstreamCheckURL,
+			SessionHeader:    *upstreamSessionHeader,
+			SessionSeparator: *upstreamSessionSeparator,
+			SessionTTL:       *upstreamSessionTTL,
+			OnError: func(err error) {
+				logger.Warnw("proxy.util.HttpServer upstream proxy failed", "err", err)
+			},
+		}
+		if pool.Strategy, err = upstream.ParseStrategy(*upstreamStrategy); err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid upstream strategy", "err", err)
+			return nil, nil
+		}
+		for _, s := range strings.Split(*upstreamURLs, ",") {
+			up, err := upstream.ParseUpstream(s)
+			if err != nil {
+				logger.Errorw("proxy.util.HttpServer invalid upstream proxy", "err", err)
+				return nil, nil
+			}
+			pool.Upstreams = append(pool.Upstreams, up)
+		}
+		chain := &upstream.Chain{Select: pool.Select, Done: pool.Done}
+		if *upstreamBypass != "" {
+			bypass := upstream.Rule{Hosts: strings.Split(*upstreamBypass, ",")}
+			chain.Select = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+				if bypass.Match(req, ctx) {
+					return nil, nil
+				}
+				return pool.Select(req, ctx)
+			}
+		}
+		chain.Register(proxy)
+		if *upstreamCheckURL != "" {
+			pool.Watch(*upstreamCheckInterval)
+		}
+	}
 
 	// Authenticate middleware
-	proxy.OnRequest().Do(auth.Basic("auth", authHandler(httpsConns, cfg.Username, cfg.Password)))
-	proxy.OnRequest().HandleConnect(auth.BasicConnect("auth", authHandler(httpsConns, cfg.Username, cfg.Password)))
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		proxy.OnRequest().Do(auth.ClientCert(certHandler(httpsConns)))
+		proxy.OnRequest().HandleConnect(auth.ClientCertConnect(certHandler(httpsConns)))
+	}
+	proxy.OnRequest().Do(auth.Basic("auth", authHandler(httpsConns, cfg.Username, cfg.Password, *upstreamSessionSeparator)))
+	proxy.OnRequest().HandleConnect(auth.BasicConnect("auth", authHandler(httpsConns, cfg.Username, cfg.Password, *upstreamSessionSeparator)))
+
+	if *bindAddrs != "" || *bindUsers != "" || *bindHeader != "" {
+		binder := &bind.Binder{Header: *bindHeader}
+		if *bindAddrs != "" {
+			binder.Default, err = bind.ParsePool(*bindAddrs)
+		}
+		if err == nil && *bindUsers != "" {
+			binder.Users, err = bind.ParsePools(*bindUsers)
+		}
+		if err == nil && *bindPools != "" {
+			binder.Pools, err = bind.ParsePools(*bindPools)
+		}
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid local addresses", "err", err)
+			return nil, nil
+		}
+		binder.Register(proxy)
+	}
+
+	if *dnsServer != "" || *dnsDomains != "" || *dnsHosts != "" || *dnsUserHosts != "" {
+		resolver, err := dnsResolver(*dnsServer, *dnsDomains, *dnsHosts, *dnsUserHosts)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid DNS configuration", "err", err)
+			return nil, nil
+		}
+		proxy.Resolver = resolver
+	}
+
+	proxy.Forwarding.Pseudonym = *viaPseudonym
+	for _, h := range []struct {
+		mode *goproxy.ForwardMode
+		name string
+	}{{&proxy.Forwarding.Via, *viaMode}, {&proxy.Forwarding.XForwarded, *xForwardedMode}, {&proxy.Forwarding.Forwarded, *forwardedMode}} {
+		if *h.mode, err = goproxy.ParseForwardMode(h.name); err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid forwarding header mode", "err", err)
+			return nil, nil
+		}
+	}
+	proxy.ListenAddrs = append(proxy.ListenAddrs, *addr)
+
+	if !*allowPrivateNets || *denyNets != "" {
+		policy, err := addrPolicy(*allowPrivateNets, *denyNets, *allowNets)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer invalid networks", "err", err)
+			return nil, nil
+		}
+		proxy.AddrPolicy = policy
+	}
+
+	if mux != nil {
+		socks := &goproxy.SocksServer{
+			Proxy:        proxy,
+			Authenticate: authHandler(httpsConns, cfg.Username, cfg.Password, *upstreamSessionSeparator),
+			UDP:          *socksUDP,
+		}
+		go serveSocks(socks, mux.SOCKS(), *addr)
+	}
+	if *socksAddr != "" {
+		socksListener, socksConns, err := bandwidth.InterceptListen("tcp", *socksAddr)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer failed to create socksListener", "err", err)
+			return nil, nil
+		}
+		socks := &goproxy.SocksServer{
+			Proxy:        proxy,
+			Authenticate: authHandler(socksConns, cfg.Username, cfg.Password, *upstreamSessionSeparator),
+			UDP:          *socksUDP,
+		}
+		go serveSocks(socks, socksListener, *socksAddr)
+	}
+
+	if *blocklists != "" {
+		var allow []string
+		if *allowlists != "" {
+			allow = strings.Split(*allowlists, ",")
+		}
+		list, err := blocklist.New(strings.Split(*blocklists, ","), allow)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer failed to load blocklists", "err", err)
+			return nil, nil
+		}
+		list.OnError = func(err error) {
+			logger.Warnw("proxy.util.HttpServer failed to reload blocklists", "err", err)
+		}
+		if *blocklistReload > 0 {
+			list.Watch(*blocklistReload)
+		}
+		list.Register(proxy)
+	}
+
+	if *filterLists != "" {
+		blocker, err := adblock.New(strings.Split(*filterLists, ",")...)
+		if err != nil {
+			logger.Errorw("proxy.util.HttpServer failed to load filter lists", "err", err)
+			return nil, nil
+		}
+		blocker.OnError = func(err error) {
+			logger.Warnw("proxy.util.HttpServer failed to reload filter lists", "err", err)
+		}
+		if *filterReload > 0 {
+			blocker.Watch(*filterReload)
+		}
+		blocker.Register(proxy)
+	}
+
+	if *imageMaxDimension > 0 || *imageQuality > 0 {
+		recompressor := &proxy_image.Recompressor{MaxDimension: *imageMaxDimension}
+		recompressor.Quality = *imageQuality
+		recompressor.Register(proxy)
+	}
+
+	if *harPath != "" {
+		recorder := har.NewRecorder(har.NewFile(*harPath, *harMaxSize<<20))
+		recorder.OnError = func(err error) {
+			logger.Warnw("proxy.util.HttpServer failed to write HAR entry", "err", err)
+		}
+		recorder.Register(proxy)
+	}
 
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		return req, req.Response
@@ -48,31 +422,152 @@ func HttpServer(proxy *goproxy.ProxyHttpServer, cfg *ProxyConfig) (server *http.
 	return &httpServer, httpListener
 }
 
-// authenticate user and initiate the bandwidth counter.
-func authHandler(httpsConns *bandwidth.ConnMap, username, password string) func(req *http.Request, user, passwd string) bool {
+func serveSocks(socks *goproxy.SocksServer, l net.Listener, addr string) {
 	logger := logging.DefaultLogger()
+	logger.Infof("Start to SOCKS server %s", addr)
+	if err := socks.Serve(l); err != nil {
+		logger.Errorw("proxy.util.HttpServer SOCKS server stopped", "err", err)
+	}
+}
+
+// proxyTLSConfig returns the configuration serving the proxy over TLS with the
+// certificate of certFile and keyFile, verifying the client certificates issued by
+// the CAs of clientCAFile if any.
+func proxyTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	keyPair, err := bandwidth.LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: keyPair.GetCertificate}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// dnsResolver returns the resolver of the proxy querying server, and the servers of
+// domains, with the overrides of the hosts files hosts and userHosts.
+func dnsResolver(server, domains, hosts, userHosts string) (*dns.Resolver, error) {
+	r := &dns.Resolver{}
+	var err error
+	if server != "" {
+		if r.Upstream, err = dns.ParseUpstream(server); err != nil {
+			return nil, err
+		}
+	}
+	if domains != "" {
+		if r.Domains, err = dns.ParseDomains(domains); err != nil {
+			return nil, err
+		}
+	}
+	if hosts != "" {
+		if r.Hosts, err = readHosts(hosts); err != nil {
+			return nil, err
+		}
+	}
+	if userHosts != "" {
+		r.UserHosts = make(map[string]map[string][]net.IP)
+		for _, entry := range strings.Split(userHosts, ";") {
+			i := strings.IndexByte(entry, '=')
+			if i < 0 {
+				return nil, fmt.Errorf("hosts file %q has no user", entry)
+			}
+			if r.UserHosts[strings.TrimSpace(entry[:i])], err = readHosts(strings.TrimSpace(entry[i+1:])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func readHosts(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dns.ParseHosts(f)
+}
+
+// addrPolicy returns the policy denying the networks of deny, and the private networks
+// unless allowPrivate, but the networks of allow.
+func addrPolicy(allowPrivate bool, deny, allow string) (*goproxy.AddrPolicy, error) {
+	policy := &goproxy.AddrPolicy{}
+	if !allowPrivate {
+		policy.Deny = append(policy.Deny, goproxy.DefaultDeniedNets...)
+	}
+	nets, err := goproxy.ParseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	policy.Deny = append(policy.Deny, nets...)
+	if policy.Allow, err = goproxy.ParseNets(allow); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// MetricsServer returns a server exposing the proxy metrics at /metrics on addr.
+func MetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	return &http.Server{Handler: mux, Addr: addr}
+}
+
+// authenticate user and initiate the bandwidth counter. The users may name a sticky
+// session after sessionSeparator.
+func authHandler(httpsConns *bandwidth.ConnMap, username, password, sessionSeparator string) func(req *http.Request, user, passwd string) bool {
 	return func(req *http.Request, user, passwd string) (authorized bool) {
-		// Set Username to interceptCon
-		authorized = false
 		// authenticate
-		authorized = authenticate(user, passwd, username, password)
+		authorized = authenticate(upstream.BaseUser(user, sessionSeparator), passwd, username, password)
 		// initiate the bandWidthCounter
-		remoteAddr := req.RemoteAddr
-		conn, ok := httpsConns.Find(remoteAddr)
-		if ok {
-			interceptConn, ok := conn.(*bandwidth.InterceptConn)
-			if ok {
-				interceptConn.OnClose = func(bytesRead, bytesWritten int) {
-					httpsConns.Pop(remoteAddr)
-					if authorized {
-						bandwidthCount(user, bytesRead, bytesWritten, remoteAddr)
-					}
-				}
-				logger.Infof("\tOnClose handler was set for %s", remoteAddr)
-			}
-		}
+		countBandwidth(httpsConns, req, user, authorized)
+		return
+	}
+}
+
+// certHandler initiates the bandwidth counter of the users authenticated by their TLS
+// client certificate.
+func certHandler(httpsConns *bandwidth.ConnMap) func(req *http.Request, user string) bool {
+	return func(req *http.Request, user string) bool {
+		countBandwidth(httpsConns, req, user, true)
+		return true
+	}
+}
+
+// countBandwidth sets the user of the connection of req, to count its bandwidth.
+func countBandwidth(httpsConns *bandwidth.ConnMap, req *http.Request, user string, authorized bool) {
+	logger := logging.DefaultLogger()
+	remoteAddr := req.RemoteAddr
+	conn, ok := httpsConns.Find(remoteAddr)
+	if !ok {
+		return
+	}
+	interceptConn, ok := conn.(*bandwidth.InterceptConn)
+	if !ok {
 		return
 	}
+	if authorized {
+		interceptConn.SetUser(user)
+	}
+	interceptConn.OnClose = func(bytesRead, bytesWritten int) {
+		httpsConns.Pop(remoteAddr)
+		if authorized {
+			bandwidthCount(user, bytesRead, bytesWritten, remoteAddr)
+		}
+	}
+	logger.Infof("\tOnClose handler was set for %s", remoteAddr)
 }
 
 // Authenticate with username and password
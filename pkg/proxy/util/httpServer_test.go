@@ -0,0 +1,105 @@
+package util
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goproxy "github.com/acentior/go-httpproxy/pkg/proxy"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// TestHttpServer checks the handlers of the proxy of HttpServer together, behind the
+// authentication of its users. HttpServer defines global flags, so it is served once.
+func TestHttpServer(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		io.WriteString(w, host)
+	}))
+	defer site.Close()
+
+	cfg := &ProxyConfig{
+		Addr:             "127.0.0.1",
+		Username:         "user",
+		Password:         "pass",
+		AllowPrivateNets: true,
+		Blocklists:       writeFile(t, "blocklist", "blocked.example\n"),
+		FilterLists:      writeFile(t, "filters", "[Adblock Plus 2.0]\n||ads.example^\n"),
+		BindUsers:        "user=127.0.0.2",
+	}
+	server, listener := HttpServer(goproxy.NewProxyHttpServer(), cfg)
+	if server == nil {
+		t.Fatal("HttpServer failed")
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := func(user string) *http.Client {
+		u := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+		if user != "" {
+			u.User = url.UserPassword(user, "pass")
+		}
+		return &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(u),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}}
+	}
+	get := func(user, u string) (string, error) {
+		resp, err := client(user).Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.Status + " " + string(body), err
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		if _, err := get("", site.URL); err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+			t.Errorf("CONNECT without credentials: %v, want 407", err)
+		}
+		if got, err := get("user", site.URL); err != nil || !strings.HasPrefix(got, "200") {
+			t.Errorf("CONNECT with credentials: %q %v", got, err)
+		}
+	})
+
+	t.Run("blocklist", func(t *testing.T) {
+		if _, err := get("user", "https://blocked.example/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+			t.Errorf("CONNECT to a blocked domain: %v, want 403", err)
+		}
+		if got, _ := get("user", "http://blocked.example/"); !strings.HasPrefix(got, "403") {
+			t.Errorf("request to a blocked domain: %q, want 403", got)
+		}
+	})
+
+	t.Run("adblock", func(t *testing.T) {
+		if _, err := get("user", "https://ads.example/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+			t.Errorf("CONNECT to a blocked host: %v, want 403", err)
+		}
+		if got, _ := get("user", "http://ads.example/banner.js"); !strings.HasPrefix(got, "403") {
+			t.Errorf("request to a blocked host: %q, want 403", got)
+		}
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		if got, err := get("user", site.URL); err != nil || got != "200 OK 127.0.0.2" {
+			t.Errorf("CONNECT of a bound user: %q %v, want it from 127.0.0.2", got, err)
+		}
+	})
+}
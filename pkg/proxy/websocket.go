@@ -25,15 +25,20 @@ func isWebSocketRequest(r *http.Request) bool {
 		headerContains(r.Header, "Upgrade", "websocket")
 }
 
-func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn) {
+func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn) {
 	targetURL := url.URL{Scheme: "wss", Host: req.URL.Host, Path: req.URL.Path}
 
 	// Connect to upstream
-	targetConn, err := tls.Dial("tcp", targetURL.Host, tlsConfig)
+	conn, err := proxy.connectDial(ctx, "tcp", targetURL.Host)
 	if err != nil {
 		ctx.Warnf("Error dialing target site: %v", err)
 		return
 	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = stripPort(targetURL.Host)
+	}
+	targetConn := tls.Client(conn, tlsConfig)
 	defer targetConn.Close()
 
 	// Perform handshake
@@ -78,6 +83,9 @@ func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWrite
 }
 
 func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) error {
+	// the upgrade is the only hop-by-hop header forwarded
+	removeHopHeaders(req.Header, req.Header.Get("Upgrade"))
+	proxy.forwardHeaders(req)
 	// write handshake request to target
 	err := req.Write(targetSiteConn)
 	if err != nil {
@@ -94,6 +102,8 @@ func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Reques
 		return err
 	}
 
+	removeHopHeaders(resp.Header, resp.Header.Get("Upgrade"))
+
 	// Run response through handlers
 	resp = proxy.filterResponse(resp, ctx)
 